@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/medunes/docker-dns/internal/diag"
+)
+
+// commands are the subcommands run instead of the server, e.g.
+// "docker-dns check-config --config=/etc/docker-dns/docker-dns.yaml". Each
+// takes the server's flags and returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"check-config": checkConfig,
+	"doctor":       doctor,
+	"print-config": printConfig,
+	"query":        query,
+}
+
+// checkConfig validates the configuration the server would run with.
+func checkConfig(args []string) int {
+	cfg, err := config.Parse(configArgs(args))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	fmt.Printf("configuration OK: serving %s on %s\n", strings.Join(cfg.TLDs, ","), strings.Join(cfg.Listen, ","))
+	return 0
+}
+
+// printConfig writes the merged configuration with the origin of every
+// value, then reports whether it is valid.
+func printConfig(args []string) int {
+	_, settings, err := config.Inspect(configArgs(args))
+	if settings != nil {
+		if werr := settings.WriteYAML(os.Stdout); werr != nil {
+			fmt.Fprintln(os.Stderr, werr)
+			return 1
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// configArgs accepts the config file as a leading argument, so that
+// "check-config FILE" works like "check-config --config=FILE".
+func configArgs(args []string) []string {
+	if len(args) > 0 && args[0] != "" && !strings.HasPrefix(args[0], "-") {
+		return append([]string{"--config=" + args[0]}, args[1:]...)
+	}
+	return args
+}
+
+// query sends one query to a running server and explains the answer:
+// "docker-dns query [@server] [flags] name [type]".
+func query(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s query [@server] [flags] name [type]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	q := diag.Query{}
+	fs.StringVar(&q.Server, "server", diag.DefaultServer, "docker-dns address, ip[:port]; also given as @ip[:port]")
+	fs.BoolVar(&q.TCP, "tcp", false, "Query over TCP instead of UDP")
+	fs.BoolVar(&q.DNSSEC, "dnssec", false, "Set the DO bit to request DNSSEC signatures")
+	fs.DurationVar(&q.Timeout, "timeout", 5*time.Second, "Timeout for the query")
+
+	var positional []string
+	for {
+		_ = fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	for _, arg := range positional {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			q.Server = arg[1:]
+		case q.Name == "":
+			q.Name = arg
+		case q.Type == "":
+			q.Type = arg
+		default:
+			fs.Usage()
+			return 2
+		}
+	}
+	if q.Name == "" {
+		fs.Usage()
+		return 2
+	}
+
+	res, err := diag.Run(context.Background(), q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := res.Write(os.Stdout); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// doctor checks the host integration of the configuration the server would
+// run with; without arguments, that of the installed package.
+func doctor(args []string) int {
+	if len(args) == 0 {
+		args = diag.PackageArgs("")
+	}
+	var checks []diag.Check
+	if cfg, err := config.Parse(configArgs(args)); err != nil {
+		checks = []diag.Check{{
+			Name:   "configuration",
+			Status: diag.StatusFail,
+			Detail: err.Error(),
+			Fix:    "fix the setting, then confirm with `docker-dns check-config`",
+		}}
+	} else {
+		checks = diag.NewDoctor(cfg).Run(context.Background())
+	}
+	ok, err := diag.WriteReport(os.Stdout, checks)
+	if err != nil || !ok {
+		return 1
+	}
+	return 0
+}
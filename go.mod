@@ -4,9 +4,12 @@ go 1.25.0
 
 require (
 	github.com/docker/docker v27.5.1+incompatible
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/miekg/dns v1.1.58
-	golang.org/x/sync v0.6.0
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/sync v0.16.0
 	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -32,9 +35,10 @@ require (
 	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.43.0 // indirect
 	go.opentelemetry.io/otel/metric v1.43.0 // indirect
 	go.opentelemetry.io/otel/trace v1.43.0 // indirect
-	golang.org/x/mod v0.14.0 // indirect
+	golang.org/x/crypto v0.49.0 // indirect
+	golang.org/x/mod v0.27.0 // indirect
 	golang.org/x/net v0.52.0 // indirect
 	golang.org/x/sys v0.42.0 // indirect
-	golang.org/x/tools v0.17.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 	gotest.tools/v3 v3.5.2 // indirect
 )
@@ -1,8 +1,10 @@
 // Package cache provides a thread-safe, TTL-bounded, size-limited DNS record cache
-// with background eviction and hit/miss telemetry.
+// with background eviction and hit/miss telemetry, and a typed LRU cache for
+// other bounded lookups.
 package cache
 
 import (
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,6 +23,14 @@ type Stats struct {
 	Entries int
 }
 
+// Item is a read-only view of a live cache entry, as returned by Items.
+type Item struct {
+	Key    string
+	Values []string
+	// TTL is the time remaining until the entry expires.
+	TTL time.Duration
+}
+
 // Cache is a concurrency-safe, TTL-backed cache for DNS records.
 // Expired entries are removed by a background goroutine; when maxSize is
 // exceeded the oldest entry is evicted immediately.
@@ -78,7 +88,13 @@ func (c *Cache) Get(key string) ([]string, bool) {
 // Set stores values for key, overwriting any existing entry.
 // If maxSize > 0 and the cache is full, the oldest entry is evicted first.
 func (c *Cache) Set(key string, values []string) {
-	if len(values) == 0 {
+	c.SetWithTTL(key, values, c.ttl)
+}
+
+// SetWithTTL is like Set but uses ttl instead of the cache-wide TTL, for
+// entries whose lifetime is dictated by their content (e.g. DNS record TTLs).
+func (c *Cache) SetWithTTL(key string, values []string, ttl time.Duration) {
+	if len(values) == 0 || ttl <= 0 {
 		return // do not cache empty results
 	}
 
@@ -91,14 +107,61 @@ func (c *Cache) Set(key string, values []string) {
 	if c.maxSize > 0 && len(c.items) >= c.maxSize {
 		c.evictOldestLocked()
 	}
-	c.items[key] = entry{values: cp, expiry: time.Now().Add(c.ttl)}
+	c.items[key] = entry{values: cp, expiry: time.Now().Add(ttl)}
 }
 
-// Delete removes a specific key from the cache.
-func (c *Cache) Delete(key string) {
+// Delete removes a specific key from the cache and reports whether it held
+// a valid (non-expired) entry.
+func (c *Cache) Delete(key string) bool {
 	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
 	delete(c.items, key)
+	return ok && !time.Now().After(e.expiry)
+}
+
+// DeleteFunc removes every entry whose key satisfies match and returns the
+// number of entries removed.
+func (c *Cache) DeleteFunc(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k := range c.items {
+		if match(k) {
+			delete(c.items, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Flush removes all entries and returns how many were dropped.
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	n := len(c.items)
+	c.items = make(map[string]entry)
 	c.mu.Unlock()
+	return n
+}
+
+// Items returns a snapshot of all non-expired entries sorted by key.
+// Values are copied so callers cannot mutate cached state.
+func (c *Cache) Items() []Item {
+	now := time.Now()
+	c.mu.RLock()
+	items := make([]Item, 0, len(c.items))
+	for k, e := range c.items {
+		if now.After(e.expiry) {
+			continue
+		}
+		cp := make([]string, len(e.values))
+		copy(cp, e.values)
+		items = append(items, Item{Key: k, Values: cp, TTL: e.expiry.Sub(now)})
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items
 }
 
 // Stats returns a point-in-time snapshot of cache metrics.
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -45,6 +46,26 @@ func TestExpiry(t *testing.T) {
 	}
 }
 
+func TestSetWithTTL(t *testing.T) {
+	c := New(time.Hour, 0)
+	defer c.Stop()
+
+	c.SetWithTTL("short", []string{"a"}, 50*time.Millisecond)
+	c.Set("long", []string{"b"})
+	c.SetWithTTL("never", []string{"c"}, 0)
+
+	if _, hit := c.Get("never"); hit {
+		t.Error("expected a non-positive TTL not to be stored")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, hit := c.Get("short"); hit {
+		t.Error("expected the per-entry TTL to override the cache TTL")
+	}
+	if _, hit := c.Get("long"); !hit {
+		t.Error("expected the cache-wide TTL to still apply to Set")
+	}
+}
+
 func TestNoCacheEmptyValues(t *testing.T) {
 	c := New(5*time.Second, 0)
 	defer c.Stop()
@@ -77,7 +98,12 @@ func TestDelete(t *testing.T) {
 	defer c.Stop()
 
 	c.Set("del.docker.", []string{"9.9.9.9"})
-	c.Delete("del.docker.")
+	if !c.Delete("del.docker.") {
+		t.Error("Delete reported no entry for a cached key")
+	}
+	if c.Delete("del.docker.") {
+		t.Error("Delete reported an entry for a missing key")
+	}
 
 	if _, hit := c.Get("del.docker."); hit {
 		t.Fatal("expected miss after Delete")
@@ -141,3 +167,52 @@ func TestStats(t *testing.T) {
 		t.Errorf("expected 1 entry, got %d", stats.Entries)
 	}
 }
+
+func TestDeleteFuncAndFlush(t *testing.T) {
+	c := New(10*time.Second, 0)
+	defer c.Stop()
+
+	c.Set("a.docker.", []string{"1.1.1.1"})
+	c.Set("b.docker.", []string{"2.2.2.2"})
+	c.Set("c.local.", []string{"3.3.3.3"})
+
+	n := c.DeleteFunc(func(k string) bool { return strings.HasSuffix(k, ".docker.") })
+	if n != 2 {
+		t.Errorf("DeleteFunc removed %d entries, want 2", n)
+	}
+	if _, hit := c.Get("c.local."); !hit {
+		t.Error("DeleteFunc removed a non-matching entry")
+	}
+
+	if n := c.Flush(); n != 1 {
+		t.Errorf("Flush removed %d entries, want 1", n)
+	}
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Errorf("expected empty cache after Flush, got %d entries", stats.Entries)
+	}
+}
+
+func TestItems(t *testing.T) {
+	c := New(10*time.Second, 0)
+	defer c.Stop()
+
+	c.Set("b.docker.", []string{"2.2.2.2"})
+	c.Set("a.docker.", []string{"1.1.1.1"})
+
+	items := c.Items()
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(items))
+	}
+	if items[0].Key != "a.docker." || items[1].Key != "b.docker." {
+		t.Errorf("items not sorted by key: %q, %q", items[0].Key, items[1].Key)
+	}
+	if items[0].TTL <= 0 || items[0].TTL > 10*time.Second {
+		t.Errorf("unexpected remaining TTL %v", items[0].TTL)
+	}
+
+	// Mutating the snapshot must not affect the cache.
+	items[0].Values[0] = "mutated"
+	if vals, _ := c.Get("a.docker."); vals[0] != "1.1.1.1" {
+		t.Errorf("Items returned shared state: %s", vals[0])
+	}
+}
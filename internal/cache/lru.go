@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LRU is a concurrency-safe, size-bounded cache of typed values that expire
+// individually. When full, the least recently used entry is evicted in
+// constant time. Expired entries are dropped when read or evicted, so no
+// background goroutine is needed.
+//
+// Values are returned as stored: callers that modify them must copy first.
+type LRU[V any] struct {
+	mu      sync.Mutex
+	order   *list.List // front is the most recently used
+	items   map[string]*list.Element
+	maxSize int
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// lruEntry is the list element payload of an LRU.
+type lruEntry[V any] struct {
+	key    string
+	value  V
+	expiry time.Time
+}
+
+// NewLRU creates an LRU holding at most maxSize entries (0 = unbounded).
+func NewLRU[V any](maxSize int) *LRU[V] {
+	return &LRU[V]{
+		order:   list.New(),
+		items:   make(map[string]*list.Element),
+		maxSize: maxSize,
+	}
+}
+
+// Get returns the value stored under key and whether it was a valid
+// (non-expired) hit.
+func (c *LRU[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok && time.Now().After(el.Value.(*lruEntry[V]).expiry) {
+		c.removeLocked(el)
+		ok = false
+	}
+	if !ok {
+		c.misses.Add(1)
+		var zero V
+		return zero, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry[V]).value, true
+}
+
+// Set stores value under key for ttl, overwriting any existing entry. A
+// non-positive ttl stores nothing.
+func (c *LRU[V]) Set(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	expiry := time.Now().Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry[V])
+		e.value, e.expiry = value, expiry
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.maxSize > 0 && len(c.items) >= c.maxSize {
+		c.removeLocked(c.order.Back())
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expiry: expiry})
+}
+
+// Flush removes all entries and returns how many were dropped.
+func (c *LRU[V]) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.items)
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	return n
+}
+
+// Stats returns a point-in-time snapshot of cache metrics. Entries may
+// include expired values not yet dropped.
+func (c *LRU[V]) Stats() Stats {
+	c.mu.Lock()
+	n := len(c.items)
+	c.mu.Unlock()
+	return Stats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: n,
+	}
+}
+
+// removeLocked drops el. Must be called with c.mu held.
+func (c *LRU[V]) removeLocked(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry[V]).key)
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU_GetSet(t *testing.T) {
+	c := NewLRU[[]int](0)
+
+	if _, hit := c.Get("missing"); hit {
+		t.Fatal("expected miss for uncached key")
+	}
+	c.Set("a", []int{1, 2}, time.Minute)
+	c.Set("never", []int{3}, 0)
+
+	if v, hit := c.Get("a"); !hit || len(v) != 2 {
+		t.Errorf("Get(a) = %v, %v", v, hit)
+	}
+	if _, hit := c.Get("never"); hit {
+		t.Error("expected a non-positive TTL not to be stored")
+	}
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 2 || s.Entries != 1 {
+		t.Errorf("Stats() = %+v", s)
+	}
+}
+
+func TestLRU_Expiry(t *testing.T) {
+	c := NewLRU[string](0)
+	c.Set("short", "a", 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	if _, hit := c.Get("short"); hit {
+		t.Fatal("expected miss after TTL elapsed")
+	}
+	if n := c.Stats().Entries; n != 0 {
+		t.Errorf("expired entry kept after read: %d entries", n)
+	}
+}
+
+func TestLRU_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU[int](2)
+	c.Set("a", 1, time.Minute)
+	c.Set("b", 2, time.Minute)
+	c.Get("a") // b is now the least recently used
+	c.Set("c", 3, time.Minute)
+
+	if _, hit := c.Get("b"); hit {
+		t.Error("expected b to be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, hit := c.Get(k); !hit {
+			t.Errorf("expected %s to survive", k)
+		}
+	}
+
+	c.Set("a", 10, time.Minute) // overwrite does not evict
+	if v, _ := c.Get("a"); v != 10 || c.Stats().Entries != 2 {
+		t.Errorf("overwrite: a = %d, %d entries", v, c.Stats().Entries)
+	}
+	if n := c.Flush(); n != 2 || c.Stats().Entries != 0 {
+		t.Errorf("Flush() = %d, %d entries left", n, c.Stats().Entries)
+	}
+}
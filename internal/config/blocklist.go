@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Blocklist formats accepted by the format= option of --blocklist.
+const (
+	// FormatAuto picks rpz for .rpz/.zone files or files with an SOA record,
+	// adblock for files with "||" rules and hosts otherwise.
+	FormatAuto = "auto"
+	// FormatHosts reads hosts files ("0.0.0.0 ads.example") and plain
+	// one-domain-per-line lists.
+	FormatHosts = "hosts"
+	// FormatAdblock reads AdBlock-style domain rules ("||ads.example^",
+	// "@@||ok.example^").
+	FormatAdblock = "adblock"
+	// FormatRPZ reads response policy zone files; only QNAME triggers are
+	// supported.
+	FormatRPZ = "rpz"
+)
+
+// Blocklist actions accepted by the action= option of --blocklist.
+const (
+	// BlockNXDomain answers blocked names with NXDOMAIN.
+	BlockNXDomain = "nxdomain"
+	// BlockNoData answers blocked names with an empty NOERROR.
+	BlockNoData = "nodata"
+	// BlockSinkhole answers A and AAAA queries with the sinkhole addresses.
+	BlockSinkhole = "sinkhole"
+)
+
+// Blocklist is one filtering list applied to forwarded queries.
+type Blocklist struct {
+	// Name labels the list in logs and metrics; defaults to the file name
+	// without its extension.
+	Name string
+	// Path is the local list file.
+	Path string
+	// Format is one of the Format* constants.
+	Format string
+	// Action is what blocked names get (see Block* constants). RPZ records
+	// carry their own action and ignore it.
+	Action string
+	// Allow are files of names exempt from this list only, in any format.
+	Allow []string
+}
+
+// ParseBlocklist parses "path[,option=value...]" with the options name,
+// format, action and allow (repeatable):
+//
+//	/etc/docker-dns/ads.txt,action=sinkhole,allow=/etc/docker-dns/ads-allow.txt
+func ParseBlocklist(spec string) (Blocklist, error) {
+	parts := strings.Split(spec, ",")
+	l := Blocklist{
+		Path:   strings.TrimSpace(parts[0]),
+		Format: FormatAuto,
+		Action: BlockNXDomain,
+	}
+	if l.Path == "" {
+		return Blocklist{}, fmt.Errorf("invalid blocklist %q: missing path", spec)
+	}
+	for _, opt := range parts[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(opt), "=")
+		value = strings.TrimSpace(value)
+		if !found || value == "" {
+			return Blocklist{}, fmt.Errorf("invalid blocklist %q: expected option=value, got %q", spec, opt)
+		}
+		switch key {
+		case "name":
+			l.Name = value
+		case "format":
+			l.Format = strings.ToLower(value)
+		case "action":
+			l.Action = strings.ToLower(value)
+		case "allow":
+			l.Allow = append(l.Allow, value)
+		default:
+			return Blocklist{}, fmt.Errorf("invalid blocklist %q: unknown option %q", spec, key)
+		}
+	}
+	if l.Name == "" {
+		base := filepath.Base(l.Path)
+		l.Name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	if err := l.validate(); err != nil {
+		return Blocklist{}, fmt.Errorf("invalid blocklist %q: %w", spec, err)
+	}
+	return l, nil
+}
+
+func (l Blocklist) validate() error {
+	if l.Name == "" || l.Path == "" {
+		return fmt.Errorf("needs a name and a path")
+	}
+	switch l.Format {
+	case FormatAuto, FormatHosts, FormatAdblock, FormatRPZ:
+	default:
+		return fmt.Errorf("unknown format %q; must be one of: %s, %s, %s, %s", l.Format, FormatAuto, FormatHosts, FormatAdblock, FormatRPZ)
+	}
+	switch l.Action {
+	case BlockNXDomain, BlockNoData, BlockSinkhole:
+	default:
+		return fmt.Errorf("unknown action %q; must be one of: %s, %s, %s", l.Action, BlockNXDomain, BlockNoData, BlockSinkhole)
+	}
+	return nil
+}
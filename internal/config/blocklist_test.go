@@ -0,0 +1,48 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Blocklist
+		wantErr bool
+	}{
+		{
+			spec: "/etc/lists/ads.txt",
+			want: Blocklist{Name: "ads", Path: "/etc/lists/ads.txt", Format: FormatAuto, Action: BlockNXDomain},
+		},
+		{
+			spec: "/etc/lists/ads.txt, name=Ads, format=AdBlock, action=sinkhole, allow=/a.txt, allow=/b.txt",
+			want: Blocklist{Name: "Ads", Path: "/etc/lists/ads.txt", Format: FormatAdblock, Action: BlockSinkhole, Allow: []string{"/a.txt", "/b.txt"}},
+		},
+		{
+			spec: "malware.rpz,format=rpz",
+			want: Blocklist{Name: "malware", Path: "malware.rpz", Format: FormatRPZ, Action: BlockNXDomain},
+		},
+		{spec: "", wantErr: true},
+		{spec: ",action=nodata", wantErr: true},
+		{spec: "ads.txt,action=drop", wantErr: true},
+		{spec: "ads.txt,format=csv", wantErr: true},
+		{spec: "ads.txt,color=red", wantErr: true},
+		{spec: "ads.txt,allow=", wantErr: true},
+		{spec: "ads.txt,nodata", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBlocklist(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBlocklist(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got.Name != tt.want.Name || got.Path != tt.want.Path || got.Format != tt.want.Format ||
+			got.Action != tt.want.Action || !slices.Equal(got.Allow, tt.want.Allow) {
+			t.Errorf("ParseBlocklist(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -8,15 +8,21 @@ import (
 func TestValidate(t *testing.T) {
 	base := func() *Config {
 		return &Config{
-			ListenIP:       "127.0.0.1",
-			TLDs:           []string{"docker"},
-			TTL:            300 * time.Second,
-			Resolvers:      []string{"8.8.8.8"},
-			LogLevel:       "info",
-			RateLimit:      100,
-			RateBurst:      50,
-			DockerTimeout:  5 * time.Second,
-			ForwardTimeout: 2 * time.Second,
+			Listen:          []string{"127.0.0.1:53"},
+			TLDs:            []string{"docker"},
+			TTL:             300 * time.Second,
+			Resolvers:       []string{"8.8.8.8"},
+			LogLevel:        "info",
+			RateLimit:       100,
+			RateBurst:       50,
+			DockerTimeout:   5 * time.Second,
+			ForwardTimeout:  2 * time.Second,
+			ForwardStrategy: StrategyParallel,
+			ForwardRace:     2,
+			DoHMethod:       "POST",
+			ResolverSource:  SourceStatic,
+			ECSPolicy:       ECSPass,
+			DNSSECDenial:    DenialNSEC,
 		}
 	}
 
@@ -27,16 +33,98 @@ func TestValidate(t *testing.T) {
 	}{
 		{"valid baseline", func(c *Config) {}, false},
 		{"multiple TLDs", func(c *Config) { c.TLDs = []string{"docker", "local"} }, false},
-		{"invalid listen IP", func(c *Config) { c.ListenIP = "not-an-ip" }, true},
+		{"IPv6 and custom port listeners", func(c *Config) { c.Listen = []string{"127.0.0.153:53", "[::1]:5353"} }, false},
+		{"no listen address", func(c *Config) { c.Listen = nil }, true},
+		{"listen address without port", func(c *Config) { c.Listen = []string{"127.0.0.1"} }, true},
+		{"listen host name", func(c *Config) { c.Listen = []string{"localhost:53"} }, true},
+		{"bridge and network listeners", func(c *Config) { c.Listen = []string{"bridge:docker0:53", "network:my-net:5353"} }, false},
+		{"bridge listener without name", func(c *Config) { c.Listen = []string{"bridge::53"} }, true},
+		{"listen port out of range", func(c *Config) { c.Listen = []string{"127.0.0.1:65536"} }, true},
+		{"duplicate listen address", func(c *Config) { c.Listen = []string{"127.0.0.1:53", "127.0.0.1:53"} }, true},
 		{"no TLDs", func(c *Config) { c.TLDs = nil }, true},
 		{"empty TLD in list", func(c *Config) { c.TLDs = []string{""} }, true},
 		{"TLD with dot", func(c *Config) { c.TLDs = []string{"local.docker"} }, true},
 		{"zero TTL", func(c *Config) { c.TTL = 0 }, true},
 		{"no resolvers", func(c *Config) { c.Resolvers = nil }, true},
 		{"invalid resolver IP", func(c *Config) { c.Resolvers = []string{"not-an-ip"} }, true},
+		{"TLS resolver", func(c *Config) { c.Resolvers = []string{"tls://1.1.1.1@cloudflare-dns.com"} }, false},
+		{"HTTPS resolver", func(c *Config) { c.Resolvers = []string{"https://dns.google/dns-query"} }, false},
+		{"QUIC resolver", func(c *Config) { c.Resolvers = []string{"quic://dns.adguard-dns.com"} }, false},
+		{"bootstrap resolvers", func(c *Config) { c.BootstrapResolvers = []string{"9.9.9.9", "[::1]:5353"} }, false},
+		{"bootstrap resolver host name", func(c *Config) { c.BootstrapResolvers = []string{"dns.google"} }, true},
+		{"DoH GET", func(c *Config) { c.DoHMethod = "GET" }, false},
+		{"DoH PUT", func(c *Config) { c.DoHMethod = "PUT" }, true},
+		{"unsupported resolver scheme", func(c *Config) { c.Resolvers = []string{"ftp://1.1.1.1"} }, true},
 		{"negative rate limit", func(c *Config) { c.RateLimit = -1 }, true},
 		{"zero rate burst", func(c *Config) { c.RateBurst = 0 }, true},
 		{"invalid log level", func(c *Config) { c.LogLevel = "verbose" }, true},
+		{"sequential strategy", func(c *Config) { c.ForwardStrategy = StrategySequential }, false},
+		{"unknown strategy", func(c *Config) { c.ForwardStrategy = "random" }, true},
+		{"zero race size", func(c *Config) { c.ForwardRace = 0 }, true},
+		{"forward rule", func(c *Config) {
+			c.ForwardRules = []ForwardRule{{Zones: []string{"corp.example."}, Resolvers: []string{"10.8.0.1"}}}
+		}, false},
+		{"forward rule with bad resolver", func(c *Config) {
+			c.ForwardRules = []ForwardRule{{Zones: []string{"corp.example."}, Resolvers: []string{"bogus"}}}
+		}, true},
+		{"zone in two forward rules", func(c *Config) {
+			c.ForwardRules = []ForwardRule{
+				{Zones: []string{"corp.example."}, Resolvers: []string{"10.8.0.1"}},
+				{Zones: []string{"corp.example."}, Resolvers: []string{"10.8.0.2"}},
+			}
+		}, true},
+		{"file resolver source", func(c *Config) {
+			c.ResolverSource, c.ResolvConf, c.ResolverPoll = SourceFile, "/etc/resolv.conf", time.Second
+		}, false},
+		{"file resolver source without path", func(c *Config) {
+			c.ResolverSource, c.ResolverPoll = SourceFile, time.Second
+		}, true},
+		{"resolved source without poll interval", func(c *Config) { c.ResolverSource = SourceResolved }, true},
+		{"unknown resolver source", func(c *Config) { c.ResolverSource = "dhcp" }, true},
+		{"dnssec negative anchor", func(c *Config) {
+			c.DNSSECValidate, c.DNSSECNegativeAnchors = true, []string{"corp.example."}
+		}, false},
+		{"bad dnssec negative anchor", func(c *Config) { c.DNSSECNegativeAnchors = []string{"*.corp.example."} }, true},
+		{"synthesized ecs", func(c *Config) { c.ECSPolicy, c.ECSPrefix4, c.ECSPrefix6 = ECSSynthesize, 20, 48 }, false},
+		{"unknown ecs policy", func(c *Config) { c.ECSPolicy = "forward" }, true},
+		{"ecs v4 prefix too long", func(c *Config) { c.ECSPrefix4 = 33 }, true},
+		{"ecs v6 prefix negative", func(c *Config) { c.ECSPrefix6 = -1 }, true},
+		{"blocklists", func(c *Config) {
+			c.Blocklists = []Blocklist{{Name: "ads", Path: "ads.txt", Format: FormatAuto, Action: BlockSinkhole}}
+			c.BlocklistSinkhole = []string{"0.0.0.0", "::"}
+		}, false},
+		{"duplicate blocklist name", func(c *Config) {
+			l := Blocklist{Name: "ads", Path: "ads.txt", Format: FormatAuto, Action: BlockNXDomain}
+			c.Blocklists = []Blocklist{l, l}
+		}, true},
+		{"two IPv4 sinkholes", func(c *Config) { c.BlocklistSinkhole = []string{"0.0.0.0", "127.0.0.1"} }, true},
+		{"bad sinkhole", func(c *Config) { c.BlocklistSinkhole = []string{"blackhole"} }, true},
+		{"negative blocklist reload", func(c *Config) { c.BlocklistReload = -1 }, true},
+		{"DoH on the HTTP server", func(c *Config) { c.DoHServeHTTP, c.HTTPAddr = true, ":8080" }, false},
+		{"DoH without HTTP server", func(c *Config) { c.DoHServeHTTP = true }, true},
+		{"trusted DoH proxies", func(c *Config) { c.DoHTrustedProxies = []string{"10.0.0.0/8", "::1"} }, false},
+		{"bad trusted DoH proxy", func(c *Config) { c.DoHTrustedProxies = []string{"proxy.lan"} }, true},
+		{"DoH listener", func(c *Config) { c.DoHAddr, c.DoHCert, c.DoHKey = ":443", "cert.pem", "key.pem" }, false},
+		{"DoH listener without key", func(c *Config) { c.DoHAddr, c.DoHCert = ":443", "cert.pem" }, true},
+		{"DoH listener on the HTTP address", func(c *Config) {
+			c.HTTPAddr = ":8443"
+			c.DoHAddr, c.DoHCert, c.DoHKey = ":8443", "cert.pem", "key.pem"
+		}, true},
+		{"DoT listener", func(c *Config) {
+			c.DoTAddr, c.DoTCert, c.DoTKey, c.DoTClientCA = "0.0.0.0:853", "cert.pem", "key.pem", "clients.pem"
+		}, false},
+		{"DoT listener without certificate", func(c *Config) { c.DoTAddr = "0.0.0.0:853" }, true},
+		{"DoT client CA without listener", func(c *Config) { c.DoTClientCA = "clients.pem" }, true},
+		{"DoH certificate without listener", func(c *Config) { c.DoHCert = "cert.pem" }, true},
+		{"nsec3 denial", func(c *Config) { c.DNSSECSign, c.DNSSECDenial = true, DenialNSEC3 }, false},
+		{"unknown dnssec denial", func(c *Config) { c.DNSSECDenial = "nsec5" }, true},
+		{"separate admin addr", func(c *Config) { c.HTTPAddr = ":8080"; c.AdminAddr = "127.0.0.1:8081" }, false},
+		{"admin addr same as http addr", func(c *Config) { c.HTTPAddr = ":8080"; c.AdminAddr = ":8080" }, true},
+		{"admin addr on localhost", func(c *Config) { c.AdminAddr = "localhost:8081" }, false},
+		{"admin addr on ipv6 loopback", func(c *Config) { c.AdminAddr = "[::1]:8081" }, false},
+		{"unauthenticated admin on all interfaces", func(c *Config) { c.AdminAddr = ":8081" }, true},
+		{"unauthenticated admin on a public ip", func(c *Config) { c.AdminAddr = "0.0.0.0:8081" }, true},
+		{"authenticated admin on all interfaces", func(c *Config) { c.AdminAddr = ":8081"; c.AdminToken = "s3cret" }, false},
 	}
 
 	for _, tt := range tests {
@@ -83,3 +171,96 @@ func TestMatchLocalSuffix(t *testing.T) {
 		}
 	}
 }
+
+func TestAdminEnabled(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"disabled by default", Config{HTTPAddr: ":8080"}, false},
+		{"token on shared server", Config{HTTPAddr: ":8080", AdminToken: "s3cret"}, true},
+		{"token without http server", Config{AdminToken: "s3cret"}, false},
+		{"dedicated address", Config{AdminAddr: "127.0.0.1:8081"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.AdminEnabled(); got != tt.want {
+			t.Errorf("%s: AdminEnabled() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWithDefaultListenPort(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.153":         "127.0.0.153:53",
+		"[::1]:5353":          "[::1]:5353",
+		"::1":                 "[::1]:53",
+		"bridge:docker0":      "bridge:docker0:53",
+		"network:my-net:5353": "network:my-net:5353",
+	}
+	for in, want := range tests {
+		if got := withDefaultListenPort(in); got != want {
+			t.Errorf("withDefaultListenPort(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	tests := map[string]ListenSpec{
+		"127.0.0.153:53":      {Host: "127.0.0.153", Port: "53"},
+		"[::1]:5353":          {Host: "::1", Port: "5353"},
+		"bridge:docker0:53":   {Kind: ListenBridge, Host: "docker0", Port: "53"},
+		"network:my-net:5353": {Kind: ListenNetwork, Host: "my-net", Port: "5353"},
+	}
+	for in, want := range tests {
+		got, err := ParseListen(in)
+		if err != nil || got != want {
+			t.Errorf("ParseListen(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	if _, err := ParseListen("docker0:53"); err == nil {
+		t.Error("want an error for an interface name without bridge:")
+	}
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	tests := map[string]string{
+		"":               "",
+		"0.0.0.0":        "0.0.0.0:853",
+		"127.0.0.1:8853": "127.0.0.1:8853",
+		"::1":            "[::1]:853",
+		"[::1]":          "[::1]:853",
+		"[::1]:8853":     "[::1]:8853",
+		"dns.example":    "dns.example:853",
+	}
+	for in, want := range tests {
+		if got := withDefaultPort(in, "853"); got != want {
+			t.Errorf("withDefaultPort(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]string{"--tld=Docker,local", "--listen=127.0.0.153,[::1]:5353", "--rate-limit=5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.TLDs) != 2 || cfg.TLDs[0] != "docker" || cfg.RateLimit != 5 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Listen) != 2 || cfg.Listen[0] != "127.0.0.153:53" || cfg.Listen[1] != "[::1]:5353" {
+		t.Errorf("Listen = %v", cfg.Listen)
+	}
+
+	// Parsing again must not redefine flags.
+	cfg, err = Parse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listen) != 1 || cfg.Listen[0] != "127.0.0.153:53" {
+		t.Errorf("default Listen = %v", cfg.Listen)
+	}
+	if _, err := Parse([]string{"--ip=not-an-ip"}); err == nil {
+		t.Error("want a validation error")
+	}
+}
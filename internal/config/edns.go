@@ -0,0 +1,42 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ednsOptionCodes maps the names accepted by --forward-edns-options to their
+// EDNS0 option codes (IANA "DNS EDNS0 Option Codes" registry).
+var ednsOptionCodes = map[string]uint16{
+	"nsid":      3,  // RFC 5001
+	"subnet":    8,  // RFC 7871 client subnet
+	"expire":    9,  // RFC 7314
+	"cookie":    10, // RFC 7873
+	"keepalive": 11, // RFC 7828
+	"padding":   12, // RFC 7830
+	"chain":     13, // RFC 7901
+	"ede":       15, // RFC 8914 extended DNS errors
+}
+
+// ParseEDNSOptions parses a comma-separated list of EDNS0 option names or
+// numeric codes. "none" (or an empty list) selects no options.
+func ParseEDNSOptions(spec string) ([]uint16, error) {
+	var codes []uint16
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+		if code, ok := ednsOptionCodes[name]; ok {
+			codes = append(codes, code)
+			continue
+		}
+		code, err := strconv.ParseUint(name, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("unknown EDNS0 option %q", name)
+		}
+		codes = append(codes, uint16(code))
+	}
+	return codes, nil
+}
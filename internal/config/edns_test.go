@@ -0,0 +1,31 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseEDNSOptions(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []uint16
+		wantErr bool
+	}{
+		{spec: "nsid,subnet,cookie,padding,ede", want: []uint16{3, 8, 10, 12, 15}},
+		{spec: " Cookie , 65001 ", want: []uint16{10, 65001}},
+		{spec: "none", want: nil},
+		{spec: "", want: nil},
+		{spec: "bogus", wantErr: true},
+		{spec: "70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseEDNSOptions(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseEDNSOptions(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseEDNSOptions(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
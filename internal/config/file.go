@@ -0,0 +1,209 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the environment variables that set flags, e.g.
+// DOCKER_DNS_RATE_LIMIT for --rate-limit.
+const EnvPrefix = "DOCKER_DNS_"
+
+// configFlag names the flag (and DOCKER_DNS_CONFIG variable) holding the
+// config file path; it cannot be set from the file itself.
+const configFlag = "config"
+
+// applySources sets the flags not given on the command line from the config
+// file and the environment, giving the precedence
+// flags > environment > file > defaults. Repeatable flags take their values
+// from the highest-precedence source that sets them. It returns the origin
+// of every flag that is not at its default, and the config file path used.
+func applySources(fs *flag.FlagSet, path string, environ []string) (map[string]Origin, string, error) {
+	origins := make(map[string]Origin)
+	fs.Visit(func(f *flag.Flag) { origins[f.Name] = OriginFlag })
+
+	env, err := envValues(fs, environ)
+	if err != nil {
+		return nil, "", err
+	}
+	if path == "" && origins[configFlag] == "" {
+		path = strings.Join(env[configFlag], "")
+		if path != "" {
+			origins[configFlag] = OriginEnv
+		}
+	}
+	delete(env, configFlag)
+
+	values := make(map[string][]string)
+	if path != "" {
+		if values, err = fileValues(fs, path); err != nil {
+			return nil, "", err
+		}
+	}
+	sources := make(map[string]Origin, len(values))
+	for name := range values {
+		sources[name] = OriginFile
+	}
+	for name, v := range env {
+		values[name] = v
+		sources[name] = OriginEnv
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if origins[name] != "" {
+			continue
+		}
+		for _, v := range values[name] {
+			if err := fs.Set(name, v); err != nil {
+				return nil, "", fmt.Errorf("invalid value %q for %s: %w", v, name, err)
+			}
+		}
+		origins[name] = sources[name]
+	}
+	return origins, path, nil
+}
+
+// fileValues reads a YAML mapping of flag names to values. Lists are
+// accepted for repeatable flags and for comma-separated ones.
+func fileValues(fs *flag.FlagSet, path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return map[string][]string{}, nil // empty or comments only
+		}
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	root := &doc
+	if root.Kind == yaml.DocumentNode && len(root.Content) == 1 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file %s: line %d: want a mapping of option names to values", path, root.Line)
+	}
+
+	values := make(map[string][]string)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, val := root.Content[i], root.Content[i+1]
+		at := fmt.Sprintf("config file %s: line %d", path, key.Line)
+		f := fs.Lookup(key.Value)
+		if f == nil || key.Value == configFlag {
+			return nil, fmt.Errorf("%s: unknown key %q%s", at, key.Value, suggestion(fs, key.Value, false))
+		}
+		if _, dup := values[key.Value]; dup {
+			return nil, fmt.Errorf("%s: key %q is set more than once", at, key.Value)
+		}
+		switch val.Kind {
+		case yaml.ScalarNode:
+			values[key.Value] = []string{val.Value}
+		case yaml.SequenceNode:
+			var items []string
+			for _, item := range val.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("%s: %s must be a list of plain values", at, key.Value)
+				}
+				items = append(items, item.Value)
+			}
+			if _, repeatable := f.Value.(*stringList); repeatable {
+				values[key.Value] = items
+			} else {
+				values[key.Value] = []string{strings.Join(items, ",")}
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s must be a value or a list", at, key.Value)
+		}
+	}
+	return values, nil
+}
+
+// envValues collects the DOCKER_DNS_* variables. Repeatable flags take
+// several values separated by ";".
+func envValues(fs *flag.FlagSet, environ []string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	for _, kv := range environ {
+		key, val, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, EnvPrefix) {
+			continue
+		}
+		name := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(key, EnvPrefix), "_", "-"))
+		f := fs.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown environment variable %s%s", key, suggestion(fs, name, true))
+		}
+		if _, repeatable := f.Value.(*stringList); repeatable {
+			for _, v := range strings.Split(val, ";") {
+				if v = strings.TrimSpace(v); v != "" {
+					values[name] = append(values[name], v)
+				}
+			}
+			continue
+		}
+		values[name] = []string{val}
+	}
+	return values, nil
+}
+
+// EnvName returns the environment variable that sets the named flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// suggestion returns "; did you mean ...?" naming the closest known option,
+// spelled as an environment variable when asEnv is set.
+func suggestion(fs *flag.FlagSet, name string, asEnv bool) string {
+	best, bestDist := "", 3
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag && !asEnv {
+			return
+		}
+		if d := editDistance(name, f.Name); d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+	switch {
+	case best == "":
+		return ""
+	case asEnv:
+		return fmt.Sprintf("; did you mean %s?", EnvName(best))
+	default:
+		return fmt.Sprintf("; did you mean %q?", best)
+	}
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
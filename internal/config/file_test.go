@@ -0,0 +1,111 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "docker-dns.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParse_ConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+# comments are fine
+tld: [docker, local]
+rate-limit: 20
+http-addr: ""
+forward-timeout: 3s
+dnssec-validate: true
+forward-rule:
+  - corp.example=10.8.0.1
+  - lab.example,10.0.0.0/8=10.9.0.1
+`)
+	cfg, err := Parse([]string{"--config=" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cfg.TLDs, ",") != "docker,local" || cfg.RateLimit != 20 || cfg.HTTPAddr != "" ||
+		cfg.ForwardTimeout != 3*time.Second || !cfg.DNSSECValidate || len(cfg.ForwardRules) != 2 {
+		t.Errorf("config file not applied: %+v", cfg)
+	}
+	if cfg.RateBurst != 50 {
+		t.Errorf("RateBurst = %d, want the default for unset keys", cfg.RateBurst)
+	}
+}
+
+func TestParse_Precedence(t *testing.T) {
+	path := writeConfig(t, "rate-limit: 20\nrate-burst: 30\nttl: 60\nforward-rule: [corp.example=10.8.0.1]\n")
+	t.Setenv("DOCKER_DNS_CONFIG", path)
+	t.Setenv("DOCKER_DNS_RATE_LIMIT", "40")
+	t.Setenv("DOCKER_DNS_RATE_BURST", "45")
+	t.Setenv("DOCKER_DNS_FORWARD_RULE", "a.example=10.1.0.1; b.example=10.2.0.1")
+
+	cfg, err := Parse([]string{"--rate-limit=80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit != 80 {
+		t.Errorf("RateLimit = %v, want the flag to win", cfg.RateLimit)
+	}
+	if cfg.RateBurst != 45 {
+		t.Errorf("RateBurst = %d, want the environment over the file", cfg.RateBurst)
+	}
+	if cfg.TTL != time.Minute {
+		t.Errorf("TTL = %v, want the file over the default", cfg.TTL)
+	}
+	if len(cfg.ForwardRules) != 2 || cfg.ForwardRules[0].Zones[0] != "a.example." {
+		t.Errorf("ForwardRules = %+v, want the environment's list to replace the file's", cfg.ForwardRules)
+	}
+}
+
+func TestParse_ConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"unknown key", "rate-limt: 5\n", `line 1: unknown key "rate-limt"; did you mean "rate-limit"?`},
+		{"config key", "config: other.yaml\n", `unknown key "config"`},
+		{"duplicate key", "ttl: 5\nttl: 6\n", `line 2: key "ttl" is set more than once`},
+		{"nested value", "tld:\n  name: docker\n", "tld must be a value or a list"},
+		{"bad value", "rate-limit: fast\n", `invalid value "fast" for rate-limit`},
+		{"not a mapping", "- ttl\n", "want a mapping"},
+		{"invalid YAML", "ttl: [\n", "config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]string{"--config=" + writeConfig(t, tt.content)})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := Parse([]string{"--config=" + filepath.Join(t.TempDir(), "missing.yaml")}); err == nil {
+		t.Error("want an error for a missing config file")
+	}
+	if cfg, err := Parse([]string{"--config=" + writeConfig(t, "# nothing set\n")}); err != nil || cfg.TTL != 300*time.Second {
+		t.Errorf("an empty config file must keep the defaults: %v", err)
+	}
+}
+
+func TestParse_UnknownEnv(t *testing.T) {
+	t.Setenv("DOCKER_DNS_RATELIMIT", "5")
+	_, err := Parse(nil)
+	if err == nil || !strings.Contains(err.Error(), "DOCKER_DNS_RATELIMIT; did you mean DOCKER_DNS_RATE_LIMIT?") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("forward-edns-options"); got != "DOCKER_DNS_FORWARD_EDNS_OPTIONS" {
+		t.Errorf("EnvName() = %q", got)
+	}
+}
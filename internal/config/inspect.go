@@ -0,0 +1,112 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Origin tells where the effective value of an option comes from.
+type Origin string
+
+// Origins reported by Inspect, from the highest precedence to the lowest.
+const (
+	OriginFlag    Origin = "flag"
+	OriginEnv     Origin = "env"
+	OriginFile    Origin = "file"
+	OriginDefault Origin = "default"
+)
+
+// secretFlags are the options whose values WriteYAML does not print.
+var secretFlags = map[string]bool{"admin-token": true}
+
+// Setting is the effective value of one option.
+type Setting struct {
+	// Name is the flag name, which is also the config file key.
+	Name string
+	// Values holds the single value of an option, or every value of a
+	// repeatable one (none when it is unset).
+	Values []string
+	// Repeatable is set for options that may be given more than once.
+	Repeatable bool
+	// Origin is where the value comes from.
+	Origin Origin
+}
+
+// Settings is the merged view of every option, in flag name order.
+type Settings struct {
+	// File is the config file that was read ("" = none).
+	File string
+	// Options are the settings of every option except --config.
+	Options []Setting
+}
+
+func newSettings(fs *flag.FlagSet, origins map[string]Origin, path string) *Settings {
+	s := &Settings{File: path}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag {
+			return
+		}
+		opt := Setting{Name: f.Name, Origin: origins[f.Name]}
+		if opt.Origin == "" {
+			opt.Origin = OriginDefault
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			opt.Repeatable = true
+			opt.Values = append([]string(nil), *list...)
+		} else {
+			opt.Values = []string{f.Value.String()}
+		}
+		s.Options = append(s.Options, opt)
+	})
+	return s
+}
+
+// WriteYAML writes the settings as a config file, noting the origin of each
+// value in a comment. Secret values are replaced with a placeholder.
+func (s *Settings) WriteYAML(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, opt := range s.Options {
+		comment := string(opt.Origin)
+		if opt.Origin == OriginEnv {
+			comment += " " + EnvName(opt.Name)
+		}
+		values := opt.Values
+		if secretFlags[opt.Name] && len(values) == 1 && values[0] != "" {
+			values = []string{"<redacted>"}
+		}
+
+		var val *yaml.Node
+		if opt.Repeatable {
+			val = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+			for _, v := range values {
+				val.Content = append(val.Content, scalarNode(v))
+			}
+		} else {
+			val = scalarNode(values[0])
+		}
+		val.LineComment = comment
+		root.Content = append(root.Content, scalarNode(opt.Name), val)
+	}
+
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}
+	if s.File != "" {
+		doc.HeadComment = "config file: " + s.File
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("writing settings: %w", err)
+	}
+	return enc.Close()
+}
+
+func scalarNode(v string) *yaml.Node {
+	n := &yaml.Node{Kind: yaml.ScalarNode, Value: v}
+	if v == "" {
+		n.Style = yaml.DoubleQuotedStyle
+	}
+	return n
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInspect_Origins(t *testing.T) {
+	path := writeConfig(t, "rate-limit: 20\nttl: 60\nforward-rule: [corp.example=10.8.0.1]\n")
+	t.Setenv("DOCKER_DNS_RATE_BURST", "45")
+
+	_, settings, err := Inspect([]string{"--config=" + path, "--ttl=30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.File != path {
+		t.Errorf("File = %q, want %q", settings.File, path)
+	}
+	want := map[string]Setting{
+		"ttl":          {Values: []string{"30"}, Origin: OriginFlag},
+		"rate-burst":   {Values: []string{"45"}, Origin: OriginEnv},
+		"rate-limit":   {Values: []string{"20"}, Origin: OriginFile},
+		"forward-rule": {Values: []string{"corp.example=10.8.0.1"}, Origin: OriginFile, Repeatable: true},
+		"blocklist":    {Origin: OriginDefault, Repeatable: true},
+		"tld":          {Values: []string{"docker"}, Origin: OriginDefault},
+	}
+	for _, opt := range settings.Options {
+		if opt.Name == configFlag {
+			t.Error("the config flag must not be listed as an option")
+		}
+		w, ok := want[opt.Name]
+		if !ok {
+			continue
+		}
+		delete(want, opt.Name)
+		if opt.Origin != w.Origin || opt.Repeatable != w.Repeatable || strings.Join(opt.Values, ";") != strings.Join(w.Values, ";") {
+			t.Errorf("%s = %+v, want %+v", opt.Name, opt, w)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("missing settings: %v", want)
+	}
+}
+
+func TestInspect_InvalidConfigKeepsSettings(t *testing.T) {
+	_, settings, err := Inspect([]string{"--tld=a.b"})
+	if err == nil {
+		t.Fatal("want a validation error")
+	}
+	if settings == nil {
+		t.Fatal("want the settings next to a validation error")
+	}
+}
+
+func TestSettings_WriteYAML(t *testing.T) {
+	t.Setenv("DOCKER_DNS_ADMIN_TOKEN", "s3cret")
+	path := writeConfig(t, "forward-rule:\n  - corp.example=10.8.0.1\n  - lab.example,10.0.0.0/8=10.9.0.1\n")
+	_, settings, err := Inspect([]string{"--config=" + path, "--http-addr="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := settings.WriteYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# config file: " + path,
+		`http-addr: "" # flag`,
+		"admin-token: <redacted> # env DOCKER_DNS_ADMIN_TOKEN",
+		"forward-rule: [corp.example=10.8.0.1, 'lab.example,10.0.0.0/8=10.9.0.1'] # file",
+		"ttl: 300 # default",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "s3cret") {
+		t.Error("the admin token must not be printed")
+	}
+
+	// The output is itself a valid config file.
+	cfg, err := Parse([]string{"--config=" + writeConfig(t, out)})
+	if err != nil {
+		t.Fatalf("reading the output back: %v", err)
+	}
+	if len(cfg.ForwardRules) != 2 || cfg.HTTPAddr != "" || cfg.TTL != 300*time.Second {
+		t.Errorf("round trip lost settings: %+v", cfg)
+	}
+}
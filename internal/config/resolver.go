@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Upstream transport protocols understood by ParseResolver.
+const (
+	// ProtoUDP is classic DNS over UDP port 53.
+	ProtoUDP = "udp"
+	// ProtoTLS is DNS over TLS (RFC 7858), port 853 by default.
+	ProtoTLS = "tls"
+	// ProtoHTTPS is DNS over HTTPS (RFC 8484), port 443 by default.
+	ProtoHTTPS = "https"
+	// ProtoQUIC is DNS over QUIC (RFC 9250), port 853 by default.
+	ProtoQUIC = "quic"
+)
+
+// Resolver is a parsed upstream resolver specification.
+type Resolver struct {
+	// Proto is the upstream transport (see Proto* constants).
+	Proto string
+	// Addr is the host:port to dial.
+	Addr string
+	// ServerName is the name verified against the upstream's TLS certificate.
+	// Empty means the certificate must carry the dialled IP address.
+	ServerName string
+	// URL is the full endpoint of a DNS-over-HTTPS upstream.
+	URL string
+}
+
+// String returns the label used for the resolver in logs and metrics, in a
+// form ParseResolver accepts. Plain resolvers keep their bare host:port form;
+// encrypted ones name the verified server when it is not the dialled host.
+func (r Resolver) String() string {
+	switch r.Proto {
+	case ProtoUDP:
+		return r.Addr
+	case ProtoHTTPS:
+		return r.URL
+	}
+	label := r.Proto + "://" + r.Addr
+	if host, _, _ := net.SplitHostPort(r.Addr); r.ServerName != "" && r.ServerName != host {
+		label += "@" + r.ServerName
+	}
+	return label
+}
+
+// ParseResolver parses an upstream specification. Accepted forms are:
+//
+//	8.8.8.8                      plain DNS on port 53
+//	[2001:db8::1]:5353           plain DNS on an explicit port
+//	tls://1.1.1.1@cloudflare-dns.com
+//	tls://1.1.1.1:853            verifies the IP address SAN
+//	tls://dns.quad9.net          server name taken from the host
+//	https://dns.google/dns-query
+//	quic://dns.adguard-dns.com    same host forms as tls://
+func ParseResolver(spec string) (Resolver, error) {
+	scheme, rest, found := strings.Cut(spec, "://")
+	if !found {
+		scheme, rest = ProtoUDP, spec
+	}
+
+	switch scheme {
+	case ProtoUDP:
+		addr, err := ipHostPort(rest, "53")
+		if err != nil {
+			return Resolver{}, fmt.Errorf("invalid resolver IP %q", spec)
+		}
+		return Resolver{Proto: ProtoUDP, Addr: addr}, nil
+
+	case ProtoTLS, ProtoQUIC:
+		hostPort, serverName, _ := strings.Cut(rest, "@")
+		host, port, err := splitHostPortDefault(hostPort, "853")
+		if err != nil || host == "" {
+			return Resolver{}, fmt.Errorf("invalid %s resolver %q: expected %s://host[:port][@server-name]",
+				strings.ToUpper(scheme), spec, scheme)
+		}
+		if serverName == "" && net.ParseIP(host) == nil {
+			serverName = host
+		}
+		return Resolver{Proto: scheme, Addr: net.JoinHostPort(host, port), ServerName: serverName}, nil
+
+	case ProtoHTTPS:
+		u, err := url.Parse(spec)
+		if err != nil || u.Host == "" || u.User != nil {
+			return Resolver{}, fmt.Errorf("invalid HTTPS resolver %q: expected https://host[:port]/path", spec)
+		}
+		host, port, err := splitHostPortDefault(u.Host, "443")
+		if err != nil {
+			return Resolver{}, fmt.Errorf("invalid HTTPS resolver %q: %w", spec, err)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return Resolver{Proto: ProtoHTTPS, Addr: net.JoinHostPort(host, port), ServerName: host, URL: u.String()}, nil
+
+	default:
+		return Resolver{}, fmt.Errorf("unsupported resolver scheme %q in %q", scheme, spec)
+	}
+}
+
+// ipHostPort validates an IP literal with an optional port and returns it in
+// host:port form.
+func ipHostPort(s, defaultPort string) (string, error) {
+	host, port, err := splitHostPortDefault(s, defaultPort)
+	if err != nil {
+		return "", err
+	}
+	// netip accepts scoped link-local addresses such as fe80::1%eth0.
+	if _, err := netip.ParseAddr(host); err != nil {
+		return "", fmt.Errorf("%q is not an IP address", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// splitHostPortDefault splits s into host and port, falling back to
+// defaultPort when s has none. Bare IPv6 literals are accepted unbracketed.
+func splitHostPortDefault(s, defaultPort string) (host, port string, err error) {
+	host, port, err = net.SplitHostPort(s)
+	if err != nil {
+		// No port: accept a bare host name or (bracketed) IP literal.
+		host, port = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), defaultPort
+		if host == "" || strings.ContainsAny(host, "[]/@ ") ||
+			(strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+			return "", "", fmt.Errorf("invalid address %q", s)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port in %q", s)
+	}
+	return host, port, nil
+}
+
+// ParseBootstrap validates a bootstrap resolver (IP[:port]) and returns it in
+// host:port form.
+func ParseBootstrap(spec string) (string, error) {
+	addr, err := ipHostPort(spec, "53")
+	if err != nil {
+		return "", fmt.Errorf("invalid bootstrap resolver %q: must be an IP address", spec)
+	}
+	return addr, nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ForwardRule sends queries under any of its zones to a dedicated resolver
+// group instead of the default resolvers.
+type ForwardRule struct {
+	// Zones are lower-case FQDN suffixes such as "corp.example." or
+	// "10.in-addr.arpa.".
+	Zones []string
+	// Resolvers is the group's ordered resolver list (see ParseResolver).
+	Resolvers []string
+}
+
+// ParseForwardRule parses "zone[,zone...]=resolver[,resolver...]". A zone is
+// a domain suffix ("corp.example", "*.corp.example") or a CIDR, which is
+// expanded to the reverse zones covering it:
+//
+//	corp.example,10.0.0.0/8=10.8.0.1,tls://10.8.0.2@dns.corp.example
+func ParseForwardRule(spec string) (ForwardRule, error) {
+	zones, resolvers, found := strings.Cut(spec, "=")
+	if !found {
+		return ForwardRule{}, fmt.Errorf("invalid forward rule %q: expected zone[,zone...]=resolver[,resolver...]", spec)
+	}
+
+	var rule ForwardRule
+	for _, z := range strings.Split(zones, ",") {
+		if z = strings.TrimSpace(z); z == "" {
+			continue
+		}
+		if strings.Contains(z, "/") {
+			rev, err := ReverseZones(z)
+			if err != nil {
+				return ForwardRule{}, fmt.Errorf("invalid forward rule %q: %w", spec, err)
+			}
+			rule.Zones = append(rule.Zones, rev...)
+			continue
+		}
+		z = strings.ToLower(strings.Trim(strings.TrimPrefix(z, "*."), "."))
+		if z == "" || strings.ContainsAny(z, " *@:") {
+			return ForwardRule{}, fmt.Errorf("invalid forward rule %q: bad zone", spec)
+		}
+		rule.Zones = append(rule.Zones, z+".")
+	}
+	for _, r := range strings.Split(resolvers, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			rule.Resolvers = append(rule.Resolvers, r)
+		}
+	}
+
+	if len(rule.Zones) == 0 || len(rule.Resolvers) == 0 {
+		return ForwardRule{}, fmt.Errorf("invalid forward rule %q: needs at least one zone and one resolver", spec)
+	}
+	for _, r := range rule.Resolvers {
+		if _, err := ParseResolver(r); err != nil {
+			return ForwardRule{}, err
+		}
+	}
+	return rule, nil
+}
+
+// ReverseZones returns the in-addr.arpa or ip6.arpa zones covering cidr.
+// Prefixes that do not end on a label boundary (8 bits for IPv4, 4 for IPv6)
+// expand to every zone at the next boundary, e.g. 172.16.0.0/12 yields
+// 16.172.in-addr.arpa. through 31.172.in-addr.arpa.
+func ReverseZones(cidr string) ([]string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", cidr)
+	}
+	prefix = prefix.Masked()
+
+	addr := prefix.Addr()
+	unit, suffix, format := 8, "in-addr.arpa.", func(d int) string { return strconv.Itoa(d) }
+	if addr.Is6() {
+		unit, suffix, format = 4, "ip6.arpa.", func(d int) string { return strconv.FormatInt(int64(d), 16) }
+	}
+
+	// Split the address into label-sized digits, most significant first.
+	var digits []int
+	for _, b := range addr.AsSlice() {
+		if unit == 8 {
+			digits = append(digits, int(b))
+		} else {
+			digits = append(digits, int(b>>4), int(b&0x0f))
+		}
+	}
+
+	zone := func(ds []int) string {
+		labels := make([]string, 0, len(ds)+1)
+		for i := len(ds) - 1; i >= 0; i-- {
+			labels = append(labels, format(ds[i]))
+		}
+		return strings.Join(append(labels, suffix), ".")
+	}
+
+	whole, rest := prefix.Bits()/unit, prefix.Bits()%unit
+	if rest == 0 {
+		return []string{zone(digits[:whole])}, nil
+	}
+	span := 1 << (unit - rest)
+	zones := make([]string, 0, span)
+	for i := 0; i < span; i++ {
+		ds := append(append([]int(nil), digits[:whole]...), digits[whole]+i)
+		zones = append(zones, zone(ds))
+	}
+	return zones, nil
+}
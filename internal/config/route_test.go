@@ -0,0 +1,87 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    ForwardRule
+		wantErr bool
+	}{
+		{
+			spec: "corp.example=10.8.0.1",
+			want: ForwardRule{Zones: []string{"corp.example."}, Resolvers: []string{"10.8.0.1"}},
+		},
+		{
+			spec: "*.Corp.Example., lab.example = 10.8.0.1, tls://10.8.0.2@dns.corp.example",
+			want: ForwardRule{
+				Zones:     []string{"corp.example.", "lab.example."},
+				Resolvers: []string{"10.8.0.1", "tls://10.8.0.2@dns.corp.example"},
+			},
+		},
+		{
+			spec: "10.0.0.0/8,corp.example=10.8.0.1",
+			want: ForwardRule{Zones: []string{"10.in-addr.arpa.", "corp.example."}, Resolvers: []string{"10.8.0.1"}},
+		},
+		{spec: "corp.example", wantErr: true},
+		{spec: "=10.8.0.1", wantErr: true},
+		{spec: "corp.example=", wantErr: true},
+		{spec: "corp.example=not-an-ip", wantErr: true},
+		{spec: "10.0.0.0/33=10.8.0.1", wantErr: true},
+		{spec: "bad zone=10.8.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseForwardRule(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseForwardRule(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if !slices.Equal(got.Zones, tt.want.Zones) || !slices.Equal(got.Resolvers, tt.want.Resolvers) {
+			t.Errorf("ParseForwardRule(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestReverseZones(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want []string
+	}{
+		{"10.0.0.0/8", []string{"10.in-addr.arpa."}},
+		{"192.168.0.0/16", []string{"168.192.in-addr.arpa."}},
+		{"192.168.1.77/24", []string{"1.168.192.in-addr.arpa."}},
+		{"0.0.0.0/0", []string{"in-addr.arpa."}},
+		{"fd00::/8", []string{"d.f.ip6.arpa."}},
+		{"fd12:3456::/32", []string{"6.5.4.3.2.1.d.f.ip6.arpa."}},
+		{"fc00::/7", []string{"c.f.ip6.arpa.", "d.f.ip6.arpa."}},
+	}
+	for _, tt := range tests {
+		got, err := ReverseZones(tt.cidr)
+		if err != nil {
+			t.Errorf("ReverseZones(%q) error: %v", tt.cidr, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ReverseZones(%q) = %v, want %v", tt.cidr, got, tt.want)
+		}
+	}
+
+	// 172.16.0.0/12 spans sixteen /16 zones.
+	got, err := ReverseZones("172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 16 || got[0] != "16.172.in-addr.arpa." || got[15] != "31.172.in-addr.arpa." {
+		t.Errorf("ReverseZones(172.16.0.0/12) = %v", got)
+	}
+
+	if _, err := ReverseZones("10.0.0.0"); err == nil {
+		t.Error("expected error for a bare address")
+	}
+}
@@ -0,0 +1,553 @@
+package diag
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/medunes/docker-dns/internal/discovery"
+	"github.com/medunes/docker-dns/internal/docker"
+	"github.com/miekg/dns"
+)
+
+// Files of the Debian package and of the host integration its postinst sets
+// up, relative to Doctor.Root.
+const (
+	// PackageEnvFile holds the IP variable of the service's ExecStart.
+	PackageEnvFile = "/etc/docker-dns/docker-dns.conf"
+	// PackageConfig is the --config file of the service.
+	PackageConfig = "/etc/docker-dns/docker-dns.yaml"
+
+	resolvConf     = "/etc/resolv.conf"
+	resolvedDropIn = "/etc/systemd/resolved.conf.d/docker-dns.conf"
+	nmDispatcher   = "/etc/NetworkManager/dispatcher.d/docker-dns"
+)
+
+const (
+	// resolvedStub is the address of systemd-resolved's stub listener.
+	resolvedStub = "127.0.0.53"
+	// networkManagerBus is NetworkManager's D-Bus name.
+	networkManagerBus = "org.freedesktop.NetworkManager"
+	// defaultDockerSocket is used when neither --docker-host nor DOCKER_HOST
+	// is set.
+	defaultDockerSocket = "/var/run/docker.sock"
+	// probeContainer is the name queried to see whether a listener answers.
+	probeContainer = "docker-dns-doctor"
+	// checkTimeout bounds each network check.
+	checkTimeout = 3 * time.Second
+	// lookupCandidates caps the containers tried for the end-to-end lookup.
+	lookupCandidates = 5
+)
+
+// Status is the outcome of a check.
+type Status string
+
+// Check outcomes, from best to worst.
+const (
+	StatusPass Status = "PASS"
+	StatusSkip Status = "SKIP"
+	StatusWarn Status = "WARN"
+	StatusFail Status = "FAIL"
+)
+
+// Check is one finding of the doctor.
+type Check struct {
+	// Name is the area checked, e.g. "listen 127.0.0.153:53".
+	Name   string
+	Status Status
+	// Detail says what was found.
+	Detail string
+	// Fix suggests how to repair a warning or failure.
+	Fix string
+}
+
+// Doctor checks how docker-dns is integrated with the host: its listeners,
+// the Docker socket, the system resolver set-up and an end-to-end lookup.
+// The function fields reach the host, so that tests can replace them.
+type Doctor struct {
+	Config *config.Config
+	// Root prefixes the host files read ("" = /).
+	Root string
+
+	ContainerNames func(ctx context.Context) ([]string, error)
+	ResolvedLinks  func(ctx context.Context) ([]discovery.ResolvedLink, error)
+	BusNameActive  func(ctx context.Context, name string) (bool, error)
+	// LookupIP resolves a name through the system resolver, as applications do.
+	LookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	Query    func(ctx context.Context, q Query) (*Result, error)
+}
+
+// NewDoctor returns a Doctor for cfg that inspects the real host.
+func NewDoctor(cfg *config.Config) *Doctor {
+	return &Doctor{
+		Config: cfg,
+		ContainerNames: func(ctx context.Context) ([]string, error) {
+			c, err := docker.NewClient(cfg.DockerHost)
+			if err != nil {
+				return nil, err
+			}
+			defer c.Close()
+			return c.ContainerNames(ctx)
+		},
+		ResolvedLinks: discovery.ResolvedLinks,
+		BusNameActive: discovery.BusNameActive,
+		LookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		},
+		Query: Run,
+	}
+}
+
+// Run performs every check in order.
+func (d *Doctor) Run(ctx context.Context) []Check {
+	cfg := d.Config
+	checks := []Check{{
+		Name:   "configuration",
+		Status: StatusPass,
+		Detail: fmt.Sprintf("valid; serving %s on %s", strings.Join(cfg.TLDs, ","), strings.Join(cfg.Listen, ",")),
+	}}
+
+	var endpoints []netip.AddrPort
+	for _, addr := range cfg.Listen {
+		spec, err := config.ParseListen(addr)
+		if err != nil || spec.Kind != "" {
+			checks = append(checks, Check{Name: "listen " + addr, Status: StatusSkip, Detail: "dynamic endpoints are resolved by the server at runtime"})
+			continue
+		}
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			continue
+		}
+		endpoints = append(endpoints, ap)
+		checks = append(checks, d.checkListener(ctx, ap))
+	}
+
+	checks = append(checks, d.checkDockerSocket())
+	names, apiCheck := d.checkDockerAPI(ctx)
+	checks = append(checks, apiCheck)
+
+	// System resolvers only talk to port 53.
+	var system netip.Addr
+	for _, ap := range endpoints {
+		if ap.Port() == 53 {
+			system = ap.Addr()
+			break
+		}
+	}
+	if !system.IsValid() {
+		checks = append(checks, Check{
+			Name:   "system resolver",
+			Status: StatusWarn,
+			Detail: "no listen address uses port 53, which is the only port /etc/resolv.conf and systemd-resolved can point at",
+			Fix:    "add an ip:53 endpoint to --listen",
+		})
+	} else {
+		checks = append(checks, d.checkSystemResolver(ctx, system)...)
+	}
+
+	if len(endpoints) > 0 && apiCheck.Status == StatusPass {
+		checks = append(checks, d.checkLookup(ctx, endpoints[0], names)...)
+	}
+	return checks
+}
+
+// checkListener verifies that docker-dns answers on ap, and otherwise
+// reports who holds the port.
+func (d *Doctor) checkListener(ctx context.Context, ap netip.AddrPort) Check {
+	c := Check{Name: "listen " + ap.String()}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	res, err := d.Query(ctx, Query{Server: ap.String(), Name: probeContainer + "." + d.Config.TLDs[0]})
+	switch {
+	case err == nil && res.Debug != nil:
+		c.Status, c.Detail = StatusPass, "docker-dns answers"
+		return c
+	case err == nil && !ap.Addr().IsLoopback():
+		c.Status = StatusWarn
+		c.Detail = "a DNS server answers, but docker-dns only identifies itself to loopback clients"
+		return c
+	}
+
+	socks, serr := socketsOn(d.Root, ap)
+	var holders []string
+	for _, s := range socks {
+		holders = append(holders, s.String())
+	}
+	c.Status = StatusFail
+	switch {
+	case err == nil:
+		c.Detail = "another DNS server answers here"
+		if len(holders) > 0 {
+			c.Detail += ": " + strings.Join(holders, ", ")
+		}
+		c.Fix = fmt.Sprintf("stop that server, or move docker-dns to a free address (IP= in %s, then `sudo dpkg-reconfigure docker-dns`)", PackageEnvFile)
+	case serr != nil:
+		c.Detail = fmt.Sprintf("no answer (%v), and the socket tables cannot be read: %v", err, serr)
+		c.Fix = "check `systemctl status docker-dns` and `journalctl -u docker-dns`"
+	case len(socks) == 0:
+		c.Detail = fmt.Sprintf("nothing listens here (%v)", err)
+		c.Fix = "start docker-dns: `sudo systemctl start docker-dns.socket docker-dns`"
+	case slices.ContainsFunc(socks, func(s boundSocket) bool { return strings.HasPrefix(s.Process, "systemd (") }):
+		c.Detail = "docker-dns.socket holds the port, but the service does not answer"
+		c.Fix = "check `systemctl status docker-dns` and `journalctl -u docker-dns`"
+	default:
+		c.Detail = fmt.Sprintf("no answer (%v); the port is held by %s", err, strings.Join(holders, ", "))
+		c.Fix = fmt.Sprintf("stop that process, or move docker-dns to a free address (IP= in %s, then `sudo dpkg-reconfigure docker-dns`)", PackageEnvFile)
+	}
+	return c
+}
+
+// checkDockerSocket verifies that the Docker socket exists and that the
+// current user may use it.
+func (d *Doctor) checkDockerSocket() Check {
+	c := Check{Name: "docker socket"}
+	host := d.Config.DockerHost
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	path := defaultDockerSocket
+	if host != "" {
+		p, ok := strings.CutPrefix(host, "unix://")
+		if !ok {
+			c.Status, c.Detail = StatusSkip, fmt.Sprintf("%s is not a local socket", host)
+			return c
+		}
+		path = p
+	}
+	c.Name += " " + path
+
+	fi, err := os.Stat(filepath.Join(d.Root, path))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.Status, c.Detail = StatusFail, "the socket does not exist"
+		c.Fix = "install and start Docker: `sudo systemctl start docker`, or set --docker-host"
+		return c
+	case err != nil:
+		c.Status, c.Detail = StatusFail, err.Error()
+		return c
+	case fi.Mode()&os.ModeSocket == 0:
+		c.Status, c.Detail = StatusFail, "not a socket"
+		return c
+	}
+
+	if err := syscall.Access(filepath.Join(d.Root, path), 0o6); err != nil {
+		c.Detail = fmt.Sprintf("the current user cannot use it (%v)", err)
+		if os.Geteuid() != 0 {
+			// The packaged service runs as root.
+			c.Status = StatusWarn
+			c.Detail += "; the packaged service runs as root and is not affected"
+			c.Fix = "run the doctor with sudo, or add the user to the socket's group: `sudo usermod -aG docker $USER`"
+		} else {
+			c.Status = StatusFail
+			c.Fix = "check the socket's permissions and any SELinux/AppArmor policy"
+		}
+		return c
+	}
+	c.Status, c.Detail = StatusPass, "accessible"
+	return c
+}
+
+// checkDockerAPI lists the running containers.
+func (d *Doctor) checkDockerAPI(ctx context.Context) ([]string, Check) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	names, err := d.ContainerNames(ctx)
+	if err != nil {
+		return nil, Check{
+			Name: "docker api", Status: StatusFail, Detail: err.Error(),
+			Fix: "make sure `docker ps` works for the same user",
+		}
+	}
+	return names, Check{Name: "docker api", Status: StatusPass, Detail: fmt.Sprintf("%d running containers", len(names))}
+}
+
+// checkSystemResolver follows the postinst's integration: systemd-resolved
+// routing domains first, then the NetworkManager dispatcher, then plain
+// /etc/resolv.conf.
+func (d *Doctor) checkSystemResolver(ctx context.Context, ip netip.Addr) []Check {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	if links, err := d.ResolvedLinks(ctx); err == nil {
+		return []Check{d.checkResolved(links, ip), d.checkStubResolvConf(ctx, ip)}
+	}
+	if active, err := d.BusNameActive(ctx, networkManagerBus); err == nil && active {
+		return []Check{d.checkDispatcher(), d.checkResolvConfOrder(ctx, ip)}
+	}
+	return []Check{d.checkResolvConfOrder(ctx, ip)}
+}
+
+// checkResolved verifies that systemd-resolved routes every managed TLD to
+// ip.
+func (d *Doctor) checkResolved(links []discovery.ResolvedLink, ip netip.Addr) Check {
+	c := Check{Name: "systemd-resolved"}
+	var routes, missing []string
+	for _, tld := range d.Config.TLDs {
+		routes = append(routes, "~"+tld)
+		routed := slices.ContainsFunc(links, func(l discovery.ResolvedLink) bool {
+			return slices.Contains(l.Servers, ip.String()) &&
+				(slices.Contains(l.Domains, "~"+tld) || slices.Contains(l.Domains, tld))
+		})
+		if !routed {
+			missing = append(missing, "~"+tld)
+		}
+	}
+	if len(missing) == 0 {
+		c.Status, c.Detail = StatusPass, fmt.Sprintf("routes %s to %s", strings.Join(routes, " "), ip)
+		return c
+	}
+	c.Status = StatusFail
+	c.Detail = fmt.Sprintf("does not route %s to %s", strings.Join(missing, " "), ip)
+	if _, err := os.Stat(filepath.Join(d.Root, resolvedDropIn)); err == nil {
+		c.Detail += fmt.Sprintf("; check %s and restart it", resolvedDropIn)
+	}
+	c.Fix = fmt.Sprintf("`sudo dpkg-reconfigure docker-dns`, or write %s with \"[Resolve] DNS=%s Domains=%s\" and run `sudo systemctl restart systemd-resolved`",
+		resolvedDropIn, ip, strings.Join(routes, " "))
+	return c
+}
+
+// checkStubResolvConf verifies that applications go through
+// systemd-resolved, whose routing domains would otherwise be bypassed.
+func (d *Doctor) checkStubResolvConf(ctx context.Context, ip netip.Addr) Check {
+	c := Check{Name: "resolv.conf"}
+	servers, err := d.nameservers(ctx)
+	if err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		return c
+	}
+	if len(servers) > 0 && (servers[0] == resolvedStub || servers[0] == ip.String()) {
+		c.Status, c.Detail = StatusPass, fmt.Sprintf("%s uses %s first", resolvConf, servers[0])
+		return c
+	}
+	c.Status = StatusWarn
+	c.Detail = fmt.Sprintf("%s does not use the systemd-resolved stub %s first (nameservers: %s), so applications bypass its routing",
+		resolvConf, resolvedStub, strings.Join(servers, ", "))
+	c.Fix = "`sudo ln -sf /run/systemd/resolve/stub-resolv.conf /etc/resolv.conf`"
+	return c
+}
+
+// checkDispatcher verifies the NetworkManager dispatcher script that puts
+// the docker-dns nameserver back after NetworkManager rewrites resolv.conf.
+func (d *Doctor) checkDispatcher() Check {
+	c := Check{Name: "networkmanager dispatcher"}
+	fi, err := os.Stat(filepath.Join(d.Root, nmDispatcher))
+	switch {
+	case err != nil:
+		c.Status = StatusFail
+		c.Detail = fmt.Sprintf("%s is missing, so NetworkManager drops the docker-dns nameserver whenever it rewrites %s", nmDispatcher, resolvConf)
+	case fi.Mode()&0o111 == 0 || fi.Mode()&0o022 != 0:
+		// NetworkManager skips scripts that are not executable or are
+		// writable by group or others.
+		c.Status = StatusFail
+		c.Detail = fmt.Sprintf("%s has mode %s; NetworkManager only runs executable scripts not writable by others", nmDispatcher, fi.Mode().Perm())
+	case !ownedByRoot(fi):
+		c.Status = StatusFail
+		c.Detail = fmt.Sprintf("%s is not owned by root, so NetworkManager ignores it", nmDispatcher)
+	default:
+		c.Status, c.Detail = StatusPass, nmDispatcher+" is installed"
+		return c
+	}
+	c.Fix = "`sudo dpkg-reconfigure docker-dns` reinstalls the script"
+	return c
+}
+
+func ownedByRoot(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return !ok || st.Uid == 0
+}
+
+// checkResolvConfOrder verifies that ip is the first nameserver, since
+// resolvers try them in order and the others fail names under the TLDs.
+func (d *Doctor) checkResolvConfOrder(ctx context.Context, ip netip.Addr) Check {
+	c := Check{Name: "resolv.conf"}
+	servers, err := d.nameservers(ctx)
+	if err != nil {
+		c.Status, c.Detail = StatusFail, err.Error()
+		return c
+	}
+	fix := "`sudo dpkg-reconfigure docker-dns` puts it back first"
+	switch i := slices.Index(servers, ip.String()); {
+	case i == 0:
+		c.Status, c.Detail = StatusPass, fmt.Sprintf("%s lists %s first", resolvConf, ip)
+	case i > 0:
+		c.Status = StatusFail
+		c.Detail = fmt.Sprintf("%s lists %s before %s, so they answer container names first", resolvConf, strings.Join(servers[:i], ", "), ip)
+		c.Fix = fix
+	default:
+		c.Status = StatusFail
+		c.Detail = fmt.Sprintf("%s does not list %s", resolvConf, ip)
+		if generator := d.resolvConfGenerator(); generator != "" {
+			c.Detail += "; it was rewritten by " + generator
+		}
+		c.Fix = fix
+	}
+	return c
+}
+
+// nameservers returns the IPs of resolv.conf's nameserver lines, in order.
+func (d *Doctor) nameservers(ctx context.Context) ([]string, error) {
+	addrs, err := (&discovery.File{Path: filepath.Join(d.Root, resolvConf)}).Resolvers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		host, _, _ := net.SplitHostPort(a)
+		ips = append(ips, host)
+	}
+	return ips, nil
+}
+
+// resolvConfGenerator names the tool that wrote resolv.conf, from its
+// "# Generated by ..." header.
+func (d *Doctor) resolvConfGenerator() string {
+	f, err := os.Open(filepath.Join(d.Root, resolvConf))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if g, ok := strings.CutPrefix(line, "# Generated by "); ok && !strings.HasPrefix(g, "docker-dns") {
+			return g
+		}
+	}
+	return ""
+}
+
+// checkLookup resolves a running container directly through docker-dns and
+// then through the system resolver, which must agree.
+func (d *Doctor) checkLookup(ctx context.Context, server netip.AddrPort, names []string) []Check {
+	tld := d.Config.TLDs[0]
+	direct := Check{Name: "lookup via docker-dns"}
+	var (
+		name string
+		want []string
+	)
+	for _, n := range names[:min(len(names), lookupCandidates)] {
+		qctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		res, err := d.Query(qctx, Query{Server: server.String(), Name: n + "." + tld})
+		cancel()
+		if err != nil {
+			direct.Status, direct.Detail = StatusFail, err.Error()
+			return []Check{direct}
+		}
+		if ips := answerIPs(res); len(ips) > 0 {
+			name, want = n+"."+tld, ips
+			direct.Status = StatusPass
+			direct.Detail = fmt.Sprintf("%s is %s%s", name, strings.Join(ips, ", "), explain(res))
+			break
+		}
+	}
+	if name == "" {
+		direct.Status = StatusWarn
+		direct.Detail = "no running container with an IPv4 address to look up"
+		direct.Fix = "start one, e.g. `docker run -d --name web nginx`, and run the doctor again"
+		return []Check{direct}
+	}
+
+	system := Check{Name: "lookup via system resolver"}
+	lctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	ips, err := d.LookupIP(lctx, name+".")
+	var got []string
+	for _, ip := range ips {
+		got = append(got, ip.String())
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	switch {
+	case err != nil:
+		system.Status, system.Detail = StatusFail, err.Error()
+		system.Fix = "fix the resolver checks above"
+	case !slices.Equal(got, want):
+		system.Status = StatusFail
+		system.Detail = fmt.Sprintf("%s is %s, but docker-dns says %s; another resolver answers first", name, strings.Join(got, ", "), strings.Join(want, ", "))
+		system.Fix = "fix the resolver checks above"
+	default:
+		system.Status, system.Detail = StatusPass, fmt.Sprintf("%s is %s", name, strings.Join(got, ", "))
+	}
+	return []Check{direct, system}
+}
+
+// answerIPs returns the A records of a response.
+func answerIPs(res *Result) []string {
+	var ips []string
+	for _, rr := range res.Msg.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A.String())
+		}
+	}
+	return ips
+}
+
+// explain summarises a response's debug information.
+func explain(res *Result) string {
+	if res.Debug == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (from %s in %s)", res.Debug.Source, res.Debug.Elapsed.Round(time.Microsecond))
+}
+
+// WriteReport prints checks with their suggested fixes and a summary. It
+// returns false when a check failed.
+func WriteReport(w io.Writer, checks []Check) (bool, error) {
+	var b strings.Builder
+	counts := make(map[Status]int)
+	for _, c := range checks {
+		counts[c.Status]++
+		fmt.Fprintf(&b, "[%s] %s: %s\n", c.Status, c.Name, c.Detail)
+		if c.Fix != "" {
+			fmt.Fprintf(&b, "       fix: %s\n", c.Fix)
+		}
+	}
+	fmt.Fprintf(&b, "\n%d passed, %d warnings, %d failed, %d skipped\n",
+		counts[StatusPass], counts[StatusWarn], counts[StatusFail], counts[StatusSkip])
+	_, err := io.WriteString(w, b.String())
+	return counts[StatusFail] == 0, err
+}
+
+// PackageArgs returns the flags the packaged service starts with, built from
+// PackageEnvFile like its ExecStart, or nil when the package is not
+// installed.
+func PackageArgs(root string) []string {
+	f, err := os.Open(filepath.Join(root, PackageEnvFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if key, val, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, "#") {
+			vars[key] = strings.Trim(val, `"'`)
+		}
+	}
+
+	var args []string
+	if _, err := os.Stat(filepath.Join(root, PackageConfig)); err == nil {
+		args = append(args, "--config="+filepath.Join(root, PackageConfig))
+	}
+	if ip := vars["IP"]; ip != "" {
+		args = append(args, "--ip="+ip)
+	}
+	return args
+}
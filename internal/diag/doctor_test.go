@@ -0,0 +1,215 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/medunes/docker-dns/internal/discovery"
+	"github.com/medunes/docker-dns/internal/server"
+	"github.com/miekg/dns"
+)
+
+// fakeHost returns a Doctor for a healthy host with plain /etc/resolv.conf
+// under a temporary root: docker-dns answers on 127.0.0.153:53, the Docker
+// socket exists and container web is 172.17.0.2.
+func fakeHost(t *testing.T) *Doctor {
+	t.Helper()
+	t.Setenv("DOCKER_HOST", "")
+	root := t.TempDir()
+	writeFile(t, root, resolvConf, "# Generated by docker-dns\nnameserver 127.0.0.153\nnameserver 8.8.8.8\n")
+	if err := os.MkdirAll(filepath.Join(root, filepath.Dir(defaultDockerSocket)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", filepath.Join(root, defaultDockerSocket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	return &Doctor{
+		Config: &config.Config{Listen: []string{"127.0.0.153:53"}, TLDs: []string{"docker"}},
+		Root:   root,
+		ContainerNames: func(context.Context) ([]string, error) {
+			return []string{"db", "web"}, nil
+		},
+		ResolvedLinks: func(context.Context) ([]discovery.ResolvedLink, error) {
+			return nil, errors.New("systemd-resolved is not running")
+		},
+		BusNameActive: func(context.Context, string) (bool, error) { return false, nil },
+		LookupIP: func(context.Context, string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("172.17.0.2")}, nil
+		},
+		Query: func(_ context.Context, q Query) (*Result, error) {
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(q.Name), dns.TypeA)
+			m.Response = true
+			if q.Name == "web.docker" {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: "web.docker.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP("172.17.0.2"),
+				})
+			}
+			return &Result{Server: q.Server, Net: "udp", Msg: m, Debug: &server.DebugInfo{Source: "docker", Elapsed: time.Millisecond}}, nil
+		},
+	}
+}
+
+// find returns the check called name.
+func find(t *testing.T, checks []Check, name string) Check {
+	t.Helper()
+	i := slices.IndexFunc(checks, func(c Check) bool { return c.Name == name })
+	if i < 0 {
+		t.Fatalf("no %q check in %+v", name, checks)
+	}
+	return checks[i]
+}
+
+func TestDoctor_Healthy(t *testing.T) {
+	d := fakeHost(t)
+	checks := d.Run(context.Background())
+	for _, c := range checks {
+		if c.Status != StatusPass {
+			t.Errorf("%s = %s: %s", c.Name, c.Status, c.Detail)
+		}
+	}
+	if c := find(t, checks, "lookup via docker-dns"); c.Detail != "web.docker is 172.17.0.2 (from docker in 1ms)" {
+		t.Errorf("lookup detail = %q", c.Detail)
+	}
+	find(t, checks, "docker socket "+defaultDockerSocket)
+}
+
+func TestDoctor_ResolvedWithoutRoute(t *testing.T) {
+	d := fakeHost(t)
+	writeFile(t, d.Root, resolvConf, "nameserver 192.168.1.1\n")
+	d.ResolvedLinks = func(context.Context) ([]discovery.ResolvedLink, error) {
+		return []discovery.ResolvedLink{{Ifindex: 2, Servers: []string{"192.168.1.1"}, Domains: []string{"~."}}}, nil
+	}
+	checks := d.Run(context.Background())
+
+	if c := find(t, checks, "systemd-resolved"); c.Status != StatusFail || !strings.Contains(c.Detail, "does not route ~docker to 127.0.0.153") {
+		t.Errorf("systemd-resolved = %+v", c)
+	}
+	if c := find(t, checks, "resolv.conf"); c.Status != StatusWarn || c.Fix == "" {
+		t.Errorf("resolv.conf = %+v, want a warning about the stub", c)
+	}
+
+	d.ResolvedLinks = func(context.Context) ([]discovery.ResolvedLink, error) {
+		return []discovery.ResolvedLink{{Servers: []string{"127.0.0.153"}, Domains: []string{"~docker"}}}, nil
+	}
+	writeFile(t, d.Root, resolvConf, "nameserver 127.0.0.53\n")
+	checks = d.Run(context.Background())
+	for _, name := range []string{"systemd-resolved", "resolv.conf"} {
+		if c := find(t, checks, name); c.Status != StatusPass {
+			t.Errorf("%s = %+v once routed", name, c)
+		}
+	}
+}
+
+func TestDoctor_NetworkManager(t *testing.T) {
+	d := fakeHost(t)
+	d.BusNameActive = func(_ context.Context, name string) (bool, error) { return name == networkManagerBus, nil }
+	writeFile(t, d.Root, resolvConf, "# Generated by NetworkManager\nnameserver 192.168.1.1\nnameserver 127.0.0.153\n")
+	checks := d.Run(context.Background())
+
+	if c := find(t, checks, "networkmanager dispatcher"); c.Status != StatusFail || !strings.Contains(c.Detail, "is missing") {
+		t.Errorf("dispatcher = %+v", c)
+	}
+	if c := find(t, checks, "resolv.conf"); c.Status != StatusFail || !strings.Contains(c.Detail, "lists 192.168.1.1 before 127.0.0.153") {
+		t.Errorf("resolv.conf = %+v", c)
+	}
+
+	writeFile(t, d.Root, nmDispatcher, "#!/bin/sh\n")
+	if err := os.Chmod(filepath.Join(d.Root, nmDispatcher), 0o775); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, d.Root, resolvConf, "# Generated by NetworkManager\nnameserver 192.168.1.1\n")
+	checks = d.Run(context.Background())
+	if c := find(t, checks, "networkmanager dispatcher"); c.Status != StatusFail || !strings.Contains(c.Detail, "has mode -rwxrwxr-x") {
+		t.Errorf("group-writable dispatcher = %+v", c)
+	}
+	if c := find(t, checks, "resolv.conf"); c.Status != StatusFail || !strings.HasSuffix(c.Detail, "rewritten by NetworkManager") {
+		t.Errorf("resolv.conf = %+v", c)
+	}
+}
+
+func TestDoctor_ListenerAndLookupFailures(t *testing.T) {
+	d := fakeHost(t)
+	query := d.Query
+	d.Query = func(ctx context.Context, q Query) (*Result, error) {
+		res, err := query(ctx, q)
+		res.Debug = nil // another DNS server
+		return res, err
+	}
+	d.LookupIP = func(context.Context, string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.9")}, nil
+	}
+	checks := d.Run(context.Background())
+
+	if c := find(t, checks, "listen 127.0.0.153:53"); c.Status != StatusFail || !strings.HasPrefix(c.Detail, "another DNS server answers here") {
+		t.Errorf("listener = %+v", c)
+	}
+	if c := find(t, checks, "lookup via system resolver"); c.Status != StatusFail || !strings.Contains(c.Detail, "is 10.0.0.9, but docker-dns says 172.17.0.2") {
+		t.Errorf("system lookup = %+v", c)
+	}
+}
+
+func TestDoctor_Skips(t *testing.T) {
+	d := fakeHost(t)
+	d.Config.Listen = []string{"bridge:docker0:53", "127.0.0.153:5353"}
+	d.Config.DockerHost = "tcp://10.0.0.2:2375"
+	d.ContainerNames = func(context.Context) ([]string, error) { return nil, nil }
+	checks := d.Run(context.Background())
+
+	for name, want := range map[string]Status{
+		"listen bridge:docker0:53": StatusSkip,
+		"docker socket":            StatusSkip,
+		"system resolver":          StatusWarn,
+		"lookup via docker-dns":    StatusWarn,
+	} {
+		if c := find(t, checks, name); c.Status != want {
+			t.Errorf("%s = %+v, want %s", name, c, want)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	var out bytes.Buffer
+	ok, err := WriteReport(&out, []Check{
+		{Name: "configuration", Status: StatusPass, Detail: "valid"},
+		{Name: "resolv.conf", Status: StatusFail, Detail: "does not list 127.0.0.153", Fix: "reconfigure"},
+		{Name: "lookup", Status: StatusWarn, Detail: "no container"},
+	})
+	if err != nil || ok {
+		t.Fatalf("WriteReport() = %v, %v; want a failure reported", ok, err)
+	}
+	want := "[PASS] configuration: valid\n" +
+		"[FAIL] resolv.conf: does not list 127.0.0.153\n" +
+		"       fix: reconfigure\n" +
+		"[WARN] lookup: no container\n" +
+		"\n1 passed, 1 warnings, 1 failed, 0 skipped\n"
+	if out.String() != want {
+		t.Errorf("report =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestPackageArgs(t *testing.T) {
+	root := t.TempDir()
+	if args := PackageArgs(root); args != nil {
+		t.Errorf("PackageArgs() without the package = %q", args)
+	}
+	writeFile(t, root, PackageEnvFile, "# docker-dns\nIP=\"127.0.0.153\"\n")
+	writeFile(t, root, PackageConfig, "tld: docker,local\nttl: 60\n")
+	want := []string{"--config=" + filepath.Join(root, PackageConfig), "--ip=127.0.0.153"}
+	if args := PackageArgs(root); !slices.Equal(args, want) {
+		t.Errorf("PackageArgs() = %q, want %q", args, want)
+	}
+}
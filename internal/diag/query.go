@@ -0,0 +1,183 @@
+// Package diag implements the diagnostic subcommands that talk to a running
+// docker-dns server.
+package diag
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/server"
+	"github.com/miekg/dns"
+)
+
+// DefaultServer is the address queried when none is given, the listener of
+// the Debian package.
+const DefaultServer = "127.0.0.153:53"
+
+// Query describes a diagnostic query.
+type Query struct {
+	// Server is the docker-dns address, "ip[:port]" (port 53 when omitted).
+	Server string
+	// Name is the name to resolve; an IP address is looked up as PTR.
+	Name string
+	// Type is the query type, e.g. "A" ("" = A, or PTR for an address).
+	Type string
+	// TCP sends the query over TCP instead of UDP.
+	TCP bool
+	// DNSSEC sets the DO bit, asking for signatures.
+	DNSSEC bool
+	// Timeout bounds the exchange.
+	Timeout time.Duration
+}
+
+// Result is the answer to a Query with the server's explanation.
+type Result struct {
+	// Server and Net are the address and transport that were used.
+	Server, Net string
+	// Msg is the response.
+	Msg *dns.Msg
+	// RTT is the round-trip time seen by the client.
+	RTT time.Duration
+	// Debug is the server's account of the answer; nil when it sent none.
+	Debug *server.DebugInfo
+}
+
+// Message builds the DNS request for q, asking for the debug option.
+func (q Query) Message() (*dns.Msg, error) {
+	name, qtype := q.Name, q.Type
+	if ip := net.ParseIP(strings.Trim(name, "[]")); ip != nil && qtype == "" {
+		rev, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			return nil, err
+		}
+		name, qtype = rev, "PTR"
+	}
+	if qtype == "" {
+		qtype = "A"
+	}
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return nil, fmt.Errorf("unknown query type %q", qtype)
+	}
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), t)
+	m.SetEdns0(dns.DefaultMsgSize, q.DNSSEC)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: server.DebugOption})
+	return m, nil
+}
+
+// Run sends q and returns the response. A truncated UDP answer is retried
+// over TCP, as a stub resolver would.
+func Run(ctx context.Context, q Query) (*Result, error) {
+	m, err := q.Message()
+	if err != nil {
+		return nil, err
+	}
+	addr := q.Server
+	if addr == "" {
+		addr = DefaultServer
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	network := "udp"
+	if q.TCP {
+		network = "tcp"
+	}
+	if q.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.Timeout)
+		defer cancel()
+	}
+
+	c := &dns.Client{Net: network}
+	resp, rtt, err := c.ExchangeContext(ctx, m, addr)
+	if err == nil && resp.Truncated && network == "udp" {
+		network = "tcp"
+		c.Net = network
+		resp, rtt, err = c.ExchangeContext(ctx, m, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying %s over %s: %w", addr, network, err)
+	}
+	debug, err := server.ParseDebugInfo(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Server: addr, Net: network, Msg: resp, RTT: rtt, Debug: debug}, nil
+}
+
+// Write prints the answer records and how the server produced them.
+func (r *Result) Write(w io.Writer) error {
+	var b strings.Builder
+	for _, rr := range r.Msg.Answer {
+		fmt.Fprintln(&b, rr.String())
+	}
+	for _, rr := range r.Msg.Ns {
+		fmt.Fprintln(&b, rr.String())
+	}
+	if len(r.Msg.Answer)+len(r.Msg.Ns) > 0 {
+		fmt.Fprintln(&b)
+	}
+
+	fmt.Fprintf(&b, "status:      %s, flags: %s, answers: %d\n",
+		dns.RcodeToString[r.Msg.Rcode], headerFlags(r.Msg), len(r.Msg.Answer))
+	if d := r.Debug; d != nil {
+		source := d.Source
+		if d.Detail != "" {
+			source += " (" + d.Detail + ")"
+		}
+		fmt.Fprintf(&b, "source:      %s\n", source)
+		if d.Source == "upstream" || len(d.Tried) > 0 {
+			rule := d.Rule
+			if rule == "" {
+				rule = "default resolvers"
+			}
+			fmt.Fprintf(&b, "route:       %s\n", rule)
+		}
+		if d.Upstream != "" {
+			fmt.Fprintf(&b, "upstream:    %s in %s\n", d.Upstream, d.UpstreamRTT.Round(time.Microsecond))
+		}
+		for _, t := range d.Tried {
+			fmt.Fprintf(&b, "tried:       %s\n", t)
+		}
+		fmt.Fprintf(&b, "server time: %s\n", d.Elapsed.Round(time.Microsecond))
+	} else {
+		fmt.Fprintln(&b, "source:      unknown; the server sent no debug information (it only does for loopback clients)")
+	}
+	fmt.Fprintf(&b, "round trip:  %s over %s to %s\n", r.RTT.Round(time.Microsecond), r.Net, r.Server)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// headerFlags lists the header flags of m the way dig does.
+func headerFlags(m *dns.Msg) string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"},
+		{m.Authoritative, "aa"},
+		{m.Truncated, "tc"},
+		{m.RecursionDesired, "rd"},
+		{m.RecursionAvailable, "ra"},
+		{m.AuthenticatedData, "ad"},
+		{m.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, " ")
+}
@@ -0,0 +1,126 @@
+package diag
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/server"
+	"github.com/miekg/dns"
+)
+
+// startServer serves h over UDP and TCP on the same loopback port.
+func startServer(t *testing.T, h dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*dns.Server{{PacketConn: pc, Handler: h}, {Listener: ln, Handler: h}} {
+		go func() { _ = s.ActivateAndServe() }()
+		t.Cleanup(func() { _ = s.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+func TestQuery_Message(t *testing.T) {
+	tests := []struct {
+		q     Query
+		name  string
+		qtype uint16
+	}{
+		{Query{Name: "web.docker"}, "web.docker.", dns.TypeA},
+		{Query{Name: "example.com.", Type: "aaaa"}, "example.com.", dns.TypeAAAA},
+		{Query{Name: "172.17.0.2"}, "2.0.17.172.in-addr.arpa.", dns.TypePTR},
+		{Query{Name: "172.17.0.2", Type: "A"}, "172.17.0.2.", dns.TypeA},
+	}
+	for _, tt := range tests {
+		m, err := tt.q.Message()
+		if err != nil {
+			t.Fatalf("%+v: %v", tt.q, err)
+		}
+		if q := m.Question[0]; q.Name != tt.name || q.Qtype != tt.qtype {
+			t.Errorf("%+v: question = %s %s, want %s %s", tt.q, q.Name, dns.TypeToString[q.Qtype], tt.name, dns.TypeToString[tt.qtype])
+		}
+		if opt := m.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].Option() != server.DebugOption {
+			t.Errorf("%+v: want the debug option", tt.q)
+		}
+	}
+	if _, err := (Query{Name: "web.docker", Type: "BOGUS"}).Message(); err == nil {
+		t.Error("want an error for an unknown type")
+	}
+}
+
+func TestRun_ReportsDebugInfo(t *testing.T) {
+	addr := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("172.17.0.2"),
+		})
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_LOCAL{
+			Code: server.DebugOption,
+			Data: []byte("source=docker&detail=container+web&elapsed=1.5ms"),
+		}}
+		_ = w.WriteMsg(resp)
+	})
+
+	res, err := Run(context.Background(), Query{Server: addr, Name: "web.docker", Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Debug == nil || res.Debug.Source != "docker" || res.Debug.Elapsed != 1500*time.Microsecond {
+		t.Fatalf("Debug = %+v", res.Debug)
+	}
+
+	var out bytes.Buffer
+	if err := res.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"web.docker.\t300\tIN\tA\t172.17.0.2",
+		"status:      NOERROR, flags: qr aa rd, answers: 1",
+		"source:      docker (container web)",
+		"server time: 1.5ms",
+		"over udp to " + addr,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestRun_RetriesTruncatedOverTCP(t *testing.T) {
+	addr := startServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			resp.Truncated = true
+		}
+		_ = w.WriteMsg(resp)
+	})
+
+	res, err := Run(context.Background(), Query{Server: addr, Name: "big.example", Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Net != "tcp" || res.Msg.Truncated {
+		t.Errorf("Net = %s, truncated = %v; want the TCP answer", res.Net, res.Msg.Truncated)
+	}
+
+	var out bytes.Buffer
+	_ = res.Write(&out)
+	if !strings.Contains(out.String(), "source:      unknown") {
+		t.Errorf("want the missing debug information noted:\n%s", out.String())
+	}
+}
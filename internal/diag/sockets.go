@@ -0,0 +1,130 @@
+package diag
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the state of a listening socket in /proc/net/tcp.
+const tcpListen = "0A"
+
+// boundSocket is a UDP socket or listening TCP socket and the process that
+// holds it.
+type boundSocket struct {
+	Proto string
+	Addr  netip.AddrPort
+	// Process is "name (pid N)", or "" when it cannot be found, typically
+	// because the socket belongs to another user.
+	Process string
+	inode   string
+}
+
+func (s boundSocket) String() string {
+	owner := s.Process
+	if owner == "" {
+		owner = "an unknown process (run as root to see it)"
+	}
+	return fmt.Sprintf("%s on %s/%s", owner, s.Addr, s.Proto)
+}
+
+// socketsOn returns the sockets bound to addr's port on addr's IP or on a
+// wildcard address, read from the /proc/net tables under root.
+func socketsOn(root string, addr netip.AddrPort) ([]boundSocket, error) {
+	var found []boundSocket
+	for _, table := range []struct{ file, proto string }{
+		{"udp", "udp"}, {"udp6", "udp"}, {"tcp", "tcp"}, {"tcp6", "tcp"},
+	} {
+		socks, err := readSocketTable(filepath.Join(root, "/proc/net", table.file), table.proto)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // no IPv6
+			}
+			return nil, err
+		}
+		for _, s := range socks {
+			ip := s.Addr.Addr().Unmap()
+			if s.Addr.Port() == addr.Port() && (ip == addr.Addr().Unmap() || ip.IsUnspecified()) {
+				found = append(found, s)
+			}
+		}
+	}
+	if len(found) > 0 {
+		owners := socketProcesses(root)
+		for i := range found {
+			found[i].Process = owners[found[i].inode]
+		}
+	}
+	return found, nil
+}
+
+// readSocketTable parses a /proc/net/{udp,tcp}[6] table, keeping UDP
+// sockets and listening TCP sockets.
+func readSocketTable(path, proto string) ([]boundSocket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []boundSocket
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 || (proto == "tcp" && fields[3] != tcpListen) {
+			continue
+		}
+		addr, err := parseProcAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		out = append(out, boundSocket{Proto: proto, Addr: addr, inode: fields[9]})
+	}
+	return out, sc.Err()
+}
+
+// parseProcAddr decodes a /proc/net address such as "9900007F:0035": the IP
+// is hex in 32-bit host-order (little-endian) words, the port big-endian.
+func parseProcAddr(s string) (netip.AddrPort, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	raw, err := hex.DecodeString(ipHex)
+	if !ok || err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("bad socket address %q", s)
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("bad socket port %q", s)
+	}
+	for w := 0; w < len(raw); w += 4 {
+		raw[w], raw[w+1], raw[w+2], raw[w+3] = raw[w+3], raw[w+2], raw[w+1], raw[w]
+	}
+	ip, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// socketProcesses maps socket inodes to "name (pid N)" for every process
+// whose file descriptors can be read.
+func socketProcesses(root string) map[string]string {
+	owners := make(map[string]string)
+	fds, _ := filepath.Glob(filepath.Join(root, "/proc/[0-9]*/fd/*"))
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+		if _, ok := owners[inode]; ok {
+			continue
+		}
+		pidDir := filepath.Dir(filepath.Dir(fd))
+		comm, _ := os.ReadFile(filepath.Join(pidDir, "comm"))
+		owners[inode] = fmt.Sprintf("%s (pid %s)", strings.TrimSpace(string(comm)), filepath.Base(pidDir))
+	}
+	return owners
+}
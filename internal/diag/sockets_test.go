@@ -0,0 +1,76 @@
+package diag
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseProcAddr(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"9900007F:0035", "127.0.0.153:53"},
+		{"00000000:0035", "0.0.0.0:53"},
+		{"00000000000000000000000001000000:0035", "[::1]:53"},
+		{"B80D0120000000000000000053000000:14E9", "[2001:db8::53]:5353"},
+	}
+	for _, tt := range tests {
+		got, err := parseProcAddr(tt.in)
+		if err != nil || got.String() != tt.want {
+			t.Errorf("parseProcAddr(%q) = %v, %v; want %s", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"9900007F", "zz00007F:0035", "9900007F:zz", "9900:0035"} {
+		if _, err := parseProcAddr(bad); err == nil {
+			t.Errorf("parseProcAddr(%q) succeeded", bad)
+		}
+	}
+}
+
+// writeFile creates root/path with content, and its directories.
+func writeFile(t *testing.T, root, path, content string) {
+	t.Helper()
+	full := filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketsOn(t *testing.T) {
+	root := t.TempDir()
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	writeFile(t, root, "/proc/net/udp", header+
+		"   0: 3500007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   991        0 1111 2 0 0\n"+
+		"   1: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 2222 2 0 0\n"+
+		"   2: 9900007F:14E9 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 3333 2 0 0\n")
+	writeFile(t, root, "/proc/net/tcp", header+
+		"   0: 00000000:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 4444 1 0 0\n"+
+		"   1: 9900007F:0035 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 5555 1 0 0\n")
+	writeFile(t, root, "/proc/812/comm", "dnsmasq\n")
+	if err := os.MkdirAll(filepath.Join(root, "/proc/812/fd"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("socket:[2222]", filepath.Join(root, "/proc/812/fd/4")); err != nil {
+		t.Fatal(err)
+	}
+
+	socks, err := socketsOn(root, netip.MustParseAddrPort("127.0.0.153:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range socks {
+		got = append(got, s.String())
+	}
+	want := []string{
+		"dnsmasq (pid 812) on 0.0.0.0:53/udp",
+		"an unknown process (run as root to see it) on 0.0.0.0:53/tcp",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("socketsOn() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+// Package discovery finds the network's upstream DNS servers at runtime, from
+// a resolv.conf-style file or from systemd-resolved, so that the forwarder can
+// follow network changes without a restart.
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+)
+
+// Source reports the current upstream resolvers as "IP:port" strings.
+type Source interface {
+	Resolvers(ctx context.Context) ([]string, error)
+}
+
+// Watch polls src every interval and calls onChange with the resolver list
+// whenever it differs from the previous one, starting with the first
+// successful poll. Poll errors are logged and the previous list is kept.
+// Watch blocks until ctx is cancelled.
+func Watch(ctx context.Context, src Source, interval time.Duration, log *slog.Logger, onChange func([]string)) {
+	var (
+		last  []string
+		known bool
+	)
+	poll := func() {
+		pctx, cancel := context.WithTimeout(ctx, interval)
+		defer cancel()
+		resolvers, err := src.Resolvers(pctx)
+		if err != nil {
+			log.Warn("resolver discovery failed", "error", err)
+			return
+		}
+		if known && slices.Equal(resolvers, last) {
+			return
+		}
+		last, known = resolvers, true
+		onChange(resolvers)
+	}
+
+	poll()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			poll()
+		}
+	}
+}
+
+// filter drops excluded IPs and duplicates, and formats the rest as IP:53.
+func filter(ips []net.IP, zones []string, exclude []net.IP) []string {
+	var out []string
+	for i, ip := range ips {
+		if slices.ContainsFunc(exclude, ip.Equal) {
+			continue
+		}
+		host := ip.String()
+		if zones != nil && zones[i] != "" {
+			host += "%" + zones[i]
+		}
+		addr := net.JoinHostPort(host, "53")
+		if !slices.Contains(out, addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
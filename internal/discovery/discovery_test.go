@@ -0,0 +1,97 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedSource returns one canned result per poll, repeating the last.
+type scriptedSource struct {
+	mu    sync.Mutex
+	steps []scriptedStep
+}
+
+type scriptedStep struct {
+	resolvers []string
+	err       error
+}
+
+func (s *scriptedSource) Resolvers(context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	step := s.steps[0]
+	if len(s.steps) > 1 {
+		s.steps = s.steps[1:]
+	}
+	return step.resolvers, step.err
+}
+
+func TestWatch_ReportsOnlyChanges(t *testing.T) {
+	src := &scriptedSource{steps: []scriptedStep{
+		{resolvers: []string{"10.0.0.1:53"}},
+		{resolvers: []string{"10.0.0.1:53"}},
+		{err: errors.New("transient")},
+		{resolvers: []string{"10.0.0.2:53"}},
+		{resolvers: []string{"10.0.0.2:53"}},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu  sync.Mutex
+		got [][]string
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watch(ctx, src, 5*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)), func(r []string) {
+			mu.Lock()
+			got = append(got, r)
+			mu.Unlock()
+		})
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(30 * time.Millisecond) // let the repeated last step settle
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := [][]string{{"10.0.0.1:53"}, {"10.0.0.2:53"}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("onChange calls = %v, want %v", got, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.168.1.1"),
+		net.ParseIP("127.0.0.153"),
+		net.ParseIP("fe80::1"),
+		net.ParseIP("192.168.1.1"),
+	}
+	zones := []string{"", "", "wlan0", ""}
+	got := filter(ips, zones, []net.IP{net.ParseIP("127.0.0.153")})
+	want := []string{"192.168.1.1:53", "[fe80::1%wlan0]:53"}
+	if !slices.Equal(got, want) {
+		t.Errorf("filter() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// File reads nameserver lines from a resolv.conf-style file.
+type File struct {
+	// Path is the file to read, e.g. /etc/resolv.conf.
+	Path string
+	// Exclude lists addresses to skip, typically docker-dns's own listen IP.
+	Exclude []net.IP
+}
+
+// Resolvers returns the file's name servers in order.
+func (f *File) Resolvers(context.Context) ([]string, error) {
+	fh, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	ips, zones, err := parseResolvConf(fh)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f.Path, err)
+	}
+	return filter(ips, zones, f.Exclude), nil
+}
+
+// parseResolvConf extracts "nameserver" entries. IPv6 zones ("fe80::1%eth0")
+// are returned separately, aligned with the IPs.
+func parseResolvConf(r io.Reader) (ips []net.IP, zones []string, err error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		host, zone, _ := strings.Cut(fields[1], "%")
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		ips = append(ips, ip)
+		zones = append(zones, zone)
+	}
+	return ips, zones, sc.Err()
+}
@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const sampleResolvConf = `# Generated by NetworkManager
+search corp.example
+nameserver 127.0.0.153
+nameserver 10.8.0.1
+nameserver   fe80::1%eth0
+nameserver not-an-ip
+options edns0 trust-ad
+nameserver 10.8.0.1
+`
+
+func TestFile_Resolvers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte(sampleResolvConf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &File{Path: path, Exclude: []net.IP{net.ParseIP("127.0.0.153")}}
+	got, err := f.Resolvers(context.Background())
+	if err != nil {
+		t.Fatalf("Resolvers: %v", err)
+	}
+	want := []string{"10.8.0.1:53", "[fe80::1%eth0]:53"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Resolvers() = %v, want %v", got, want)
+	}
+}
+
+func TestFile_MissingFile(t *testing.T) {
+	f := &File{Path: filepath.Join(t.TempDir(), "missing")}
+	if _, err := f.Resolvers(context.Background()); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,178 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	resolvedBusName   = "org.freedesktop.resolve1"
+	resolvedPath      = "/org/freedesktop/resolve1"
+	resolvedDNSProp   = "org.freedesktop.resolve1.Manager.DNS"
+	resolvedFallbacks = "org.freedesktop.resolve1.Manager.FallbackDNS"
+	resolvedDomains   = "org.freedesktop.resolve1.Manager.Domains"
+)
+
+// resolvedServer is one entry of resolved's a(iiay) DNS property: the link
+// index (0 for global servers), the address family and the raw address.
+type resolvedServer struct {
+	Ifindex int32
+	Family  int32
+	Address []byte
+}
+
+// resolvedDomain is one entry of resolved's a(isb) Domains property: the link
+// index (0 for global domains), the domain and whether it is routing-only.
+type resolvedDomain struct {
+	Ifindex   int32
+	Domain    string
+	RouteOnly bool
+}
+
+// ResolvedLink is the DNS configuration systemd-resolved holds for one link,
+// or its global configuration when Ifindex is 0.
+type ResolvedLink struct {
+	Ifindex int32
+	// Servers are the DNS server addresses, without port.
+	Servers []string
+	// Domains are the search and routing domains; routing-only ones carry
+	// a "~" prefix, as in resolved.conf.
+	Domains []string
+}
+
+// ResolvedLinks returns resolved's per-link DNS servers and domains. It
+// fails when resolved is not running.
+func ResolvedLinks(ctx context.Context) ([]ResolvedLink, error) {
+	conn, err := dbus.ConnectSystemBus(dbus.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to system bus: %w", err)
+	}
+	defer conn.Close()
+
+	obj := conn.Object(resolvedBusName, resolvedPath)
+	var (
+		servers []resolvedServer
+		domains []resolvedDomain
+	)
+	for prop, dst := range map[string]any{resolvedDNSProp: &servers, resolvedDomains: &domains} {
+		v, err := obj.GetProperty(prop)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", prop, err)
+		}
+		if err := v.Store(dst); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", prop, err)
+		}
+	}
+	return resolvedLinks(servers, domains), nil
+}
+
+// resolvedLinks groups resolved's servers and domains by link, in the order
+// links first appear.
+func resolvedLinks(servers []resolvedServer, domains []resolvedDomain) []ResolvedLink {
+	var links []ResolvedLink
+	link := func(ifindex int32) *ResolvedLink {
+		for i := range links {
+			if links[i].Ifindex == ifindex {
+				return &links[i]
+			}
+		}
+		links = append(links, ResolvedLink{Ifindex: ifindex})
+		return &links[len(links)-1]
+	}
+	for _, s := range servers {
+		if s.Family == syscall.AF_INET && len(s.Address) == net.IPv4len ||
+			s.Family == syscall.AF_INET6 && len(s.Address) == net.IPv6len {
+			l := link(s.Ifindex)
+			l.Servers = append(l.Servers, net.IP(s.Address).String())
+		}
+	}
+	for _, d := range domains {
+		l := link(d.Ifindex)
+		if d.RouteOnly {
+			l.Domains = append(l.Domains, "~"+d.Domain)
+		} else {
+			l.Domains = append(l.Domains, d.Domain)
+		}
+	}
+	return links
+}
+
+// BusNameActive reports whether a service owns name on the system D-Bus,
+// e.g. "org.freedesktop.NetworkManager".
+func BusNameActive(ctx context.Context, name string) (bool, error) {
+	conn, err := dbus.ConnectSystemBus(dbus.WithContext(ctx))
+	if err != nil {
+		return false, fmt.Errorf("connecting to system bus: %w", err)
+	}
+	defer conn.Close()
+
+	var owned bool
+	if err := conn.BusObject().CallWithContext(ctx, "org.freedesktop.DBus.NameHasOwner", 0, name).Store(&owned); err != nil {
+		return false, fmt.Errorf("looking up %s: %w", name, err)
+	}
+	return owned, nil
+}
+
+// Resolved queries systemd-resolved over the system D-Bus for the DNS servers
+// of every link, as configured by NetworkManager, DHCP or VPN clients.
+type Resolved struct {
+	// Exclude lists addresses to skip, typically docker-dns's own listen IP.
+	Exclude []net.IP
+}
+
+// Resolvers returns resolved's current servers in its own order (global
+// servers first), falling back to its FallbackDNS list when none are set.
+func (r *Resolved) Resolvers(ctx context.Context) ([]string, error) {
+	conn, err := dbus.ConnectSystemBus(dbus.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to system bus: %w", err)
+	}
+	defer conn.Close()
+
+	obj := conn.Object(resolvedBusName, resolvedPath)
+	for _, prop := range []string{resolvedDNSProp, resolvedFallbacks} {
+		v, err := obj.GetProperty(prop)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", prop, err)
+		}
+		var servers []resolvedServer
+		if err := v.Store(&servers); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", prop, err)
+		}
+		if out := resolvedAddrs(servers, r.Exclude); len(out) > 0 {
+			return out, nil
+		}
+	}
+	return nil, nil
+}
+
+// resolvedAddrs converts resolved's server entries to IP:port strings,
+// scoping link-local IPv6 addresses to their interface.
+func resolvedAddrs(servers []resolvedServer, exclude []net.IP) []string {
+	var (
+		ips   []net.IP
+		zones []string
+	)
+	for _, s := range servers {
+		switch {
+		case s.Family == syscall.AF_INET && len(s.Address) == net.IPv4len,
+			s.Family == syscall.AF_INET6 && len(s.Address) == net.IPv6len:
+		default:
+			continue
+		}
+		ip := net.IP(s.Address)
+		zone := ""
+		if ip.IsLinkLocalUnicast() && ip.To4() == nil && s.Ifindex > 0 {
+			if iface, err := net.InterfaceByIndex(int(s.Ifindex)); err == nil {
+				zone = iface.Name
+			}
+		}
+		ips = append(ips, ip)
+		zones = append(zones, zone)
+	}
+	return filter(ips, zones, exclude)
+}
@@ -0,0 +1,65 @@
+package discovery
+
+import (
+	"net"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestResolvedAddrs(t *testing.T) {
+	servers := []resolvedServer{
+		{Ifindex: 0, Family: syscall.AF_INET, Address: []byte{1, 1, 1, 1}},
+		{Ifindex: 3, Family: syscall.AF_INET, Address: []byte{192, 168, 1, 1}},
+		{Ifindex: 3, Family: syscall.AF_INET6, Address: net.ParseIP("2001:db8::53")},
+		{Ifindex: 4, Family: syscall.AF_INET, Address: []byte{127, 0, 0, 153}},
+		{Ifindex: 5, Family: syscall.AF_INET, Address: []byte{10, 0}}, // truncated
+		{Ifindex: 5, Family: 99, Address: []byte{10, 0, 0, 1}},        // unknown family
+	}
+	got := resolvedAddrs(servers, []net.IP{net.ParseIP("127.0.0.153")})
+	want := []string{"1.1.1.1:53", "192.168.1.1:53", "[2001:db8::53]:53"}
+	if !slices.Equal(got, want) {
+		t.Errorf("resolvedAddrs() = %v, want %v", got, want)
+	}
+}
+
+func TestResolvedAddrs_ScopesLinkLocal(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skip("no network interfaces")
+	}
+	iface := ifaces[0]
+	servers := []resolvedServer{
+		{Ifindex: int32(iface.Index), Family: syscall.AF_INET6, Address: net.ParseIP("fe80::1")},
+	}
+	want := []string{"[fe80::1%" + iface.Name + "]:53"}
+	if got := resolvedAddrs(servers, nil); !slices.Equal(got, want) {
+		t.Errorf("resolvedAddrs() = %v, want %v", got, want)
+	}
+}
+
+func TestResolvedLinks(t *testing.T) {
+	servers := []resolvedServer{
+		{Ifindex: 0, Family: syscall.AF_INET, Address: []byte{127, 0, 0, 153}},
+		{Ifindex: 3, Family: syscall.AF_INET, Address: []byte{192, 168, 1, 1}},
+		{Ifindex: 3, Family: syscall.AF_INET, Address: []byte{10, 0}}, // truncated
+	}
+	domains := []resolvedDomain{
+		{Ifindex: 0, Domain: "docker", RouteOnly: true},
+		{Ifindex: 3, Domain: "lan"},
+		{Ifindex: 4, Domain: "vpn.example", RouteOnly: true},
+	}
+	got := resolvedLinks(servers, domains)
+	if len(got) != 3 {
+		t.Fatalf("resolvedLinks() = %+v, want 3 links", got)
+	}
+	if got[0].Ifindex != 0 || !slices.Equal(got[0].Servers, []string{"127.0.0.153"}) || !slices.Equal(got[0].Domains, []string{"~docker"}) {
+		t.Errorf("global = %+v", got[0])
+	}
+	if !slices.Equal(got[1].Servers, []string{"192.168.1.1"}) || !slices.Equal(got[1].Domains, []string{"lan"}) {
+		t.Errorf("link 3 = %+v", got[1])
+	}
+	if got[2].Ifindex != 4 || len(got[2].Servers) != 0 {
+		t.Errorf("link 4 = %+v", got[2])
+	}
+}
@@ -1,14 +1,18 @@
 // Package docker wraps the Docker API client, presenting a minimal interface
-// focused on what the DNS resolver actually needs: container IP lookup.
+// focused on what the DNS resolver actually needs: container IP lookup and
+// the gateway addresses of Docker networks.
 package docker
 
 import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 
 	dockerclient "github.com/docker/docker/client"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
 )
 
 // Client is the interface the DNS server uses to query Docker.
@@ -18,6 +22,10 @@ type Client interface {
 	// across all its networks. Returns an empty slice (not an error) if the
 	// container does not exist.
 	ContainerIPs(ctx context.Context, containerName string) ([]string, error)
+	// NetworkGateways returns the gateway addresses (IPv4 and IPv6) of the
+	// named Docker network. Returns an empty slice (not an error) if the
+	// network does not exist.
+	NetworkGateways(ctx context.Context, networkName string) ([]string, error)
 	// Close releases underlying resources.
 	Close() error
 }
@@ -59,6 +67,46 @@ func (r *RealClient) ContainerIPs(ctx context.Context, containerName string) ([]
 	return extractIPs(info), nil
 }
 
+// NetworkGateways implements Client.
+func (r *RealClient) NetworkGateways(ctx context.Context, networkName string) ([]string, error) {
+	info, err := r.cli.NetworkInspect(ctx, networkName, network.InspectOptions{})
+	if err != nil {
+		if dockerclient.IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("inspecting network %q: %w", networkName, err)
+	}
+	var gateways []string
+	for _, c := range info.IPAM.Config {
+		if net.ParseIP(c.Gateway) != nil {
+			gateways = append(gateways, c.Gateway)
+		}
+	}
+	return gateways, nil
+}
+
+// ContainerNames returns the names of the running containers. It is not
+// part of Client: only the diagnostics list containers.
+func (r *RealClient) ContainerNames(ctx context.Context) ([]string, error) {
+	list, err := r.cli.ContainerList(ctx, container.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+	return containerNames(list), nil
+}
+
+// containerNames returns the primary name of each container, without the
+// leading slash the API reports.
+func containerNames(list []types.Container) []string {
+	var names []string
+	for _, c := range list {
+		if len(c.Names) > 0 {
+			names = append(names, strings.TrimPrefix(c.Names[0], "/"))
+		}
+	}
+	return names
+}
+
 // Close implements Client.
 func (r *RealClient) Close() error {
 	return r.cli.Close()
@@ -2,18 +2,26 @@ package docker
 
 import (
 	"context"
+	"slices"
 	"testing"
+
+	"github.com/docker/docker/api/types"
 )
 
 // MockClient implements docker.Client for unit tests.
 type MockClient struct {
-	IPsFunc func(ctx context.Context, name string) ([]string, error)
+	IPsFunc      func(ctx context.Context, name string) ([]string, error)
+	GatewaysFunc func(ctx context.Context, name string) ([]string, error)
 }
 
 func (m *MockClient) ContainerIPs(ctx context.Context, name string) ([]string, error) {
 	return m.IPsFunc(ctx, name)
 }
 
+func (m *MockClient) NetworkGateways(ctx context.Context, name string) ([]string, error) {
+	return m.GatewaysFunc(ctx, name)
+}
+
 func (m *MockClient) Close() error { return nil }
 
 // Ensure MockClient satisfies the interface at compile time.
@@ -46,3 +54,14 @@ func TestMockClientSatisfiesInterface(t *testing.T) {
 		t.Errorf("expected nil for missing container, got %v", ips)
 	}
 }
+
+func TestContainerNames(t *testing.T) {
+	list := []types.Container{
+		{Names: []string{"/web", "/app/web"}},
+		{Names: nil},
+		{Names: []string{"/db"}},
+	}
+	if got := containerNames(list); !slices.Equal(got, []string{"web", "db"}) {
+		t.Errorf("containerNames() = %v, want [web db]", got)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// adminCacheEntry is the JSON representation of a cache entry.
+type adminCacheEntry struct {
+	Key        string   `json:"key"`
+	Values     []string `json:"values"`
+	TTLSeconds float64  `json:"ttl_seconds"`
+}
+
+// registerAdminRoutes mounts the cache admin API on mux. Every route is
+// wrapped in adminAuth so the token check cannot be forgotten per handler.
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+	mux.Handle("GET /admin/cache", s.adminAuth(s.adminListCache))
+	mux.Handle("DELETE /admin/cache", s.adminAuth(s.adminFlushAll))
+	mux.Handle("DELETE /admin/cache/{key}", s.adminAuth(s.adminDeleteKey))
+	mux.Handle("POST /admin/cache/flush", s.adminAuth(s.adminFlushMatching))
+}
+
+func (s *Server) newAdminServer() *http.Server {
+	mux := http.NewServeMux()
+	s.registerAdminRoutes(mux)
+	return &http.Server{
+		Addr:         s.cfg.AdminAddr,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+}
+
+// adminAuth enforces the configured bearer token. When no token is set the
+// API is only reachable through the dedicated admin address, which Validate
+// then confines to loopback.
+func (s *Server) adminAuth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AdminToken != "" {
+			got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(s.cfg.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="docker-dns"`)
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+		}
+		next(w, r)
+	})
+}
+
+func (s *Server) adminListCache(w http.ResponseWriter, _ *http.Request) {
+	items := s.cache.Items()
+	entries := make([]adminCacheEntry, len(items))
+	for i, it := range items {
+		entries[i] = adminCacheEntry{
+			Key:        it.Key,
+			Values:     it.Values,
+			TTLSeconds: it.TTL.Seconds(),
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"count": len(entries), "entries": entries})
+}
+
+func (s *Server) adminDeleteKey(w http.ResponseWriter, r *http.Request) {
+	key := dns.Fqdn(strings.ToLower(r.PathValue("key")))
+	if !s.cache.Delete(key) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "key not cached", "key": key})
+		return
+	}
+	s.log.Info("cache entry deleted via admin API", "key", key)
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": 1, "key": key})
+}
+
+// adminFlushMatching removes entries by managed TLD (?tld=docker) or by a
+// shell-style glob over the FQDN (?pattern=web-*.docker).
+func (s *Server) adminFlushMatching(w http.ResponseWriter, r *http.Request) {
+	tld := strings.ToLower(strings.Trim(r.URL.Query().Get("tld"), "."))
+	pattern := strings.ToLower(r.URL.Query().Get("pattern"))
+
+	var match func(string) bool
+	switch {
+	case tld != "" && pattern != "":
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "specify either tld or pattern, not both"})
+		return
+	case tld != "":
+		suffix := "." + tld + "."
+		match = func(k string) bool { return strings.HasSuffix(k, suffix) }
+	case pattern != "":
+		pattern = dns.Fqdn(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid pattern: " + err.Error()})
+			return
+		}
+		match = func(k string) bool {
+			ok, _ := path.Match(pattern, k)
+			return ok
+		}
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing tld or pattern query parameter"})
+		return
+	}
+
+	n := s.cache.DeleteFunc(match)
+	s.log.Info("cache flushed via admin API", "tld", tld, "pattern", pattern, "flushed", n)
+	writeJSON(w, http.StatusOK, map[string]any{"flushed": n})
+}
+
+func (s *Server) adminFlushAll(w http.ResponseWriter, _ *http.Request) {
+	n := s.cache.Flush()
+	s.log.Info("cache flushed via admin API", "flushed", n)
+	writeJSON(w, http.StatusOK, map[string]any{"flushed": n})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
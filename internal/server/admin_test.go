@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// adminRequest issues req against handler with an optional bearer token and
+// decodes the JSON body into a generic map.
+func adminRequest(t *testing.T, h http.Handler, method, target, token string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var body map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: decoding body %q: %v", method, target, rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestAdmin_DisabledWithoutToken(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.HTTPAddr = ":0"
+	srv := newTestServer(t, noopDocker(), cfg)
+
+	rec := httptest.NewRecorder()
+	srv.newHTTPServer().Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 when admin API is disabled, got %d", rec.Code)
+	}
+}
+
+func TestAdmin_RequiresToken(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.HTTPAddr = ":0"
+	cfg.AdminToken = "s3cret"
+	h := newTestServer(t, noopDocker(), cfg).newHTTPServer().Handler
+
+	if code, _ := adminRequest(t, h, http.MethodGet, "/admin/cache", ""); code != http.StatusUnauthorized {
+		t.Errorf("missing token: got %d, want 401", code)
+	}
+	if code, _ := adminRequest(t, h, http.MethodGet, "/admin/cache", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d, want 401", code)
+	}
+	if code, _ := adminRequest(t, h, http.MethodGet, "/admin/cache", "s3cret"); code != http.StatusOK {
+		t.Errorf("valid token: got %d, want 200", code)
+	}
+
+	// /metrics must stay public.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/metrics: got %d, want 200", rec.Code)
+	}
+}
+
+func TestAdmin_ListDeleteAndFlush(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.AdminAddr = "127.0.0.1:0"
+	srv := newTestServer(t, noopDocker(), cfg)
+	h := srv.newAdminServer().Handler
+
+	srv.cache.Set("web.docker.", []string{"10.0.0.1"})
+	srv.cache.Set("web-2.docker.", []string{"10.0.0.2"})
+	srv.cache.Set("api.docker.", []string{"10.0.0.3"})
+	srv.cache.Set("db.local.", []string{"10.0.0.4"})
+
+	code, body := adminRequest(t, h, http.MethodGet, "/admin/cache", "")
+	if code != http.StatusOK {
+		t.Fatalf("list: got %d", code)
+	}
+	if body["count"].(float64) != 4 {
+		t.Fatalf("list: expected 4 entries, got %v", body["count"])
+	}
+	first := body["entries"].([]any)[0].(map[string]any)
+	if first["key"] != "api.docker." || first["ttl_seconds"].(float64) <= 0 {
+		t.Errorf("list: unexpected first entry %v", first)
+	}
+
+	if code, _ := adminRequest(t, h, http.MethodDelete, "/admin/cache/API.docker", ""); code != http.StatusOK {
+		t.Errorf("delete: got %d, want 200", code)
+	}
+	if code, _ := adminRequest(t, h, http.MethodDelete, "/admin/cache/api.docker.", ""); code != http.StatusNotFound {
+		t.Errorf("delete missing key: got %d, want 404", code)
+	}
+	if st := srv.cache.Stats(); st.Hits != 0 || st.Misses != 0 {
+		t.Errorf("delete counted cache lookups: %+v", st)
+	}
+
+	code, body = adminRequest(t, h, http.MethodPost, "/admin/cache/flush?pattern=web*.docker", "")
+	if code != http.StatusOK || body["flushed"].(float64) != 2 {
+		t.Errorf("flush by pattern: got %d %v, want 2 flushed", code, body)
+	}
+	if code, _ := adminRequest(t, h, http.MethodPost, "/admin/cache/flush", ""); code != http.StatusBadRequest {
+		t.Errorf("flush without selector: got %d, want 400", code)
+	}
+
+	srv.cache.Set("web.docker.", []string{"10.0.0.1"})
+	code, body = adminRequest(t, h, http.MethodPost, "/admin/cache/flush?tld=docker", "")
+	if code != http.StatusOK || body["flushed"].(float64) != 1 {
+		t.Errorf("flush by TLD: got %d %v, want 1 flushed", code, body)
+	}
+
+	code, body = adminRequest(t, h, http.MethodDelete, "/admin/cache", "")
+	if code != http.StatusOK || body["flushed"].(float64) != 1 {
+		t.Errorf("flush all: got %d %v, want 1 flushed", code, body)
+	}
+	if n := srv.cache.Stats().Entries; n != 0 {
+		t.Errorf("expected empty cache, got %d entries", n)
+	}
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// blocker filters forwarded queries through the configured blocklists. Each
+// list is reloaded independently when its files change; a list that fails to
+// reload keeps serving its previous rules.
+type blocker struct {
+	lists     []*blocklist
+	sinkhole4 net.IP
+	sinkhole6 net.IP
+	log       *slog.Logger
+}
+
+// blocklist is one configured list and its current rules.
+type blocklist struct {
+	cfg   config.Blocklist
+	rules atomic.Pointer[listRules]
+	stamp string // modification stamp of the loaded files, see fileStamp
+}
+
+// listRules is an immutable snapshot of a list: the names it blocks and the
+// names its allow-lists (and its own exception rules) exempt.
+type listRules struct {
+	block ruleSet
+	allow ruleSet
+}
+
+// blockRule is the policy for a blocked name.
+type blockRule struct {
+	action string   // config.Block* constant
+	ips    []net.IP // sinkhole addresses; nil uses the configured ones
+}
+
+// allowed is the placeholder rule stored in allow sets.
+var allowed = &blockRule{}
+
+// ruleSet maps lower-case FQDNs to rules. exact matches the name itself,
+// below matches every name strictly beneath it.
+type ruleSet struct {
+	exact map[string]*blockRule
+	below map[string]*blockRule
+}
+
+func newRuleSet() ruleSet {
+	return ruleSet{exact: make(map[string]*blockRule), below: make(map[string]*blockRule)}
+}
+
+func (rs ruleSet) len() int { return len(rs.exact) + len(rs.below) }
+
+// match returns the rule for name: an exact entry first, then the entry of
+// the closest enclosing domain.
+func (rs ruleSet) match(name string) *blockRule {
+	if r, ok := rs.exact[name]; ok {
+		return r
+	}
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		if r, ok := rs.below[name[i:]]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+func newBlocker(cfg *config.Config, log *slog.Logger) (*blocker, error) {
+	b := &blocker{log: log}
+	for _, s := range cfg.BlocklistSinkhole {
+		if ip := net.ParseIP(s); ip.To4() != nil {
+			b.sinkhole4 = ip.To4()
+		} else {
+			b.sinkhole6 = ip
+		}
+	}
+	for _, lc := range cfg.Blocklists {
+		l := &blocklist{cfg: lc}
+		if err := b.load(l); err != nil {
+			return nil, err
+		}
+		b.lists = append(b.lists, l)
+	}
+	return b, nil
+}
+
+// match returns the first list blocking name and its rule. A name on a
+// list's allow-list is only exempt from that list.
+func (b *blocker) match(name string) (*blocklist, *blockRule) {
+	for _, l := range b.lists {
+		rules := l.rules.Load()
+		if rules.allow.match(name) != nil {
+			continue
+		}
+		if r := rules.block.match(name); r != nil {
+			return l, r
+		}
+	}
+	return nil, nil
+}
+
+// sinkhole returns the addresses answered for rule, of the family qtype asks
+// for.
+func (b *blocker) sinkhole(rule *blockRule, qtype uint16) []net.IP {
+	ips := rule.ips
+	if ips == nil {
+		ips = []net.IP{b.sinkhole4, b.sinkhole6}
+	}
+	var out []net.IP
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		if v4 := ip.To4() != nil; (qtype == dns.TypeA && v4) || (qtype == dns.TypeAAAA && !v4) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// reloadLoop reloads lists whose files changed every interval until ctx is
+// cancelled.
+func (b *blocker) reloadLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, l := range b.lists {
+				if stamp := l.fileStamp(); stamp != l.stamp {
+					if err := b.load(l); err != nil {
+						b.log.Warn("blocklist reload failed; keeping previous rules", "list", l.cfg.Name, "error", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// load reads l's files and installs the new rules. The stamp is recorded
+// even on failure, so a broken file is retried once it changes again.
+func (b *blocker) load(l *blocklist) error {
+	l.stamp = l.fileStamp()
+	rules := &listRules{block: newRuleSet(), allow: newRuleSet()}
+	if err := readList(l.cfg.Path, l.cfg.Format, l.cfg.Action, rules.block, rules.allow); err != nil {
+		return fmt.Errorf("blocklist %s: %w", l.cfg.Name, err)
+	}
+	for _, path := range l.cfg.Allow {
+		// Every entry of an allow-list exempts its names, whatever the syntax.
+		if err := readList(path, config.FormatAuto, config.BlockNXDomain, rules.allow, rules.allow); err != nil {
+			return fmt.Errorf("blocklist %s: allow-list: %w", l.cfg.Name, err)
+		}
+	}
+	l.rules.Store(rules)
+	b.log.Info("blocklist loaded", "list", l.cfg.Name, "entries", rules.block.len(), "allowed", rules.allow.len())
+	return nil
+}
+
+// fileStamp summarises the size and modification time of every file of l.
+func (l *blocklist) fileStamp() string {
+	var sb strings.Builder
+	for _, path := range append([]string{l.cfg.Path}, l.cfg.Allow...) {
+		if fi, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&sb, "%d/%d;", fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			sb.WriteString("missing;")
+		}
+	}
+	return sb.String()
+}
+
+// readList parses the list at path into block and allow, the latter taking
+// exception rules ("@@" lines, RPZ passthru).
+func readList(path, format, action string, block, allow ruleSet) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if format == config.FormatAuto {
+		format = detectFormat(path, data)
+	}
+	rule := &blockRule{action: action}
+	switch format {
+	case config.FormatRPZ:
+		return parseRPZ(bytes.NewReader(data), path, block, allow)
+	case config.FormatAdblock:
+		return parseLines(bytes.NewReader(data), func(line string) {
+			if name, below, exception, ok := parseAdblockLine(line); ok {
+				set := block
+				if exception {
+					set = allow
+				}
+				set.exact[name] = rule
+				if below {
+					set.below[name] = rule
+				}
+			}
+		})
+	default:
+		return parseLines(bytes.NewReader(data), func(line string) {
+			for _, name := range parseHostsLine(line) {
+				block.exact[name] = rule
+			}
+		})
+	}
+}
+
+// detectFormat guesses the format of a list from its extension and content.
+func detectFormat(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".rpz", ".zone":
+		return config.FormatRPZ
+	}
+	format := config.FormatHosts
+	_ = parseLines(bytes.NewReader(data), func(line string) {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || line[0] == '#' || line[0] == '!' || line[0] == ';':
+		case fields[0] == "$ORIGIN" || slices.Contains(fields, "SOA"):
+			format = config.FormatRPZ
+		case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@"):
+			if format == config.FormatHosts {
+				format = config.FormatAdblock
+			}
+		}
+	})
+	return format
+}
+
+func parseLines(r io.Reader, fn func(line string)) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fn(strings.TrimSpace(sc.Text()))
+	}
+	return sc.Err()
+}
+
+// parseHostsLine returns the names of a hosts file line ("0.0.0.0 a.example
+// b.example") or a domain list line ("a.example"). Comments are dropped.
+func parseHostsLine(line string) []string {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if net.ParseIP(fields[0]) != nil {
+		fields = fields[1:]
+	} else {
+		fields = fields[:1]
+	}
+	var names []string
+	for _, f := range fields {
+		if name, ok := listName(f); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseAdblockLine parses the domain rules of AdBlock syntax: "||a.example^"
+// blocks a.example and its subdomains, "@@" marks an exception and a bare
+// "a.example" blocks that name alone. Rules with paths, wildcards or
+// modifiers other than $important do not describe domains and are skipped.
+func parseAdblockLine(line string) (name string, below, exception, ok bool) {
+	if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+		return "", false, false, false
+	}
+	exception = strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+	line, mods, _ := strings.Cut(line, "$")
+	if mods != "" && mods != "important" {
+		return "", false, false, false
+	}
+	if strings.HasPrefix(line, "||") {
+		below = true
+		line = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(line, "||"), "|"), "^")
+	}
+	name, ok = listName(line)
+	return name, below, exception, ok
+}
+
+// listName normalises a list entry to a lower-case FQDN. Single-label names
+// such as localhost, IP addresses and anything that is not a plain domain
+// name are rejected.
+func listName(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSuffix(s, "."))
+	if !strings.Contains(s, ".") || strings.ContainsAny(s, "*/^|:") || net.ParseIP(s) != nil {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(s); !ok {
+		return "", false
+	}
+	return s + ".", true
+}
+
+// RPZ actions expressed as CNAME targets.
+const (
+	rpzNXDomain = "."
+	rpzNoData   = "*."
+	rpzPassthru = "rpz-passthru."
+	rpzDrop     = "rpz-drop."
+)
+
+// parseRPZ reads a response policy zone. Owner names relative to the zone
+// apex (the SOA owner) are QNAME triggers; "*." prefixes cover subdomains.
+// CNAME targets select the action, and A/AAAA records sinkhole the name to
+// their addresses. rpz-drop is answered with NXDOMAIN since docker-dns never
+// leaves clients without an answer. IP, NSDNAME and client triggers and
+// redirections to other names are not supported and are skipped.
+func parseRPZ(r io.Reader, path string, block, allow ruleSet) error {
+	zp := dns.NewZoneParser(r, ".", path)
+	zp.SetIncludeAllowed(false)
+	apex := "."
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if h.Rrtype == dns.TypeSOA {
+			apex = owner
+			continue
+		}
+		trigger, ok := rpzTrigger(owner, apex)
+		if !ok {
+			continue
+		}
+		set, key := block.exact, trigger
+		if strings.HasPrefix(trigger, "*.") {
+			set, key = block.below, trigger[2:]
+		}
+
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			switch strings.ToLower(rr.Target) {
+			case rpzNXDomain, rpzDrop:
+				set[key] = &blockRule{action: config.BlockNXDomain}
+			case rpzNoData:
+				set[key] = &blockRule{action: config.BlockNoData}
+			case rpzPassthru:
+				if set = allow.exact; strings.HasPrefix(trigger, "*.") {
+					set = allow.below
+				}
+				set[key] = allowed
+			}
+		case *dns.A:
+			addSinkhole(set, key, rr.A)
+		case *dns.AAAA:
+			addSinkhole(set, key, rr.AAAA)
+		}
+	}
+	return zp.Err()
+}
+
+// rpzTrigger strips the zone apex from owner, rejecting names outside the
+// zone and trigger types other than QNAME.
+func rpzTrigger(owner, apex string) (string, bool) {
+	trigger := owner
+	if apex != "." {
+		if !dns.IsSubDomain(apex, owner) || owner == apex {
+			return "", false
+		}
+		trigger = strings.TrimSuffix(owner, apex)
+	}
+	labels := dns.SplitDomainName(trigger)
+	if len(labels) == 0 || strings.HasPrefix(labels[len(labels)-1], "rpz-") {
+		return "", false
+	}
+	return strings.Join(labels, ".") + ".", true
+}
+
+// addSinkhole adds ip to the local data of key, replacing any other action.
+func addSinkhole(set map[string]*blockRule, key string, ip net.IP) {
+	r, ok := set[key]
+	if !ok || r.action != config.BlockSinkhole {
+		r = &blockRule{action: config.BlockSinkhole}
+		set[key] = r
+	}
+	r.ips = append(r.ips, ip)
+}
+
+// handleBlocked answers a query that list blocks according to rule. Clients
+// with EDNS learn why through an extended DNS error (RFC 8914).
+func (s *Server) handleBlocked(
+	w dns.ResponseWriter,
+	req *dns.Msg,
+	resp *dns.Msg,
+	q dns.Question,
+	list *blocklist,
+	rule *blockRule,
+	udpSize uint16,
+) {
+	s.metrics.BlockedQueries.Inc(list.cfg.Name)
+	s.log.Debug("query blocked", "domain", q.Name, "list", list.cfg.Name, "action", rule.action)
+	traceOf(w).detail("blocklist %s, action %s", list.cfg.Name, rule.action)
+
+	// Blocked answers stand in for forwarded ones, which are recursive.
+	resp.RecursionAvailable = true
+	switch rule.action {
+	case config.BlockNXDomain:
+		resp.SetRcode(req, dns.RcodeNameError)
+	case config.BlockSinkhole:
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(s.cfg.TTL.Seconds())}
+		for _, ip := range s.blocker.sinkhole(rule, q.Qtype) {
+			if q.Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip})
+			} else {
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: "blocked by " + list.cfg.Name})
+	}
+	s.writeResponse(w, resp, udpSize, sourceBlocked)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// writeList writes content to name in a fresh temporary directory.
+func writeList(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestList(t *testing.T, l config.Blocklist) *blocker {
+	t.Helper()
+	cfg := defaultTestConfig()
+	cfg.Blocklists = []config.Blocklist{l}
+	b, err := newBlocker(cfg, discardLogger())
+	if err != nil {
+		t.Fatalf("newBlocker: %v", err)
+	}
+	return b
+}
+
+// action returns the action b applies to name, or "" when it is not blocked.
+func action(b *blocker, name string) string {
+	if _, r := b.match(name); r != nil {
+		return r.action
+	}
+	return ""
+}
+
+func TestBlocklist_Formats(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string // query name -> expected action
+	}{
+		{
+			name: "hosts",
+			file: "hosts",
+			content: "# ad servers\n127.0.0.1 localhost\n0.0.0.0 ads.example tracker.example # inline\n" +
+				"malware.example\n",
+			want: map[string]string{
+				"ads.example.":     config.BlockNoData,
+				"tracker.example.": config.BlockNoData,
+				"malware.example.": config.BlockNoData,
+				"sub.ads.example.": "",
+				"localhost.":       "",
+			},
+		},
+		{
+			name: "adblock",
+			file: "filters.txt",
+			content: "[Adblock Plus 2.0]\n! comment\n||ads.example^\n@@||ok.ads.example^\n" +
+				"||scoped.example^$third-party\n/banner/*\nexact.example\n",
+			want: map[string]string{
+				"ads.example.":         config.BlockNoData,
+				"x.y.ads.example.":     config.BlockNoData,
+				"ok.ads.example.":      "",
+				"deep.ok.ads.example.": "",
+				"scoped.example.":      "",
+				"exact.example.":       config.BlockNoData,
+				"sub.exact.example.":   "",
+			},
+		},
+		{
+			name: "rpz",
+			file: "policy.rpz",
+			content: "$TTL 60\n$ORIGIN rpz.local.\n@ SOA ns.rpz.local. admin.rpz.local. 1 3600 600 86400 60\n@ NS ns.rpz.local.\n" +
+				"nx.example CNAME .\n*.nx.example CNAME .\nnodata.example CNAME *.\n" +
+				"sink.example A 10.0.0.1\nsink.example AAAA 2001:db8::1\n" +
+				"*.wild.example CNAME .\nok.wild.example CNAME rpz-passthru.\n" +
+				"drop.example CNAME rpz-drop.\n32.1.0.0.127.rpz-ip CNAME .\n",
+			want: map[string]string{
+				"nx.example.":        config.BlockNXDomain,
+				"a.nx.example.":      config.BlockNXDomain,
+				"nodata.example.":    config.BlockNoData,
+				"sink.example.":      config.BlockSinkhole,
+				"wild.example.":      "",
+				"a.wild.example.":    config.BlockNXDomain,
+				"ok.wild.example.":   "",
+				"drop.example.":      config.BlockNXDomain,
+				"1.0.0.127.rpz-ip.":  "",
+				"unrelated.example.": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := loadTestList(t, config.Blocklist{
+				Name: tt.name, Path: writeList(t, tt.file, tt.content), Format: config.FormatAuto, Action: config.BlockNoData,
+			})
+			for name, want := range tt.want {
+				if got := action(b, name); got != want {
+					t.Errorf("%s: action = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBlocklist_RPZSinkholeAddresses(t *testing.T) {
+	b := loadTestList(t, config.Blocklist{
+		Name:   "rpz",
+		Path:   writeList(t, "p.rpz", "sink.example. 60 IN A 10.0.0.1\nsink.example. 60 IN A 10.0.0.2\n"),
+		Format: config.FormatRPZ,
+		Action: config.BlockNXDomain,
+	})
+	_, r := b.match("sink.example.")
+	if r == nil {
+		t.Fatal("sink.example. not blocked")
+	}
+	if ips := b.sinkhole(r, dns.TypeA); len(ips) != 2 {
+		t.Errorf("want both local-data addresses, got %v", ips)
+	}
+	if ips := b.sinkhole(r, dns.TypeAAAA); len(ips) != 0 {
+		t.Errorf("no IPv6 local data, got %v", ips)
+	}
+}
+
+func TestBlocklist_AllowOnlyOverridesItsList(t *testing.T) {
+	allow := writeList(t, "allow.txt", "shared.example\n")
+	cfg := defaultTestConfig()
+	cfg.Blocklists = []config.Blocklist{
+		{Name: "ads", Path: writeList(t, "ads.txt", "shared.example\nads.example\n"), Format: config.FormatAuto, Action: config.BlockNXDomain, Allow: []string{allow}},
+		{Name: "malware", Path: writeList(t, "malware.txt", "shared.example\n"), Format: config.FormatAuto, Action: config.BlockNoData},
+	}
+	b, err := newBlocker(cfg, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, _ := b.match("shared.example."); l == nil || l.cfg.Name != "malware" {
+		t.Errorf("shared.example. should be allowed by ads but blocked by malware, got %v", l)
+	}
+	if l, _ := b.match("ads.example."); l == nil || l.cfg.Name != "ads" {
+		t.Errorf("ads.example. should be blocked by ads, got %v", l)
+	}
+}
+
+func TestBlocklist_Reload(t *testing.T) {
+	path := writeList(t, "ads.txt", "ads.example\n")
+	b := loadTestList(t, config.Blocklist{Name: "ads", Path: path, Format: config.FormatHosts, Action: config.BlockNXDomain})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.reloadLoop(ctx, 10*time.Millisecond)
+
+	future := time.Now().Add(time.Hour)
+	if err := os.WriteFile(path, []byte("tracker.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Chtimes(path, future, future)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for action(b, "tracker.example.") == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("changed list was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if action(b, "ads.example.") != "" {
+		t.Error("entries removed from the file are still blocked")
+	}
+
+	// A list that disappears keeps its last rules.
+	_ = os.Remove(path)
+	time.Sleep(50 * time.Millisecond)
+	if action(b, "tracker.example.") == "" {
+		t.Error("a failed reload dropped the previous rules")
+	}
+}
+
+func TestNewBlocker_MissingFile(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.Blocklists = []config.Blocklist{{Name: "ads", Path: filepath.Join(t.TempDir(), "nope.txt"), Format: config.FormatAuto, Action: config.BlockNXDomain}}
+	if _, err := newBlocker(cfg, discardLogger()); err == nil {
+		t.Error("want an error for a missing list")
+	}
+}
+
+func TestHandleQuery_Blocked(t *testing.T) {
+	upstream, count := startCountingUpstream(t, "192.0.2.1", dns.RcodeSuccess)
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{upstream}
+	cfg.BlocklistSinkhole = []string{"0.0.0.0", "::"}
+	cfg.Blocklists = []config.Blocklist{
+		{Name: "ads", Path: writeList(t, "ads.txt", "||ads.example^\n"), Format: config.FormatAuto, Action: config.BlockSinkhole},
+		{Name: "malware", Path: writeList(t, "malware.txt", "0.0.0.0 malware.example\n"), Format: config.FormatAuto, Action: config.BlockNXDomain},
+	}
+	srv := newTestServer(t, noopDocker(), cfg)
+	addr := serveTestDNS(t, srv)
+	c := &dns.Client{Timeout: 3 * time.Second}
+
+	a, _, err := c.Exchange(ednsQuery("cdn.ads.example."), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Answer) != 1 || !a.Answer[0].(*dns.A).A.Equal(net.IPv4zero) {
+		t.Errorf("want the sinkhole address, got %v", a.Answer)
+	}
+	if ede := findEDE(a); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeBlocked {
+		t.Errorf("want EDE Blocked, got %v", ede)
+	}
+
+	if mx := queryDNS(t, addr, "ads.example.", dns.TypeMX); mx.Rcode != dns.RcodeSuccess || len(mx.Answer) != 0 {
+		t.Errorf("sinkholed name should answer other types with NODATA, got %v", mx)
+	}
+	if nx := queryDNS(t, addr, "malware.example.", dns.TypeA); nx.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s, want NXDOMAIN", dns.RcodeToString[nx.Rcode])
+	}
+	if n := count.Load(); n != 0 {
+		t.Errorf("blocked queries must not be forwarded, upstream saw %d", n)
+	}
+	if ok := queryDNS(t, addr, "example.com.", dns.TypeA); len(ok.Answer) != 1 || count.Load() != 1 {
+		t.Errorf("unlisted names should be forwarded, got %v", ok)
+	}
+
+	if got := srv.metrics.BlockedQueries.Get("ads"); got != 2 {
+		t.Errorf("blocked by ads = %d, want 2", got)
+	}
+	rec := httptest.NewRecorder()
+	srv.httpMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`docker_dns_blocked_queries_total{list="malware"} 1`,
+		`docker_dns_blocklist_entries{list="ads"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func findEDE(m *dns.Msg) *dns.EDNS0_EDE {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				return ede
+			}
+		}
+	}
+	return nil
+}
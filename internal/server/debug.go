@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DebugOption is the EDNS0 option code (from the local/experimental range
+// of RFC 6891) a client sends, empty, to ask how its query was answered.
+// Loopback clients get it back carrying a DebugInfo; others are ignored.
+const DebugOption uint16 = 65001
+
+// DebugInfo explains how the server produced an answer.
+type DebugInfo struct {
+	// Source is the answer path: cache, docker, upstream, blocked or local.
+	Source string
+	// Detail narrows the source down, e.g. the container name, the cache
+	// that hit or the blocklist.
+	Detail string
+	// Rule lists the zones of the forward rule that routed the query
+	// ("" = the default resolvers).
+	Rule string
+	// Upstream is the resolver whose answer was used, and UpstreamRTT the
+	// duration of that exchange.
+	Upstream    string
+	UpstreamRTT time.Duration
+	// Tried lists every upstream exchange as "addr: rcode (rtt)" or
+	// "addr: error (rtt)", in completion order.
+	Tried []string
+	// Elapsed is the time the server spent on the query.
+	Elapsed time.Duration
+}
+
+// encode packs the info as a URL query string, the payload of DebugOption.
+func (d *DebugInfo) encode() []byte {
+	v := url.Values{}
+	v.Set("source", d.Source)
+	if d.Detail != "" {
+		v.Set("detail", d.Detail)
+	}
+	if d.Rule != "" {
+		v.Set("rule", d.Rule)
+	}
+	if d.Upstream != "" {
+		v.Set("upstream", d.Upstream)
+		v.Set("rtt", d.UpstreamRTT.String())
+	}
+	for _, t := range d.Tried {
+		v.Add("tried", t)
+	}
+	v.Set("elapsed", d.Elapsed.String())
+	return []byte(v.Encode())
+}
+
+// ParseDebugInfo returns the DebugInfo carried by a response, or nil when
+// the server did not include one.
+func ParseDebugInfo(resp *dns.Msg) (*DebugInfo, error) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil, nil
+	}
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != DebugOption {
+			continue
+		}
+		v, err := url.ParseQuery(string(local.Data))
+		if err != nil {
+			return nil, fmt.Errorf("malformed debug option: %w", err)
+		}
+		d := &DebugInfo{
+			Source:   v.Get("source"),
+			Detail:   v.Get("detail"),
+			Rule:     v.Get("rule"),
+			Upstream: v.Get("upstream"),
+			Tried:    v["tried"],
+		}
+		d.UpstreamRTT, _ = time.ParseDuration(v.Get("rtt"))
+		d.Elapsed, _ = time.ParseDuration(v.Get("elapsed"))
+		return d, nil
+	}
+	return nil, nil
+}
+
+// wantsDebug reports whether req carries DebugOption.
+func wantsDebug(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == DebugOption {
+			return true
+		}
+	}
+	return false
+}
+
+// queryTrace collects the DebugInfo of a query while it is answered. All
+// methods are safe on a nil trace, which records nothing.
+type queryTrace struct {
+	start time.Time
+
+	mu   sync.Mutex
+	info DebugInfo
+	rtts map[string]time.Duration
+}
+
+// traceWriter is the ResponseWriter of a query that asked for a trace.
+type traceWriter struct {
+	dns.ResponseWriter
+	trace *queryTrace
+}
+
+// withTrace wraps w when req asks for a trace and comes from a loopback
+// client, since the trace reveals the server's upstreams and containers.
+// DoH queries never get one: behind a local proxy, every client would look
+// like a loopback one.
+func withTrace(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	if !wantsDebug(req) {
+		return w
+	}
+	if _, ok := w.(*dohResponseWriter); ok {
+		return w
+	}
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		return w
+	}
+	return &traceWriter{ResponseWriter: w, trace: &queryTrace{start: time.Now()}}
+}
+
+// traceOf returns the trace of the query answered through w, or nil.
+func traceOf(w dns.ResponseWriter) *queryTrace {
+	if tw, ok := w.(*traceWriter); ok {
+		return tw.trace
+	}
+	return nil
+}
+
+type traceKey struct{}
+
+// contextWithTrace returns ctx carrying t for the forwarder.
+func contextWithTrace(ctx context.Context, t *queryTrace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) *queryTrace {
+	t, _ := ctx.Value(traceKey{}).(*queryTrace)
+	return t
+}
+
+func (t *queryTrace) detail(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Detail = fmt.Sprintf(format, args...)
+}
+
+func (t *queryTrace) rule(zones []string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Rule = strings.Join(zones, ",")
+}
+
+// attempt records one upstream exchange; result is its rcode or error.
+func (t *queryTrace) attempt(addr, result string, rtt time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rtts == nil {
+		t.rtts = make(map[string]time.Duration)
+	}
+	t.rtts[addr] = rtt
+	t.info.Tried = append(t.info.Tried, fmt.Sprintf("%s: %s (%s)", addr, result, rtt.Round(time.Microsecond)))
+}
+
+// answered records the upstream whose response was used.
+func (t *queryTrace) answered(addr string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Upstream, t.info.UpstreamRTT = addr, t.rtts[addr]
+}
+
+// attach adds the DebugOption reply to msg when the query asked for one.
+// It needs an OPT record, which the request's EDNS0 made sure of.
+func (t *queryTrace) attach(msg *dns.Msg, source string) {
+	if t == nil {
+		return
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	t.mu.Lock()
+	info := t.info
+	t.mu.Unlock()
+	info.Source = source
+	info.Elapsed = time.Since(t.start)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: DebugOption, Data: info.encode()})
+}
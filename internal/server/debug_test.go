@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// debugQuery asks addr for name with the debug option and returns the
+// response and its DebugInfo.
+func debugQuery(t *testing.T, addr, name string) (*dns.Msg, *DebugInfo) {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: DebugOption})
+	resp, _, err := (&dns.Client{Timeout: 3 * time.Second}).Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	info, err := ParseDebugInfo(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info == nil {
+		t.Fatalf("%s: no debug option in the response", name)
+	}
+	return resp, info
+}
+
+func TestDebugOption_ExplainsAnswers(t *testing.T) {
+	corp := startFakeUpstream(t, "10.8.0.7", dns.RcodeSuccess)
+	dead := deadUpstream(t)
+	dc := &mockDockerClient{ipsFunc: func(context.Context, string) ([]string, error) {
+		return []string{"172.17.0.2"}, nil
+	}}
+	cfg := defaultTestConfig()
+	cfg.ForwardStrategy = config.StrategySequential
+	cfg.ForwardRules = []config.ForwardRule{{Zones: []string{"corp.example."}, Resolvers: []string{dead, corp}}}
+	addr := serveTestDNS(t, newTestServer(t, dc, cfg))
+
+	_, info := debugQuery(t, addr, "web.docker.")
+	if info.Source != sourceDocker || info.Detail != "container web" {
+		t.Errorf("first lookup = %+v, want docker for container web", info)
+	}
+	_, info = debugQuery(t, addr, "web.docker.")
+	if info.Source != sourceCache {
+		t.Errorf("second lookup source = %q, want cache", info.Source)
+	}
+
+	resp, info := debugQuery(t, addr, "www.corp.example.")
+	if len(resp.Answer) != 1 {
+		t.Fatalf("forwarded answer = %v", resp.Answer)
+	}
+	if info.Source != sourceUpstream || info.Rule != "corp.example." || info.Upstream != corp {
+		t.Errorf("forwarded = %+v, want upstream %s through rule corp.example.", info, corp)
+	}
+	if len(info.Tried) != 2 || !strings.HasPrefix(info.Tried[0], dead+": ") || info.UpstreamRTT <= 0 {
+		t.Errorf("Tried = %q, want the dead resolver then %s", info.Tried, corp)
+	}
+	if info.Elapsed <= 0 {
+		t.Error("want the server time")
+	}
+}
+
+func TestDebugOption_OnlyOnRequest(t *testing.T) {
+	addr := serveTestDNS(t, newTestServer(t, noopDocker(), defaultTestConfig()))
+	m := new(dns.Msg)
+	m.SetQuestion("web.docker.", dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	resp, _, err := (&dns.Client{Timeout: 3 * time.Second}).Exchange(m, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := ParseDebugInfo(resp); info != nil {
+		t.Errorf("debug option sent without being asked: %+v", info)
+	}
+}
+
+// remoteWriter is a dns.ResponseWriter with a fixed client address.
+type remoteWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+}
+
+func (w *remoteWriter) RemoteAddr() net.Addr { return w.remote }
+
+func TestWithTrace_LoopbackOnly(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("web.docker.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_LOCAL{Code: DebugOption}}
+
+	for _, tt := range []struct {
+		ip   string
+		want bool
+	}{{"127.0.0.1", true}, {"::1", true}, {"172.17.0.2", false}} {
+		w := withTrace(&remoteWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.ip), Port: 5300}}, req)
+		if got := traceOf(w) != nil; got != tt.want {
+			t.Errorf("trace for %s = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	doh := &dohResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5300}}
+	if traceOf(withTrace(doh, req)) != nil {
+		t.Error("trace attached to a DoH query")
+	}
+}
+
+func TestDebugInfo_RoundTrip(t *testing.T) {
+	in := DebugInfo{
+		Source:      sourceUpstream,
+		Detail:      "DNSSEC secure",
+		Rule:        "corp.example.,10.in-addr.arpa.",
+		Upstream:    "tls://dns.example:853",
+		UpstreamRTT: 12 * time.Millisecond,
+		Tried:       []string{"8.8.8.8:53: SERVFAIL (3ms)", "tls://dns.example:853: NOERROR (12ms)"},
+		Elapsed:     15 * time.Millisecond,
+	}
+	m := new(dns.Msg)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_LOCAL{Code: DebugOption, Data: in.encode()}}
+	out, err := ParseDebugInfo(m)
+	if err != nil || out == nil {
+		t.Fatalf("ParseDebugInfo() = %v, %v", out, err)
+	}
+	if out.Source != in.Source || out.Detail != in.Detail || out.Rule != in.Rule || out.Upstream != in.Upstream ||
+		out.UpstreamRTT != in.UpstreamRTT || strings.Join(out.Tried, "|") != strings.Join(in.Tried, "|") || out.Elapsed != in.Elapsed {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+}
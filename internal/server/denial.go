@@ -0,0 +1,262 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// denial is what a set of NSEC or NSEC3 records proves about a name.
+type denial int
+
+const (
+	denialNone   denial = iota // nothing proven
+	denialProven               // the name or type provably does not exist
+	denialOptOut               // covered by an opt-out NSEC3: may be an unsigned delegation
+)
+
+// denialProof holds the verified NSEC and NSEC3 records of a negative answer.
+type denialProof struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+	ttl   time.Duration // how long the conclusions may be cached
+}
+
+func (p *denialProof) add(set *rrset) {
+	for _, rr := range set.rrs {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			p.nsec = append(p.nsec, r)
+		case *dns.NSEC3:
+			p.nsec3 = append(p.nsec3, r)
+		}
+	}
+}
+
+// deny checks that name does not exist (nxdomain) or has no qtype records.
+func (p *denialProof) deny(name string, qtype uint16, nxdomain bool) denial {
+	name = dns.Fqdn(strings.ToLower(name))
+	if len(p.nsec) > 0 {
+		if nxdomain {
+			return p.nsecNXDomain(name)
+		}
+		return p.nsecNoData(name, qtype)
+	}
+	if len(p.nsec3) > 0 {
+		if !nxdomain {
+			if n := p.nsec3Match(name); n != nil {
+				if lacks(n.TypeBitMap, qtype) {
+					return denialProven
+				}
+				return denialNone
+			}
+			// No matching NSEC3: only an opt-out span may hide the name
+			// (RFC 5155 §8.6), e.g. an unsigned delegation.
+		}
+		return p.nsec3ClosestEncloser(name, nxdomain)
+	}
+	return denialNone
+}
+
+// hasType reports whether a matching NSEC or NSEC3 lists rtype at name.
+func (p *denialProof) hasType(name string, rtype uint16) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	for _, n := range p.nsec {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			return slices.Contains(n.TypeBitMap, rtype)
+		}
+	}
+	if n := p.nsec3Match(name); n != nil {
+		return slices.Contains(n.TypeBitMap, rtype)
+	}
+	return false
+}
+
+// nsecNoData needs an NSEC at name without qtype, or for an empty
+// non-terminal an NSEC covering name whose next name lies below it
+// (RFC 4035 §5.4).
+func (p *denialProof) nsecNoData(name string, qtype uint16) denial {
+	for _, n := range p.nsec {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			if lacks(n.TypeBitMap, qtype) {
+				return denialProven
+			}
+			return denialNone
+		}
+	}
+	for _, n := range p.nsec {
+		if nsecCovers(n, name) && dns.IsSubDomain(name, strings.ToLower(n.NextDomain)) {
+			return denialProven
+		}
+	}
+	return denialNone
+}
+
+// nsecNXDomain needs NSECs covering name and the wildcard at its closest
+// encloser (RFC 4035 §5.4).
+func (p *denialProof) nsecNXDomain(name string) denial {
+	var cover *dns.NSEC
+	for _, n := range p.nsec {
+		if nsecCovers(n, name) {
+			cover = n
+			break
+		}
+	}
+	if cover == nil {
+		return denialNone
+	}
+	// The closest encloser is the longest ancestor shared with either end
+	// of the covering span.
+	ce := commonAncestor(name, cover.Hdr.Name)
+	if other := commonAncestor(name, cover.NextDomain); dns.CountLabel(other) > dns.CountLabel(ce) {
+		ce = other
+	}
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	for _, n := range p.nsec {
+		if nsecCovers(n, wildcard) {
+			return denialProven
+		}
+	}
+	return denialNone
+}
+
+// wildcardExpansion checks that name, answered from the wildcard whose
+// closest encloser has labels labels, does not exist: an NSEC covers it
+// (RFC 4035 §5.3.4) or an NSEC3 covers its next closer name (RFC 5155 §8.8).
+func (p *denialProof) wildcardExpansion(name string, labels int) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	for _, n := range p.nsec {
+		if nsecCovers(n, name) {
+			return true
+		}
+	}
+	all := dns.SplitDomainName(name)
+	if labels >= len(all) {
+		return false
+	}
+	nextCloser := dns.Fqdn(strings.Join(all[len(all)-labels-1:], "."))
+	for _, n := range p.nsec3 {
+		if n.Cover(nextCloser) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Match returns the NSEC3 whose hash matches name, if any.
+func (p *denialProof) nsec3Match(name string) *dns.NSEC3 {
+	for _, n := range p.nsec3 {
+		if n.Match(name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsec3ClosestEncloser performs the closest encloser proof (RFC 5155 §8.3):
+// an NSEC3 matches the closest encloser and another covers the next closer
+// name. For NXDOMAIN the wildcard at the closest encloser must be covered too.
+func (p *denialProof) nsec3ClosestEncloser(name string, nxdomain bool) denial {
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels); i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		if p.nsec3Match(ce) == nil {
+			continue
+		}
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		var cover *dns.NSEC3
+		for _, n := range p.nsec3 {
+			if n.Cover(nextCloser) {
+				cover = n
+				break
+			}
+		}
+		if cover == nil {
+			return denialNone
+		}
+		if cover.Flags&1 == 1 {
+			return denialOptOut
+		}
+		if !nxdomain {
+			// NODATA without a matching NSEC3 is only valid under opt-out.
+			return denialNone
+		}
+		for _, n := range p.nsec3 {
+			if n.Cover("*." + ce) {
+				return denialProven
+			}
+		}
+		return denialNone
+	}
+	return denialNone
+}
+
+// lacks reports whether a type bitmap proves qtype absent; a CNAME would
+// have answered any type.
+func lacks(bitmap []uint16, qtype uint16) bool {
+	return !slices.Contains(bitmap, qtype) && !slices.Contains(bitmap, dns.TypeCNAME)
+}
+
+// nsecCovers reports whether name falls strictly between n's owner and next
+// name in canonical order, including the wrap-around span of the last NSEC.
+func nsecCovers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare orders names per RFC 4034 §6.1: label by label from the
+// root, comparing the lower-cased label octets.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(unescapeLabel(la[i]), unescapeLabel(lb[j])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// unescapeLabel decodes the \DDD and \X escapes of a presentation-format
+// label into its wire octets.
+func unescapeLabel(l string) string {
+	if !strings.Contains(l, `\`) {
+		return l
+	}
+	var b strings.Builder
+	for i := 0; i < len(l); i++ {
+		if l[i] != '\\' || i+1 >= len(l) {
+			b.WriteByte(l[i])
+			continue
+		}
+		if i+3 < len(l) && isDigit(l[i+1]) && isDigit(l[i+2]) && isDigit(l[i+3]) {
+			b.WriteByte((l[i+1]-'0')*100 + (l[i+2]-'0')*10 + (l[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(l[i+1])
+		i++
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// commonAncestor returns the longest domain that a and b both end in.
+func commonAncestor(a, b string) string {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+	return dns.Fqdn(strings.Join(la[len(la)-n:], "."))
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalCompare(t *testing.T) {
+	// RFC 4034 §6.1 example, in canonical order.
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"\\001.z.example.",
+		"*.z.example.",
+		"\\200.z.example.",
+	}
+	for i := 0; i+1 < len(ordered); i++ {
+		if c := canonicalCompare(ordered[i], ordered[i+1]); c >= 0 {
+			t.Errorf("canonicalCompare(%q, %q) = %d, want < 0", ordered[i], ordered[i+1], c)
+		}
+	}
+	if c := canonicalCompare("WWW.Example.", "www.example."); c != 0 {
+		t.Errorf("comparison must ignore case, got %d", c)
+	}
+}
+
+func TestNSECCovers(t *testing.T) {
+	span := &dns.NSEC{Hdr: dns.RR_Header{Name: "b.example."}, NextDomain: "d.example."}
+	last := &dns.NSEC{Hdr: dns.RR_Header{Name: "x.example."}, NextDomain: "example."}
+
+	tests := []struct {
+		nsec *dns.NSEC
+		name string
+		want bool
+	}{
+		{span, "c.example.", true},
+		{span, "sub.b.example.", true},
+		{span, "b.example.", false},
+		{span, "d.example.", false},
+		{span, "e.example.", false},
+		{last, "y.example.", true},
+		{last, "a.example.", false},
+	}
+	for _, tt := range tests {
+		if got := nsecCovers(tt.nsec, tt.name); got != tt.want {
+			t.Errorf("%s NSEC %s covers %s = %v, want %v", tt.nsec.Hdr.Name, tt.nsec.NextDomain, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDenialProof_NSECEmptyNonTerminal(t *testing.T) {
+	p := &denialProof{nsec: []*dns.NSEC{
+		{Hdr: dns.RR_Header{Name: "a.example."}, NextDomain: "x.ent.example.", TypeBitMap: []uint16{dns.TypeA}},
+	}}
+	if got := p.deny("ent.example.", dns.TypeDS, false); got != denialProven {
+		t.Errorf("empty non-terminal NODATA = %v, want proven", got)
+	}
+	if got := p.deny("other.example.", dns.TypeA, false); got != denialNone {
+		t.Errorf("covered name without descendants is NXDOMAIN, not NODATA: got %v", got)
+	}
+}
+
+// nsec3Chain builds an NSEC3 chain for names in zone, with the given bitmap
+// at every name and opt-out set when optOut is true.
+func nsec3Chain(zone string, optOut bool, names map[string][]uint16) []*dns.NSEC3 {
+	type hashed struct {
+		hash  string
+		types []uint16
+	}
+	var hs []hashed
+	for name, types := range names {
+		hs = append(hs, hashed{dns.HashName(name, dns.SHA1, 0, ""), types})
+	}
+	sort.Slice(hs, func(i, j int) bool { return hs[i].hash < hs[j].hash })
+
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	out := make([]*dns.NSEC3, len(hs))
+	for i, h := range hs {
+		out[i] = &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: h.hash + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: hs[(i+1)%len(hs)].hash,
+			TypeBitMap: h.types,
+		}
+	}
+	return out
+}
+
+func TestDenialProof_NSEC3(t *testing.T) {
+	names := map[string][]uint16{
+		"example.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY},
+		"www.example.": {dns.TypeA},
+	}
+
+	tests := []struct {
+		name     string
+		optOut   bool
+		qname    string
+		qtype    uint16
+		nxdomain bool
+		want     denial
+	}{
+		{"NODATA at an existing name", false, "www.example.", dns.TypeAAAA, false, denialProven},
+		{"type present is not denied", false, "www.example.", dns.TypeA, false, denialNone},
+		{"NXDOMAIN via closest encloser", false, "nope.example.", dns.TypeA, true, denialProven},
+		{"NODATA without a matching NSEC3", false, "nope.example.", dns.TypeDS, false, denialNone},
+		{"opt-out span", true, "nope.example.", dns.TypeDS, false, denialOptOut},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &denialProof{nsec3: nsec3Chain("example.", tt.optOut, names)}
+			if got := p.deny(tt.qname, tt.qtype, tt.nxdomain); got != tt.want {
+				t.Errorf("deny(%s %s) = %v, want %v", tt.qname, dns.TypeToString[tt.qtype], got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDenialProof_WildcardExpansion(t *testing.T) {
+	chain := nsec3Chain("example.", false, map[string][]uint16{
+		"example.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY},
+		"*.example.":   {dns.TypeA},
+		"sub.example.": {dns.TypeA},
+		"www.example.": {dns.TypeA},
+	})
+	p := &denialProof{nsec3: chain}
+	if !p.wildcardExpansion("nope.example.", 1) {
+		t.Error("next closer name covered by NSEC3: want the expansion proven")
+	}
+	if p.wildcardExpansion("www.example.", 1) {
+		t.Error("www.example. exists: an expansion for it must not be proven")
+	}
+	if !p.wildcardExpansion("a.b.example.", 1) {
+		t.Error("b.example. is the next closer name and is covered: want proven")
+	}
+	if (&denialProof{}).wildcardExpansion("nope.example.", 1) {
+		t.Error("no denial records: want unproven")
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohPath is where DNS-over-HTTPS queries are served (RFC 8484 §4.1).
+const dohPath = "/dns-query"
+
+// dohWriteTimeout leaves room for forwarded queries that try several
+// resolvers, well beyond the 5s of the other HTTP endpoints. serveDoH sets it
+// per request, so that it also applies on the shared --http-addr server.
+const dohWriteTimeout = 30 * time.Second
+
+// newDoHServer builds the dedicated DNS-over-HTTPS listener. HTTP/2 is
+// negotiated over TLS, so clients can multiplex queries on one connection.
+func (s *Server) newDoHServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, s.serveDoH)
+	return &http.Server{
+		Addr:         s.cfg.DoHAddr,
+		Handler:      mux,
+		TLSConfig:    s.dohCert.tlsConfig(),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: dohWriteTimeout,
+		IdleTimeout:  2 * time.Minute,
+	}
+}
+
+// serveDoH answers an RFC 8484 request, GET with a base64url "dns" parameter
+// or POST with a wire-format body, through the regular query pipeline.
+func (s *Server) serveDoH(w http.ResponseWriter, r *http.Request) {
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(dohWriteTimeout))
+	status := s.answerDoH(w, r)
+	s.metrics.DoHRequests.Inc(r.Method, strconv.Itoa(status))
+}
+
+func (s *Server) answerDoH(w http.ResponseWriter, r *http.Request) int {
+	var (
+		packed []byte
+		err    error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query().Get("dns")
+		if q == "" {
+			return dohError(w, http.StatusBadRequest, "missing dns parameter")
+		}
+		packed, err = base64.RawURLEncoding.DecodeString(q)
+	case http.MethodPost:
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != dohMediaType {
+			return dohError(w, http.StatusUnsupportedMediaType, "content type must be "+dohMediaType)
+		}
+		packed, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err == nil && len(packed) > dns.MaxMsgSize {
+			return dohError(w, http.StatusRequestEntityTooLarge, "query too large")
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		return dohError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	if err != nil {
+		return dohError(w, http.StatusBadRequest, "unreadable query")
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return dohError(w, http.StatusBadRequest, "malformed DNS message")
+	}
+
+	dw := newDoHResponseWriter(r, s.dohClient(r))
+	s.handleQuery(dw, req)
+	if dw.packed == nil {
+		return dohError(w, http.StatusInternalServerError, "no response")
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	// RFC 8484 §5.1: HTTP caches must not outlive the records' TTLs.
+	if rc := dw.msg.Rcode; (rc == dns.RcodeSuccess || rc == dns.RcodeNameError) && !dw.msg.Truncated {
+		if ttl := responseTTL(dw.msg); ttl > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(dw.packed)
+	return http.StatusOK
+}
+
+// dohClient returns the address of the client behind r. That is the peer,
+// unless the peer is a trusted proxy: then the forwarding headers are walked
+// from the nearest hop outwards, and the first address not itself a trusted
+// proxy is the client. Hops further out are set by that client and ignored.
+func (s *Server) dohClient(r *http.Request) netip.AddrPort {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !s.trustedProxy(peer.Addr()) {
+		return peer
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// "unknown" or an obfuscated name: the proxy is all we know.
+			return peer
+		}
+		if addr = addr.Unmap(); !s.trustedProxy(addr) || i == 0 {
+			return netip.AddrPortFrom(addr, 0)
+		}
+	}
+	return peer
+}
+
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor lists the client addresses recorded by proxies, the nearest
+// last: the for= parameters of Forwarded (RFC 7239) or, without it,
+// X-Forwarded-For. Ports and IPv6 brackets are removed.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, line := range h.Values("Forwarded") {
+		for _, elem := range strings.Split(line, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, forwardedNode(strings.Trim(v, `"`)))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, line := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(line, ",") {
+			hops = append(hops, forwardedNode(strings.TrimSpace(hop)))
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the port from a forwarded node such as
+// "192.0.2.1:4711" or "[2001:db8::1]:4711".
+func forwardedNode(node string) string {
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().String()
+	}
+	return strings.Trim(node, "[]")
+}
+
+func dohError(w http.ResponseWriter, status int, msg string) int {
+	http.Error(w, msg, status)
+	return status
+}
+
+// dohResponseWriter captures the answer handleQuery writes for an HTTP
+// request. Its addresses are TCP addresses, so answers are never truncated
+// to a UDP payload size.
+type dohResponseWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+	packed        []byte
+}
+
+func newDoHResponseWriter(r *http.Request, client netip.AddrPort) *dohResponseWriter {
+	w := &dohResponseWriter{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+	if client.IsValid() {
+		w.remote = net.TCPAddrFromAddrPort(client)
+	}
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = la
+	}
+	return w
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.msg, w.packed = m, packed
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg, w.packed = m, append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohTestServer serves web.docker (172.17.0.2) with DoH on the HTTP server.
+func dohTestServer(t *testing.T) *Server {
+	t.Helper()
+	dc := &mockDockerClient{ipsFunc: func(_ context.Context, name string) ([]string, error) {
+		if name == "web" {
+			return []string{"172.17.0.2"}, nil
+		}
+		return nil, nil
+	}}
+	cfg := defaultTestConfig()
+	cfg.HTTPAddr = "127.0.0.1:0"
+	cfg.DoHServeHTTP = true
+	return newTestServer(t, dc, cfg)
+}
+
+func packQuery(t *testing.T, name string, qtype uint16) []byte {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func unpackDoH(t *testing.T, rec *httptest.ResponseRecorder) *dns.Msg {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != dohMediaType {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(rec.Body.Bytes()); err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	return m
+}
+
+func TestServeDoH(t *testing.T) {
+	srv := dohTestServer(t)
+	h := srv.newHTTPServer().Handler
+	packed := packQuery(t, "web.docker.", dns.TypeA)
+
+	get := httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+	post := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(packed))
+	post.Header.Set("Content-Type", dohMediaType)
+
+	for _, req := range []*http.Request{get, post} {
+		t.Run(req.Method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			m := unpackDoH(t, rec)
+			if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "172.17.0.2" {
+				t.Errorf("unexpected answer %v", m.Answer)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != "max-age=10" {
+				t.Errorf("Cache-Control = %q, want the answer TTL", cc)
+			}
+		})
+	}
+	if got := srv.metrics.QueriesTotal.Load(); got != 2 {
+		t.Errorf("queries_total = %d, want 2", got)
+	}
+	if got := srv.metrics.DoHRequests.Get(http.MethodPost, "200"); got != 1 {
+		t.Errorf("DoH POST requests = %d, want 1", got)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(packQuery(t, "nope.docker.", dns.TypeA)), nil))
+	if m := unpackDoH(t, rec); m.Rcode != dns.RcodeNameError || rec.Header().Get("Cache-Control") != "" {
+		t.Errorf("want an uncached NXDOMAIN without SOA, got %s, %q", dns.RcodeToString[m.Rcode], rec.Header().Get("Cache-Control"))
+	}
+}
+
+func TestServeDoH_OutlivesHTTPWriteTimeout(t *testing.T) {
+	slow := startUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(200 * time.Millisecond)
+		fakeUpstreamHandler("5.6.7.8", dns.RcodeSuccess, nil).ServeDNS(w, req)
+	}))
+	cfg := defaultTestConfig()
+	cfg.HTTPAddr = "127.0.0.1:0"
+	cfg.DoHServeHTTP = true
+	cfg.Resolvers = []string{slow}
+	srv := newTestServer(t, noopDocker(), cfg)
+
+	hs := srv.newHTTPServer()
+	hs.WriteTimeout = 50 * time.Millisecond // stands in for the 5s of the shared server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = hs.Serve(ln) }()
+	t.Cleanup(func() { _ = hs.Close() })
+
+	url := "http://" + ln.Addr().String() + dohPath + "?dns=" + base64.RawURLEncoding.EncodeToString(packQuery(t, "example.com.", dns.TypeA))
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("slow forward cut off: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	m := new(dns.Msg)
+	if err != nil || m.Unpack(body) != nil || len(m.Answer) != 1 {
+		t.Errorf("slow forward: status %d, %d bytes, err %v", resp.StatusCode, len(body), err)
+	}
+}
+
+func TestServeDoH_BadRequests(t *testing.T) {
+	srv := dohTestServer(t)
+	h := srv.newHTTPServer().Handler
+	packed := packQuery(t, "web.docker.", dns.TypeA)
+
+	post := func(ct string, body []byte) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(body))
+		r.Header.Set("Content-Type", ct)
+		return r
+	}
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"PUT", httptest.NewRequest(http.MethodPut, dohPath, bytes.NewReader(packed)), http.StatusMethodNotAllowed},
+		{"GET without dns", httptest.NewRequest(http.MethodGet, dohPath, nil), http.StatusBadRequest},
+		{"GET with invalid base64", httptest.NewRequest(http.MethodGet, dohPath+"?dns=AAA*", nil), http.StatusBadRequest},
+		{"POST wrong content type", post("application/json", packed), http.StatusUnsupportedMediaType},
+		{"POST garbage", post(dohMediaType, []byte{1, 2, 3}), http.StatusBadRequest},
+		{"POST too large", post(dohMediaType, make([]byte, dns.MaxMsgSize+1)), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, tt.req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+	if got := srv.metrics.DoHRequests.Get(http.MethodPost, "400"); got != 1 {
+		t.Errorf("DoH POST 400s = %d, want 1", got)
+	}
+	if got := srv.metrics.QueriesTotal.Load(); got != 0 {
+		t.Errorf("rejected requests must not reach the resolver, queries_total = %d", got)
+	}
+}
+
+func TestServeDoH_RateLimited(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.DoHServeHTTP = true
+	cfg.HTTPAddr = "127.0.0.1:0"
+	cfg.RateLimit, cfg.RateBurst = 0.001, 1
+	srv := newTestServer(t, noopDocker(), cfg)
+	h := srv.newHTTPServer().Handler
+
+	var last *dns.Msg
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(packQuery(t, "nope.docker.", dns.TypeA)), nil)
+		req.RemoteAddr = "198.51.100.7:40000"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		last = unpackDoH(t, rec)
+	}
+	if last.Rcode != dns.RcodeRefused || srv.metrics.RateLimited.Load() != 1 {
+		t.Errorf("second query from the same client should be refused, got %s", dns.RcodeToString[last.Rcode])
+	}
+}
+
+func TestDoHClient(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.DoHTrustedProxies = []string{"10.0.0.0/8", "::1"}
+	srv := newTestServer(t, noopDocker(), cfg)
+
+	tests := []struct {
+		name, peer, header, value, want string
+	}{
+		{"direct client", "198.51.100.7:40000", "", "", "198.51.100.7:40000"},
+		{"untrusted peer's header ignored", "198.51.100.7:40000", "X-Forwarded-For", "203.0.113.9", "198.51.100.7:40000"},
+		{"trusted proxy", "10.0.0.2:5000", "X-Forwarded-For", "203.0.113.9", "203.0.113.9:0"},
+		{"spoofed hop skipped", "10.0.0.2:5000", "X-Forwarded-For", "192.0.2.1, 203.0.113.9, 10.0.0.3", "203.0.113.9:0"},
+		{"only proxies", "10.0.0.2:5000", "X-Forwarded-For", "10.0.0.4, 10.0.0.3", "10.0.0.4:0"},
+		{"unknown hop", "10.0.0.2:5000", "X-Forwarded-For", "203.0.113.9, unknown", "10.0.0.2:5000"},
+		{"no header", "[::1]:5000", "", "", "[::1]:5000"},
+		{"forwarded", "[::1]:5000", "Forwarded", `for=192.0.2.1, for="[2001:db8::7]:4711";proto=https`, "[2001:db8::7]:0"},
+		{"forwarded wins", "[::1]:5000", "Forwarded", "for=192.0.2.1", "192.0.2.1:0"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, dohPath, nil)
+		req.RemoteAddr = tt.peer
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		if tt.name == "forwarded wins" {
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		}
+		if got := srv.dohClient(req).String(); got != tt.want {
+			t.Errorf("%s: dohClient() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDoHListener(t *testing.T) {
+	pki := newTestPKI(t)
+	cfg := defaultTestConfig()
+	cfg.DoHAddr, cfg.DoHCert, cfg.DoHKey = "127.0.0.1:0", pki.certFile, pki.keyFile
+	srv := newTestServer(t, &mockDockerClient{ipsFunc: func(context.Context, string) ([]string, error) {
+		return []string{"172.17.0.2"}, nil
+	}}, cfg)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doh := srv.newDoHServer()
+	go func() { _ = doh.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = doh.Close() })
+
+	caPEM, _ := os.ReadFile(pki.caFile)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	client := &http.Client{
+		Timeout: 3 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "dns.test"},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := client.Post("https://"+ln.Addr().String()+dohPath, dohMediaType, bytes.NewReader(packQuery(t, "web.docker.", dns.TypeA)))
+	if err != nil {
+		t.Fatalf("DoH request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 {
+		t.Errorf("want HTTP/2, got %s", resp.Proto)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil || len(m.Answer) != 1 {
+		t.Errorf("unexpected DoH answer %v (%v)", m, err)
+	}
+
+	// Only /dns-query is served on the dedicated listener.
+	if resp, err := client.Get("https://" + ln.Addr().String() + "/metrics"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("/metrics on the DoH listener: status %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestNewDoHServer_BadCertificate(t *testing.T) {
+	cfg := defaultTestConfig()
+	dir := t.TempDir()
+	cfg.DoHAddr, cfg.DoHCert, cfg.DoHKey = "127.0.0.1:0", filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_ = os.WriteFile(cfg.DoHCert, []byte("not a certificate"), 0o600)
+	if _, err := New(cfg, nil, noopDocker(), discardLogger()); err == nil || !strings.Contains(err.Error(), "DoH certificate") {
+		t.Errorf("want a certificate error, got %v", err)
+	}
+}
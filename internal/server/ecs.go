@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// ecsPolicy decides what EDNS Client Subnet data (RFC 7871) upstreams see.
+type ecsPolicy struct {
+	mode    string // config.ECSPass, config.ECSStrip or config.ECSSynthesize
+	prefix4 uint8
+	prefix6 uint8
+}
+
+func newECSPolicy(cfg *config.Config) ecsPolicy {
+	return ecsPolicy{mode: cfg.ECSPolicy, prefix4: uint8(cfg.ECSPrefix4), prefix6: uint8(cfg.ECSPrefix6)}
+}
+
+// newForwardEDNSFilter builds the option filter for forwarded traffic. The
+// ECS policy, not --forward-edns-options, has the last word on the subnet
+// option.
+func newForwardEDNSFilter(cfg *config.Config) ednsFilter {
+	f := newEDNSFilter(cfg.ForwardEDNSOptions)
+	switch cfg.ECSPolicy {
+	case config.ECSStrip:
+		delete(f, dns.EDNS0SUBNET)
+	case config.ECSSynthesize:
+		f[dns.EDNS0SUBNET] = true
+	}
+	return f
+}
+
+// query returns req as it should be forwarded for a client at addr: without
+// ECS when stripping, with a synthesized ECS option when synthesizing, and
+// unchanged otherwise. req itself is never modified.
+func (p ecsPolicy) query(req *dns.Msg, addr net.IP) *dns.Msg {
+	switch p.mode {
+	case config.ECSStrip:
+		if clientSubnet(req) == nil {
+			return req
+		}
+		m := req.Copy()
+		opt := m.IsEdns0()
+		opt.Option = withoutSubnet(opt.Option)
+		return m
+
+	case config.ECSSynthesize:
+		subnet := p.synthesize(addr)
+		if subnet == nil {
+			return req
+		}
+		m := req.Copy()
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt = m.IsEdns0()
+		}
+		opt.Option = append(withoutSubnet(opt.Option), subnet)
+		return m
+	}
+	return req
+}
+
+// synthesize builds an ECS option from addr truncated to the configured
+// prefix. Loopback and unknown addresses reveal nothing useful and get none.
+func (p ecsPolicy) synthesize(addr net.IP) *dns.EDNS0_SUBNET {
+	if addr == nil || addr.IsLoopback() || addr.IsUnspecified() {
+		return nil
+	}
+	o := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if v4 := addr.To4(); v4 != nil {
+		o.Family, o.SourceNetmask = 1, p.prefix4
+		o.Address = v4.Mask(net.CIDRMask(int(p.prefix4), 32))
+	} else {
+		o.Family, o.SourceNetmask = 2, p.prefix6
+		o.Address = addr.Mask(net.CIDRMask(int(p.prefix6), 128))
+	}
+	return o
+}
+
+// respondECS fixes the ECS option of resp, the reply to req. Clients that
+// sent ECS get their own option back with scope, the prefix length the
+// answer applies to; others never see one (RFC 7871 §7.2.1).
+func respondECS(req, resp *dns.Msg, scope uint8) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opt.Option = withoutSubnet(opt.Option)
+	cs := clientSubnet(req)
+	if cs == nil {
+		return
+	}
+	echo := *cs
+	echo.SourceScope = min(scope, cs.SourceNetmask)
+	opt.Option = append(opt.Option, &echo)
+}
+
+// responseScope returns the ECS scope of an upstream answer to a query that
+// carried sent, or 0 when the answer applies to every client.
+func responseScope(sent *dns.EDNS0_SUBNET, resp *dns.Msg) uint8 {
+	if sent == nil {
+		return 0
+	}
+	got := clientSubnet(resp)
+	if got == nil || got.Family != sent.Family {
+		return 0
+	}
+	// A scope longer than the source prefix only applies to the source
+	// prefix itself (RFC 7871 §7.3.1).
+	return min(got.SourceScope, sent.SourceNetmask)
+}
+
+// clientSubnet returns the ECS option of m, if any.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+func withoutSubnet(opts []dns.EDNS0) []dns.EDNS0 {
+	var out []dns.EDNS0
+	for _, o := range opts {
+		if o.Option() != dns.EDNS0SUBNET {
+			out = append(out, o)
+		}
+	}
+	return out
+}
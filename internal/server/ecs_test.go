@@ -0,0 +1,168 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// ecsQuery is an EDNS query for name carrying the client subnet cidr.
+func ecsQuery(t *testing.T, name, cidr string) *dns.Msg {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("parse %s: %v", cidr, err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	o := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ipnet.IP}
+	if ipnet.IP.To4() == nil {
+		o.Family = 2
+	}
+	req := ednsQuery(name)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, o)
+	return req
+}
+
+func subnetString(o *dns.EDNS0_SUBNET) string {
+	if o == nil {
+		return "none"
+	}
+	return o.String()
+}
+
+func TestECSPolicy_Query(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		req    func() *dns.Msg
+		client string
+		want   string // expected subnet, "none" for no option
+	}{
+		{"pass keeps the client option", config.ECSPass, func() *dns.Msg { return ecsQuery(t, "example.com.", "198.51.100.0/24") }, "192.0.2.1", "198.51.100.0/24/0"},
+		{"strip removes it", config.ECSStrip, func() *dns.Msg { return ecsQuery(t, "example.com.", "198.51.100.0/24") }, "192.0.2.1", "none"},
+		{"synthesize from IPv4", config.ECSSynthesize, func() *dns.Msg { return ednsQuery("example.com.") }, "203.0.113.77", "203.0.113.0/24/0"},
+		{"synthesize from IPv6", config.ECSSynthesize, func() *dns.Msg { return ednsQuery("example.com.") }, "2001:db8:1:2ff::1", "[2001:db8:1:200::]/56/0"},
+		{"synthesize replaces the client option", config.ECSSynthesize, func() *dns.Msg { return ecsQuery(t, "example.com.", "198.51.100.0/24") }, "203.0.113.77", "203.0.113.0/24/0"},
+		{"synthesize adds OPT when missing", config.ECSSynthesize, func() *dns.Msg {
+			m := new(dns.Msg)
+			m.SetQuestion("example.com.", dns.TypeA)
+			return m
+		}, "203.0.113.77", "203.0.113.0/24/0"},
+		{"synthesize skips loopback clients", config.ECSSynthesize, func() *dns.Msg { return ednsQuery("example.com.") }, "127.0.0.1", "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := ecsPolicy{mode: tt.mode, prefix4: 24, prefix6: 56}
+			req := tt.req()
+			before := subnetString(clientSubnet(req))
+
+			got := p.query(req, net.ParseIP(tt.client))
+			if s := subnetString(clientSubnet(got)); s != tt.want {
+				t.Errorf("upstream subnet = %s, want %s", s, tt.want)
+			}
+			if after := subnetString(clientSubnet(req)); after != before {
+				t.Errorf("client request modified: %s -> %s", before, after)
+			}
+		})
+	}
+}
+
+func TestRespondECS(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.SetEdns0(1232, false)
+	resp.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(203, 0, 113, 0)}}
+	respondECS(ednsQuery("example.com."), resp, 24)
+	if o := clientSubnet(resp); o != nil {
+		t.Errorf("client without ECS must not get one back, got %v", o)
+	}
+
+	respondECS(ecsQuery(t, "example.com.", "198.51.100.0/24"), resp, 32)
+	o := clientSubnet(resp)
+	if o == nil || !o.Address.Equal(net.IPv4(198, 51, 100, 0)) || o.SourceScope != 24 {
+		t.Errorf("want the client's subnet with scope clamped to 24, got %v", o)
+	}
+}
+
+func TestHandleForward_ECSScopedCache(t *testing.T) {
+	var queries atomic.Int64
+	upstream, last := capturingUpstream(t, func(req *dns.Msg) *dns.Msg {
+		queries.Add(1)
+		resp := answerA(req)
+		if o := clientSubnet(req); o != nil {
+			echo := *o
+			echo.SourceScope = o.SourceNetmask
+			resp.SetEdns0(1232, false)
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &echo)
+		}
+		return resp
+	})
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{upstream}
+	cfg.ForwardCache = true
+	addr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+	c := &dns.Client{Timeout: 3 * time.Second}
+
+	exchange := func(req *dns.Msg) *dns.Msg {
+		t.Helper()
+		resp, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		return resp
+	}
+
+	first := exchange(ecsQuery(t, "cdn.example.", "198.51.100.0/24"))
+	if o := clientSubnet(last()); o == nil || o.SourceNetmask != 24 {
+		t.Fatalf("client subnet not passed upstream: %v", o)
+	}
+	if o := clientSubnet(first); o == nil || o.SourceScope != 24 {
+		t.Fatalf("want the subnet echoed with scope 24, got %v", o)
+	}
+
+	exchange(ecsQuery(t, "cdn.example.", "198.51.100.0/24"))
+	if n := queries.Load(); n != 1 {
+		t.Errorf("same subnet should be served from cache, upstream saw %d queries", n)
+	}
+
+	exchange(ecsQuery(t, "cdn.example.", "203.0.113.0/24"))
+	if n := queries.Load(); n != 2 {
+		t.Errorf("another subnet must not reuse a scoped answer, upstream saw %d queries", n)
+	}
+
+	// Without ECS the upstream answers with global scope, shared by everyone.
+	exchange(ednsQuery("global.example."))
+	hit := exchange(ecsQuery(t, "global.example.", "192.0.2.0/24"))
+	if n := queries.Load(); n != 3 {
+		t.Errorf("want a global answer reused across subnets, upstream saw %d queries", n)
+	}
+	if o := clientSubnet(hit); o == nil || o.SourceScope != 0 {
+		t.Errorf("a global answer must be echoed with scope 0, got %v", o)
+	}
+	if len(hit.Answer) != 1 || hit.Answer[0].Header().Ttl > 60 {
+		t.Errorf("unexpected cached answer %v", hit.Answer)
+	}
+}
+
+func TestHandleForward_ECSStrip(t *testing.T) {
+	upstream, last := capturingUpstream(t, answerA)
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{upstream}
+	cfg.ECSPolicy = config.ECSStrip
+	addr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+
+	c := &dns.Client{Timeout: 3 * time.Second}
+	resp, _, err := c.Exchange(ecsQuery(t, "example.com.", "198.51.100.0/24"), addr)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if o := clientSubnet(last()); o != nil {
+		t.Errorf("ECS must be stripped upstream, got %v", o)
+	}
+	if o := clientSubnet(resp); o == nil || o.SourceScope != 0 {
+		t.Errorf("client should get its subnet back with scope 0, got %v", o)
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import "github.com/miekg/dns"
+
+// ednsFilter is the set of EDNS0 option codes relayed between clients and
+// upstreams. Options outside it are hop-by-hop or unknown and are dropped.
+type ednsFilter map[uint16]bool
+
+func newEDNSFilter(codes []uint16) ednsFilter {
+	f := make(ednsFilter, len(codes))
+	for _, c := range codes {
+		f[c] = true
+	}
+	return f
+}
+
+// options returns the allowed subset of opts.
+func (f ednsFilter) options(opts []dns.EDNS0) []dns.EDNS0 {
+	var out []dns.EDNS0
+	for _, o := range opts {
+		if f[o.Option()] {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// withoutOPT returns rrs minus any OPT pseudo-record.
+func withoutOPT(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// capturingUpstream records the last query it received and answers it with
+// the reply built by respond.
+func capturingUpstream(t *testing.T, respond func(req *dns.Msg) *dns.Msg) (string, func() *dns.Msg) {
+	t.Helper()
+	var (
+		mu   sync.Mutex
+		last *dns.Msg
+	)
+	addr := startUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		last = req.Copy()
+		mu.Unlock()
+		_ = w.WriteMsg(respond(req))
+	}))
+	return addr, func() *dns.Msg {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
+
+func answerA(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(5, 6, 7, 8).To4(),
+	})
+	return resp
+}
+
+func ednsQuery(name string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.SetEdns0(1232, true)
+	return req
+}
+
+func TestForward_PreservesHeaderAndFiltersEDNS(t *testing.T) {
+	upstream, lastQuery := capturingUpstream(t, answerA)
+	f := newTestForwarder(t, []string{upstream}, "parallel")
+
+	req := ednsQuery("example.com.")
+	req.Id = 4321
+	req.AuthenticatedData = true
+	req.CheckingDisabled = true
+	opt := req.IsEdns0()
+	opt.Option = []dns.EDNS0{
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 0, 2, 0).To4()},
+		&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1}},
+	}
+
+	if _, err := f.Forward(t.Context(), req); err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	q := lastQuery()
+	if q.Id != 4321 {
+		t.Errorf("upstream saw ID %d, want the client's 4321", q.Id)
+	}
+	if !q.RecursionDesired || !q.AuthenticatedData || !q.CheckingDisabled {
+		t.Errorf("header flags not preserved: RD=%v AD=%v CD=%v", q.RecursionDesired, q.AuthenticatedData, q.CheckingDisabled)
+	}
+	qopt := q.IsEdns0()
+	if qopt == nil || qopt.UDPSize() != 1232 || !qopt.Do() {
+		t.Fatalf("expected OPT with size 1232 and DO, got %v", qopt)
+	}
+	var codes []uint16
+	for _, o := range qopt.Option {
+		codes = append(codes, o.Option())
+	}
+	if len(codes) != 1 || codes[0] != dns.EDNS0SUBNET {
+		t.Errorf("forwarded EDNS0 options = %v, want subnet only", codes)
+	}
+}
+
+func TestForward_RecursionDesiredClearedStaysCleared(t *testing.T) {
+	upstream, lastQuery := capturingUpstream(t, answerA)
+	f := newTestForwarder(t, []string{upstream}, "parallel")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.RecursionDesired = false
+	if _, err := f.Forward(t.Context(), req); err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	if q := lastQuery(); q.RecursionDesired || q.IsEdns0() != nil {
+		t.Errorf("expected RD=0 and no OPT upstream, got RD=%v OPT=%v", q.RecursionDesired, q.IsEdns0())
+	}
+}
+
+func TestHandleForward_MapsResponseFlagsAndOPT(t *testing.T) {
+	upstream, _ := capturingUpstream(t, func(req *dns.Msg) *dns.Msg {
+		resp := answerA(req)
+		resp.AuthenticatedData = true
+		resp.RecursionAvailable = true
+		opt := new(dns.OPT)
+		opt.Hdr = dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}
+		opt.SetUDPSize(4096)
+		opt.Option = []dns.EDNS0{
+			&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "7570"},
+			&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 100},
+		}
+		resp.Extra = append(resp.Extra, opt)
+		return resp
+	})
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{upstream}
+	addr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+
+	req := ednsQuery("example.com.")
+	req.CheckingDisabled = true
+	c := &dns.Client{Timeout: 3 * time.Second}
+	resp, _, err := c.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+
+	if resp.Id != req.Id {
+		t.Errorf("response ID %d, want %d", resp.Id, req.Id)
+	}
+	if !resp.AuthenticatedData || !resp.CheckingDisabled || !resp.RecursionAvailable {
+		t.Errorf("flags not mapped back: AD=%v CD=%v RA=%v", resp.AuthenticatedData, resp.CheckingDisabled, resp.RecursionAvailable)
+	}
+	var opts int
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts != 1 {
+		t.Fatalf("expected exactly one OPT record, got %d", opts)
+	}
+	opt := resp.IsEdns0()
+	if !opt.Do() || opt.UDPSize() != 1232 {
+		t.Errorf("response OPT should echo the client's DO bit and size, got DO=%v size=%d", opt.Do(), opt.UDPSize())
+	}
+	if len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0NSID {
+		t.Errorf("expected only the NSID option to be relayed, got %v", opt.Option)
+	}
+}
+
+func TestHandleForward_RelaysExtendedRcode(t *testing.T) {
+	upstream, _ := capturingUpstream(t, func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeBadCookie)
+		resp.SetEdns0(1232, false)
+		return resp
+	})
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{upstream}
+	addr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+
+	c := &dns.Client{Timeout: 3 * time.Second}
+	resp, _, err := c.Exchange(ednsQuery("example.com."), addr)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Rcode != dns.RcodeBadCookie {
+		t.Errorf("rcode = %s, want BADCOOKIE", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestHandleQuery_NonQueryOpcodeNotForwarded(t *testing.T) {
+	upstream, count := startCountingUpstream(t, "192.0.2.1", dns.RcodeSuccess)
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{upstream}
+	addr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+
+	req := new(dns.Msg)
+	req.SetNotify("example.com.")
+	resp, _, err := (&dns.Client{Timeout: 3 * time.Second}).Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("rcode = %s, want NOTIMP", dns.RcodeToString[resp.Rcode])
+	}
+	if n := count.Load(); n != 0 {
+		t.Errorf("NOTIFY reached the upstream %d times", n)
+	}
+}
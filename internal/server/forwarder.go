@@ -2,76 +2,168 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/medunes/docker-dns/internal/config"
 	"github.com/miekg/dns"
 )
 
-// Forwarder dispatches DNS queries to a set of upstream resolvers in parallel
-// and returns the first successful response.
+// Forwarder dispatches DNS queries to a set of upstream resolvers according
+// to the configured strategy, tracking per-upstream health so that dead
+// resolvers are taken out of rotation until a background probe succeeds.
 type Forwarder struct {
-	resolvers []string // host IPs (port 53 appended at call time)
+	upstreams []*upstream
+	zones     []string // zones of the forward rule; nil for the default resolvers
+	strategy  string
+	raceSize  int
 	timeout   time.Duration
+	cursor    atomic.Uint64 // round-robin position
+	edns      ednsFilter
 	log       *slog.Logger
 	metrics   *Metrics
 }
 
-func newForwarder(resolvers []string, timeout time.Duration, log *slog.Logger, m *Metrics) *Forwarder {
-	return &Forwarder{
-		resolvers: resolvers,
-		timeout:   timeout,
-		log:       log,
-		metrics:   m,
+// newForwarder builds a standalone Forwarder for resolvers.
+func newForwarder(resolvers []string, cfg *config.Config, log *slog.Logger, m *Metrics) (*Forwarder, error) {
+	opts, err := newTransportOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newForwarderFromSet(newUpstreamSet(opts), resolvers, cfg, log, m)
+}
+
+// newForwarderFromSet builds a Forwarder whose upstreams come from set.
+func newForwarderFromSet(set *upstreamSet, resolvers []string, cfg *config.Config, log *slog.Logger, m *Metrics) (*Forwarder, error) {
+	f := &Forwarder{
+		strategy: cfg.ForwardStrategy,
+		raceSize: cfg.ForwardRace,
+		timeout:  cfg.ForwardTimeout,
+		edns:     newForwardEDNSFilter(cfg),
+		log:      log,
+		metrics:  m,
+	}
+	for _, spec := range resolvers {
+		u, err := set.get(spec)
+		if err != nil {
+			return nil, err
+		}
+		f.upstreams = append(f.upstreams, u)
 	}
+	return f, nil
 }
 
 // forwardResult carries the outcome of a single resolver attempt.
 type forwardResult struct {
 	resp *dns.Msg
 	err  error
+	addr string
 }
 
-// Forward fans out req to all configured resolvers in parallel and returns the
-// first non-error response with a successful Rcode. If all resolvers fail it
-// returns an aggregated error.
+// Forward sends req to the upstream resolvers selected by the strategy and
+// returns the first successful response. Canonical negative answers such as
+// NXDOMAIN are passed through; if every resolver fails it returns an
+// aggregated error.
 func (f *Forwarder) Forward(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	if len(f.resolvers) == 0 {
+	if len(f.upstreams) == 0 {
 		return nil, fmt.Errorf("no resolvers configured")
 	}
 
-	// Build the upstream query from the original request.
-	m := new(dns.Msg)
-	if len(req.Question) > 0 {
-		q := req.Question[0]
-		m.SetQuestion(q.Name, q.Qtype)
-	} else {
-		m = req.Copy()
+	m := f.upstreamQuery(req)
+
+	candidates := f.candidates()
+	switch f.strategy {
+	case config.StrategySequential, config.StrategyRoundRobin:
+		return f.sequence(ctx, m, candidates)
+	default:
+		return f.race(ctx, m, candidates)
 	}
-	m.RecursionDesired = true
+}
 
-	// Copy EDNS0 from original so upstream honours the correct buffer size.
+// upstreamQuery builds the query sent upstream from the client's request. It
+// keeps the message ID and the RD, AD and CD bits, so that
+// DNSSEC-aware stubs get the semantics they asked for, and an OPT record with
+// the client's payload size, DO bit and allowed options.
+func (f *Forwarder) upstreamQuery(req *dns.Msg) *dns.Msg {
+	m := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:                req.Id,
+			Opcode:            dns.OpcodeQuery,
+			RecursionDesired:  req.RecursionDesired,
+			AuthenticatedData: req.AuthenticatedData,
+			CheckingDisabled:  req.CheckingDisabled,
+		},
+		Question: append([]dns.Question(nil), req.Question...),
+	}
 	if opt := req.IsEdns0(); opt != nil {
-		m.SetEdns0(opt.UDPSize(), opt.Do())
+		out := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		out.SetUDPSize(opt.UDPSize())
+		out.SetDo(opt.Do())
+		out.Option = f.edns.options(opt.Option)
+		m.Extra = append(m.Extra, out)
+	}
+	return m
+}
+
+// Budget is the overall deadline a caller should allow for one Forward call.
+// Sequential strategies may spend one timeout per upstream.
+func (f *Forwarder) Budget() time.Duration {
+	attempts := 1
+	if f.strategy == config.StrategySequential || f.strategy == config.StrategyRoundRobin {
+		attempts = max(len(f.upstreams), 1)
+	}
+	return time.Duration(attempts)*f.timeout + 500*time.Millisecond
+}
+
+// candidates returns the upstreams to try, in order. Unhealthy upstreams are
+// skipped unless every upstream is unhealthy, in which case all are tried
+// rather than failing outright.
+func (f *Forwarder) candidates() []*upstream {
+	ups := make([]*upstream, 0, len(f.upstreams))
+	for _, u := range f.upstreams {
+		if u.healthy() {
+			ups = append(ups, u)
+		}
+	}
+	if len(ups) == 0 {
+		ups = append(ups, f.upstreams...)
+	}
+
+	switch f.strategy {
+	case config.StrategyFastest:
+		scores := make(map[*upstream]float64, len(ups))
+		for _, u := range ups {
+			scores[u] = u.score()
+		}
+		sort.SliceStable(ups, func(i, j int) bool { return scores[ups[i]] < scores[ups[j]] })
+		if len(ups) > f.raceSize {
+			ups = ups[:f.raceSize]
+		}
+	case config.StrategyRoundRobin:
+		start := int((f.cursor.Add(1) - 1) % uint64(len(ups)))
+		ups = append(ups[start:], ups[:start]...)
 	}
+	return ups
+}
 
-	resultCh := make(chan forwardResult, len(f.resolvers))
+// race fans out m to all ups in parallel and returns the first response with
+// a successful Rcode, keeping the best non-success response as a fallback.
+func (f *Forwarder) race(ctx context.Context, m *dns.Msg, ups []*upstream) (*dns.Msg, error) {
+	resultCh := make(chan forwardResult, len(ups))
 	var wg sync.WaitGroup
 
-	for _, resolver := range f.resolvers {
+	for _, u := range ups {
 		wg.Add(1)
-		go func(addr string) {
+		go func(u *upstream) {
 			defer wg.Done()
-			// Append default DNS port only when the resolver has no explicit port.
-			if _, _, err := net.SplitHostPort(addr); err != nil {
-				addr = net.JoinHostPort(addr, "53")
-			}
-			resp, err := f.queryResolver(ctx, m, addr)
-			resultCh <- forwardResult{resp: resp, err: err}
-		}(resolver)
+			resp, err := f.queryUpstream(ctx, m, u)
+			resultCh <- forwardResult{resp: resp, err: err, addr: u.addr}
+		}(u)
 	}
 
 	// Close resultCh once all goroutines have sent their results.
@@ -85,15 +177,17 @@ func (f *Forwarder) Forward(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 	var (
 		lastErr      error
 		bestResponse *dns.Msg
+		bestAddr     string
 	)
 	for res := range resultCh {
 		if res.err == nil && res.resp != nil {
 			if res.resp.Rcode == dns.RcodeSuccess {
+				traceFrom(ctx).answered(res.addr)
 				return res.resp, nil
 			}
 			// Prefer NXDOMAIN over SERVFAIL when choosing a fallback to surface.
 			if bestResponse == nil || res.resp.Rcode == dns.RcodeNameError {
-				bestResponse = res.resp
+				bestResponse, bestAddr = res.resp, res.addr
 			}
 			lastErr = fmt.Errorf("upstream rcode %s", dns.RcodeToString[res.resp.Rcode])
 		} else if res.err != nil {
@@ -104,31 +198,101 @@ func (f *Forwarder) Forward(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 	// Pass through canonical upstream answers (e.g. NXDOMAIN) rather than
 	// synthesising a SERVFAIL when the name genuinely doesn't exist.
 	if bestResponse != nil {
+		traceFrom(ctx).answered(bestAddr)
 		return bestResponse, nil
 	}
 	if lastErr != nil {
-		return nil, fmt.Errorf("all %d resolvers failed: %w", len(f.resolvers), lastErr)
+		return nil, fmt.Errorf("all %d resolvers failed: %w", len(ups), lastErr)
 	}
 	return nil, fmt.Errorf("no response from any resolver")
 }
 
-// queryResolver performs a single DNS exchange with addr, respecting ctx deadline.
-func (f *Forwarder) queryResolver(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
-	c := &dns.Client{
-		Timeout: f.timeout,
+// sequence tries ups one at a time and stops at the first NOERROR or
+// NXDOMAIN answer. SERVFAIL/REFUSED answers move on to the next upstream but
+// are surfaced if nothing better turns up.
+func (f *Forwarder) sequence(ctx context.Context, m *dns.Msg, ups []*upstream) (*dns.Msg, error) {
+	var (
+		lastErr      error
+		fallback     *dns.Msg
+		fallbackAddr string
+	)
+	for _, u := range ups {
+		if ctx.Err() != nil {
+			lastErr = ctx.Err()
+			break
+		}
+		resp, err := f.queryUpstream(ctx, m, u)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError {
+			traceFrom(ctx).answered(u.addr)
+			return resp, nil
+		}
+		if fallback == nil {
+			fallback, fallbackAddr = resp, u.addr
+		}
+		lastErr = fmt.Errorf("upstream rcode %s", dns.RcodeToString[resp.Rcode])
 	}
 
-	f.log.Debug("querying resolver", "addr", addr, "domain", m.Question[0].Name)
-	resp, _, err := c.ExchangeContext(ctx, m, addr)
+	if fallback != nil {
+		traceFrom(ctx).answered(fallbackAddr)
+		return fallback, nil
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("all %d resolvers failed: %w", len(ups), lastErr)
+	}
+	return nil, fmt.Errorf("no response from any resolver")
+}
+
+// queryUpstream performs a single DNS exchange with u, respecting the ctx
+// deadline, and folds the outcome into u's health statistics.
+func (f *Forwarder) queryUpstream(ctx context.Context, m *dns.Msg, u *upstream) (*dns.Msg, error) {
+	f.log.Debug("querying resolver", "addr", u.addr, "domain", m.Question[0].Name)
+	start := time.Now()
+	resp, err := u.transport.Exchange(ctx, m)
+	rtt := time.Since(start)
+	f.metrics.UpstreamDuration.With(u.addr).Observe(rtt.Seconds())
 	if err != nil {
-		f.log.Debug("resolver error", "addr", addr, "error", err)
-		return nil, fmt.Errorf("resolver %s: %w", addr, err)
+		traceFrom(ctx).attempt(u.addr, err.Error(), rtt)
+		f.log.Debug("resolver error", "addr", u.addr, "error", err)
+		f.metrics.UpstreamResponses.Inc(u.addr, "error")
+		// A caller giving up is not the upstream's fault.
+		if !errors.Is(ctx.Err(), context.Canceled) && u.recordFailure(time.Now()) {
+			f.log.Warn("upstream marked unhealthy", "addr", u.addr, "error", err)
+		}
+		return nil, fmt.Errorf("resolver %s: %w", u.addr, err)
+	}
+	f.metrics.UpstreamResponses.Inc(u.addr, dns.RcodeToString[resp.Rcode])
+	traceFrom(ctx).attempt(u.addr, dns.RcodeToString[resp.Rcode], rtt)
+	if u.recordSuccess(rtt) {
+		f.log.Info("upstream recovered", "addr", u.addr)
 	}
 
 	f.log.Debug("resolver responded",
-		"addr", addr,
+		"addr", u.addr,
 		"rcode", dns.RcodeToString[resp.Rcode],
 		"answers", len(resp.Answer),
 	)
 	return resp, nil
 }
+
+// probeDue starts a probe for every unhealthy upstream whose backoff has
+// elapsed. Any response, whatever its Rcode, proves the upstream reachable.
+func (f *Forwarder) probeDue(ctx context.Context) {
+	now := time.Now()
+	for _, u := range f.upstreams {
+		if !u.claimProbe(now) {
+			continue
+		}
+		go func(u *upstream) {
+			defer u.finishProbe()
+			probe := new(dns.Msg)
+			probe.SetQuestion(".", dns.TypeNS)
+			pctx, cancel := context.WithTimeout(ctx, f.timeout)
+			defer cancel()
+			_, _ = f.queryUpstream(pctx, probe, u)
+		}(u)
+	}
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/medunes/docker-dns/internal/config"
 	"github.com/miekg/dns"
 )
 
@@ -80,3 +83,174 @@ func noopDocker() *mockDockerClient {
 		},
 	}
 }
+
+// newTestForwarder builds a Forwarder over resolvers with the given strategy.
+func newTestForwarder(t *testing.T, resolvers []string, strategy string) *Forwarder {
+	t.Helper()
+	cfg := defaultTestConfig()
+	cfg.ForwardStrategy = strategy
+	cfg.ForwardTimeout = 500 * time.Millisecond
+	f, err := newForwarder(resolvers, cfg, discardLogger(), newMetrics())
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	return f
+}
+
+func forwardA(t *testing.T, f *Forwarder, name string) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), f.Budget())
+	defer cancel()
+	resp, err := f.Forward(ctx, req)
+	if err != nil {
+		t.Fatalf("Forward(%s): %v", name, err)
+	}
+	return resp
+}
+
+func TestForwarder_SequentialQueriesOneAtATime(t *testing.T) {
+	first, firstCount := startCountingUpstream(t, "1.1.1.1", dns.RcodeSuccess)
+	second, secondCount := startCountingUpstream(t, "2.2.2.2", dns.RcodeSuccess)
+	f := newTestForwarder(t, []string{first, second}, config.StrategySequential)
+
+	for i := 0; i < 3; i++ {
+		forwardA(t, f, "example.com.")
+	}
+	if firstCount.Load() != 3 || secondCount.Load() != 0 {
+		t.Errorf("expected 3/0 queries, got %d/%d", firstCount.Load(), secondCount.Load())
+	}
+}
+
+func TestForwarder_SequentialFailover(t *testing.T) {
+	good, goodCount := startCountingUpstream(t, "2.2.2.2", dns.RcodeSuccess)
+	f := newTestForwarder(t, []string{deadUpstream(t), good}, config.StrategySequential)
+
+	resp := forwardA(t, f, "example.com.")
+	if resp.Rcode != dns.RcodeSuccess || goodCount.Load() != 1 {
+		t.Fatalf("expected failover to second resolver, rcode=%s count=%d",
+			dns.RcodeToString[resp.Rcode], goodCount.Load())
+	}
+}
+
+func TestForwarder_RoundRobin(t *testing.T) {
+	a, aCount := startCountingUpstream(t, "1.1.1.1", dns.RcodeSuccess)
+	b, bCount := startCountingUpstream(t, "2.2.2.2", dns.RcodeSuccess)
+	f := newTestForwarder(t, []string{a, b}, config.StrategyRoundRobin)
+
+	for i := 0; i < 4; i++ {
+		forwardA(t, f, "example.com.")
+	}
+	if aCount.Load() != 2 || bCount.Load() != 2 {
+		t.Errorf("expected 2/2 queries, got %d/%d", aCount.Load(), bCount.Load())
+	}
+}
+
+func TestForwarder_FastestRacesBestN(t *testing.T) {
+	var counts []*atomic.Int64
+	var resolvers []string
+	for i := 0; i < 3; i++ {
+		addr, c := startCountingUpstream(t, "1.1.1.1", dns.RcodeSuccess)
+		resolvers = append(resolvers, addr)
+		counts = append(counts, c)
+	}
+	f := newTestForwarder(t, resolvers, config.StrategyFastest)
+	f.raceSize = 1
+
+	for i := 0; i < 5; i++ {
+		forwardA(t, f, "example.com.")
+	}
+	var total int64
+	for _, c := range counts {
+		total += c.Load()
+	}
+	if total != 5 {
+		t.Errorf("fastest with race size 1 should send one query per lookup, got %d for 5 lookups", total)
+	}
+}
+
+func TestForwarder_UnhealthyUpstreamSkipped(t *testing.T) {
+	dead := deadUpstream(t)
+	good, _ := startCountingUpstream(t, "2.2.2.2", dns.RcodeSuccess)
+	f := newTestForwarder(t, []string{dead, good}, config.StrategySequential)
+
+	for i := 0; i < upstreamFailThreshold; i++ {
+		forwardA(t, f, "example.com.")
+	}
+	if st := f.upstreams[0].status(); st.Healthy || st.ConsecutiveFailures != upstreamFailThreshold {
+		t.Fatalf("dead upstream should be unhealthy after %d failures: %+v", upstreamFailThreshold, st)
+	}
+
+	// The dead upstream is no longer a candidate.
+	if c := f.candidates(); len(c) != 1 || c[0].addr != good {
+		t.Errorf("expected only the healthy upstream as candidate, got %d", len(c))
+	}
+}
+
+func TestForwarder_ProbeRestoresUpstream(t *testing.T) {
+	var reachable atomic.Bool
+	f := newTestForwarder(t, nil, config.StrategyParallel)
+	u := newUpstream("probe-test", transportFunc(func(_ context.Context, m *dns.Msg) (*dns.Msg, error) {
+		if !reachable.Load() {
+			return nil, fmt.Errorf("unreachable")
+		}
+		resp := new(dns.Msg)
+		resp.SetRcode(m, dns.RcodeRefused)
+		return resp, nil
+	}))
+	f.upstreams = []*upstream{u}
+
+	now := time.Now()
+	for i := 0; i < upstreamFailThreshold; i++ {
+		u.recordFailure(now)
+	}
+	if u.healthy() {
+		t.Fatal("expected upstream to be unhealthy")
+	}
+	if u.claimProbe(now) {
+		t.Fatal("probe must wait for the backoff to elapse")
+	}
+
+	reachable.Store(true)
+	u.mu.Lock()
+	u.nextProbe = now
+	u.mu.Unlock()
+	f.probeDue(context.Background())
+
+	deadline := time.Now().Add(time.Second)
+	for !u.healthy() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !u.healthy() {
+		t.Error("a successful probe should restore the upstream, even with REFUSED")
+	}
+}
+
+func TestUpstream_BackoffGrows(t *testing.T) {
+	u := newUpstream("x", nil)
+	now := time.Now()
+	for i := 0; i < upstreamFailThreshold; i++ {
+		u.recordFailure(now)
+	}
+	first := u.nextProbe.Sub(now)
+	u.recordFailure(now) // failed probe
+	second := u.nextProbe.Sub(now)
+	if first != upstreamMinBackoff || second != 2*upstreamMinBackoff {
+		t.Errorf("expected backoff %v then %v, got %v then %v", upstreamMinBackoff, 2*upstreamMinBackoff, first, second)
+	}
+
+	for i := 0; i < 20; i++ {
+		u.recordFailure(now)
+	}
+	if u.backoff != upstreamMaxBackoff {
+		t.Errorf("backoff should be capped at %v, got %v", upstreamMaxBackoff, u.backoff)
+	}
+}
+
+// transportFunc adapts a function to the transport interface.
+type transportFunc func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+
+func (fn transportFunc) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	return fn(ctx, m)
+}
@@ -18,18 +18,19 @@ func (s *Server) HandleQuery(w dns.ResponseWriter, req *dns.Msg) {
 
 func (s *Server) handleQuery(w dns.ResponseWriter, req *dns.Msg) {
 	s.metrics.QueriesTotal.Add(1)
+	defer s.metrics.QueryDuration.ObserveSince(time.Now())
+	w = withTrace(w, req)
 
 	// --- Rate limiting ---
-	if s.rateLim != nil {
-		clientIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-		if !s.rateLim.Allow(clientIP) {
-			s.metrics.RateLimited.Add(1)
-			s.log.Debug("rate limited", "client", clientIP)
-			refuseMsg := new(dns.Msg)
-			refuseMsg.SetRcode(req, dns.RcodeRefused)
-			_ = w.WriteMsg(refuseMsg)
-			return
-		}
+	clientIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if !s.rateLim.Allow(clientIP) {
+		s.metrics.RateLimited.Add(1)
+		s.log.Debug("rate limited", "client", clientIP)
+		refuseMsg := new(dns.Msg)
+		refuseMsg.SetRcode(req, dns.RcodeRefused)
+		s.observeResponse(refuseMsg, sourceLocal)
+		_ = w.WriteMsg(refuseMsg)
+		return
 	}
 
 	// --- Build base response ---
@@ -43,11 +44,20 @@ func (s *Server) handleQuery(w dns.ResponseWriter, req *dns.Msg) {
 		resp.SetEdns0(edns0UDPSize, opt.Do())
 	}
 
+	// Only standard queries are answered; NOTIFY, UPDATE and the like are
+	// meant for the zone's own servers and are never forwarded upstream.
+	if req.Opcode != dns.OpcodeQuery {
+		s.log.Debug("unsupported opcode", "opcode", dns.OpcodeToString[req.Opcode])
+		resp.SetRcode(req, dns.RcodeNotImplemented)
+		s.writeResponse(w, resp, edns0UDPSize, sourceLocal)
+		return
+	}
+
 	// RFC 1035 §4.1.2: a request with no questions is a format error.
 	if len(req.Question) == 0 {
 		s.log.Debug("received query with no questions")
 		resp.SetRcode(req, dns.RcodeFormatError)
-		s.writeResponse(w, resp, edns0UDPSize)
+		s.writeResponse(w, resp, edns0UDPSize, sourceLocal)
 		return
 	}
 
@@ -57,13 +67,58 @@ func (s *Server) handleQuery(w dns.ResponseWriter, req *dns.Msg) {
 
 	s.log.Debug("query received", "domain", domain, "type", dns.TypeToString[q.Qtype])
 
-	if suffix := s.cfg.MatchLocalSuffix(domain); suffix != "" {
+	if suffix := s.localSuffix(domain); suffix != "" {
 		s.handleLocal(w, req, resp, q, domain, suffix, edns0UDPSize)
+	} else if z := s.signedApex(domain); z != nil {
+		s.handleApex(w, req, resp, q, z, edns0UDPSize)
+	} else if list, rule := s.blocked(domain); rule != nil {
+		s.handleBlocked(w, req, resp, q, list, rule, edns0UDPSize)
 	} else {
 		s.handleForward(w, req, resp, q, edns0UDPSize)
 	}
 }
 
+// blocked returns the blocklist and rule that block domain, if any.
+func (s *Server) blocked(domain string) (*blocklist, *blockRule) {
+	if s.blocker == nil {
+		return nil, nil
+	}
+	return s.blocker.match(domain)
+}
+
+// signedApex returns the signer of the zone whose apex is domain, or nil.
+// Only signed zones answer at their apex, where the SOA and DNSKEY live.
+func (s *Server) signedApex(domain string) *zoneSigner {
+	if s.signer == nil {
+		return nil
+	}
+	if z := s.signer.zone(domain); z != nil && z.zone == domain {
+		return z
+	}
+	return nil
+}
+
+// handleApex answers SOA and DNSKEY queries at the apex of a signed zone.
+func (s *Server) handleApex(
+	w dns.ResponseWriter,
+	req *dns.Msg,
+	resp *dns.Msg,
+	q dns.Question,
+	z *zoneSigner,
+	udpSize uint16,
+) {
+	resp.Authoritative = true
+	traceOf(w).detail("apex of signed zone %s", z.zone)
+	switch q.Qtype {
+	case dns.TypeSOA:
+		resp.Answer = append(resp.Answer, z.soa())
+	case dns.TypeDNSKEY:
+		resp.Answer = append(resp.Answer, z.key)
+	}
+	s.finishSigned(req, resp, z, q.Name, []uint16{dns.TypeSOA, dns.TypeDNSKEY}, true)
+	s.writeResponse(w, resp, udpSize, sourceLocal)
+}
+
 // handleLocal resolves queries for our managed TLDs from cache or Docker.
 func (s *Server) handleLocal(
 	w dns.ResponseWriter,
@@ -74,16 +129,26 @@ func (s *Server) handleLocal(
 	suffix string,
 	udpSize uint16,
 ) {
-	// We only handle A and AAAA for container resolution.
-	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+	var zone *zoneSigner
+	if s.signer != nil {
+		zone = s.signer.zone(domain)
+	}
+	trace := traceOf(w)
+	trace.detail("container %s", extractContainerName(domain, suffix))
+
+	// We only handle A and AAAA for container resolution. Signed zones answer
+	// other types with a provable NODATA instead.
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA && zone == nil {
+		trace.detail("%s is not served for containers", dns.TypeToString[q.Qtype])
 		resp.SetRcode(req, dns.RcodeNotImplemented)
-		s.writeResponse(w, resp, udpSize)
+		s.writeResponse(w, resp, udpSize, sourceLocal)
 		return
 	}
 
 	// Authoritative only for our own TLD.
 	resp.Authoritative = true
 
+	source := sourceCache
 	ips, ok := s.cache.Get(domain)
 	if ok {
 		s.metrics.CacheHits.Add(1)
@@ -91,14 +156,16 @@ func (s *Server) handleLocal(
 	} else {
 		s.metrics.CacheMisses.Add(1)
 		s.log.Debug("cache miss", "domain", domain)
+		source = sourceDocker
 
 		var err error
 		ips, err = s.fetchFromDocker(domain, suffix)
 		if err != nil {
 			s.log.Error("docker lookup failed", "domain", domain, "error", err)
+			trace.detail("container %s: %v", extractContainerName(domain, suffix), err)
 			s.metrics.DockerErrors.Add(1)
 			resp.SetRcode(req, dns.RcodeServerFailure)
-			s.writeResponse(w, resp, udpSize)
+			s.writeResponse(w, resp, udpSize, sourceDocker)
 			return
 		}
 
@@ -111,33 +178,80 @@ func (s *Server) handleLocal(
 		// Authoritative NXDOMAIN: we own this TLD and the name is unknown.
 		s.log.Debug("NXDOMAIN", "domain", domain)
 		resp.SetRcode(req, dns.RcodeNameError)
-		s.writeResponse(w, resp, udpSize)
+		if zone != nil {
+			s.finishSigned(req, resp, zone, q.Name, nil, false)
+		}
+		s.writeResponse(w, resp, udpSize, source)
 		return
 	}
 
 	// Populate A records. AAAA queries receive an empty authoritative NOERROR
 	// because the docker client currently only extracts IPv4 addresses.
+	var records []dns.RR
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		if ip == nil || ip.To4() == nil {
+			s.log.Debug("skipping non-IPv4 address", "ip", ipStr, "domain", domain)
+			continue
+		}
+		records = append(records, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(s.cfg.TTL.Seconds()),
+			},
+			A: ip.To4(),
+		})
+	}
 	if q.Qtype == dns.TypeA {
-		for _, ipStr := range ips {
-			ip := net.ParseIP(ipStr)
-			if ip == nil || ip.To4() == nil {
-				s.log.Debug("skipping non-IPv4 address", "ip", ipStr, "domain", domain)
-				continue
-			}
-			resp.Answer = append(resp.Answer, &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   q.Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    uint32(s.cfg.TTL.Seconds()),
-				},
-				A: ip.To4(),
-			})
+		resp.Answer = append(resp.Answer, records...)
+	}
+
+	if zone != nil {
+		var types []uint16
+		if len(records) > 0 {
+			types = []uint16{dns.TypeA}
 		}
+		s.finishSigned(req, resp, zone, q.Name, types, true)
 	}
 
 	s.log.Debug("local query answered", "domain", domain, "answers", len(resp.Answer))
-	s.writeResponse(w, resp, udpSize)
+	s.writeResponse(w, resp, udpSize, source)
+}
+
+// finishSigned completes an answer from a signed zone. Negative answers carry
+// the zone's SOA; clients that set DO also get signatures and a black lie
+// proving the name holds only types. For a name that does not exist the
+// NXDOMAIN becomes a NOERROR whose black lie carries NXNAME (RFC 9824).
+func (s *Server) finishSigned(req, resp *dns.Msg, z *zoneSigner, name string, types []uint16, exists bool) {
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = append(resp.Ns, z.soa())
+		if do {
+			resp.Rcode = dns.RcodeSuccess
+			resp.Ns = append(resp.Ns, z.blackLie(name, types, exists))
+		}
+	}
+	if !do {
+		return
+	}
+
+	answer, err := z.sign(resp.Answer)
+	if err == nil {
+		resp.Ns, err = z.sign(resp.Ns)
+	}
+	if err != nil {
+		s.log.Error("signing failed", "domain", name, "error", err)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		resp.Answer, resp.Ns = nil, nil
+		return
+	}
+	resp.Answer = answer
 }
 
 // handleForward proxies non-local queries to upstream resolvers.
@@ -150,30 +264,141 @@ func (s *Server) handleForward(
 ) {
 	resp.Authoritative = false
 
+	// Apply the ECS policy first: the subnet sent upstream also selects the
+	// cached answers this client may reuse.
+	var clientIP net.IP
+	if host, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		clientIP = net.ParseIP(host)
+	}
+	query := s.ecs.query(req, clientIP)
+	subnet := clientSubnet(query)
+	if !s.edns[dns.EDNS0SUBNET] {
+		subnet = nil // the forwarder drops it
+	}
+
+	if s.answers != nil {
+		if hit, ok := s.answers.get(query, subnet); ok {
+			s.log.Debug("forward cache hit", "domain", q.Name, "type", dns.TypeToString[q.Qtype])
+			traceOf(w).detail("forwarded answer cache")
+			resp.Rcode = hit.msg.Rcode
+			resp.AuthenticatedData = hit.msg.AuthenticatedData
+			resp.RecursionAvailable = hit.msg.RecursionAvailable
+			resp.Answer, resp.Ns = hit.msg.Answer, hit.msg.Ns
+			resp.Extra = append(hit.msg.Extra, resp.Extra...)
+			respondECS(req, resp, hit.scope)
+			s.writeResponse(w, resp, udpSize, sourceCache)
+			return
+		}
+	}
+
 	s.metrics.ForwardQueries.Add(1)
 	s.log.Debug("forwarding query", "domain", q.Name, "type", dns.TypeToString[q.Qtype])
 
-	// Allow the forwarder enough time to try all resolvers in parallel.
-	totalTimeout := s.cfg.ForwardTimeout + 500*time.Millisecond
-	ctx, cancel := context.WithTimeout(context.Background(), totalTimeout)
+	// Allow the forwarder enough time to try every resolver its strategy needs.
+	fwd := s.router.route(q.Name)
+	trace := traceOf(w)
+	trace.rule(fwd.zones)
+	ctx, cancel := context.WithTimeout(contextWithTrace(context.Background(), trace), fwd.Budget())
 	defer cancel()
 
-	upstream, err := s.forwarder.Forward(ctx, req)
+	// A client setting CD does its own validation and gets the raw answer.
+	validate := s.dnssec != nil && !req.CheckingDisabled
+	sent := query
+	if validate {
+		sent = s.dnssec.prepare(query)
+	}
+
+	upstream, err := fwd.Forward(ctx, sent)
 	if err != nil {
 		s.log.Warn("all forwarders failed", "domain", q.Name, "error", err)
+		trace.detail("%v", err)
 		s.metrics.ForwardErrors.Add(1)
 		resp.SetRcode(req, dns.RcodeServerFailure)
-		s.writeResponse(w, resp, udpSize)
+		s.writeResponse(w, resp, udpSize, sourceUpstream)
 		return
 	}
 
+	scope := responseScope(subnet, upstream)
+	if validate {
+		s.validateForward(req, resp, q, upstream, trace)
+	} else {
+		s.mapUpstreamResponse(resp, upstream)
+	}
+	respondECS(req, resp, scope)
+	if s.answers != nil {
+		s.answers.set(query, subnet, scope, resp)
+	}
+	s.writeResponse(w, resp, udpSize, sourceUpstream)
+}
+
+// validateForward maps a DNSSEC-validated upstream answer into resp. Secure
+// answers get AD when the client asked for it (via AD or DO), bogus ones
+// become SERVFAIL with an extended DNS error, and signatures the client did
+// not ask for are removed. The outcome is recorded in trace.
+func (s *Server) validateForward(req, resp *dns.Msg, q dns.Question, upstream *dns.Msg, trace *queryTrace) {
+	if upstream.Rcode != dns.RcodeSuccess && upstream.Rcode != dns.RcodeNameError {
+		// Failures carry no data to validate.
+		s.mapUpstreamResponse(resp, upstream)
+		resp.AuthenticatedData = false
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), validationTimeout)
+	defer cancel()
+	sec, why := s.dnssec.validate(ctx, q.Name, q.Qtype, upstream)
+	s.metrics.DNSSECResults.Inc(sec.String())
+	if why != "" {
+		trace.detail("DNSSEC %s: %s", sec, why)
+	} else {
+		trace.detail("DNSSEC %s", sec)
+	}
+
+	if sec == secBogus {
+		s.log.Warn("DNSSEC validation failed", "domain", q.Name, "type", dns.TypeToString[q.Qtype], "reason", why)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		if opt := resp.IsEdns0(); opt != nil {
+			opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus, ExtraText: why})
+		}
+		return
+	}
+
+	s.mapUpstreamResponse(resp, upstream)
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	resp.AuthenticatedData = sec == secSecure && (req.AuthenticatedData || do)
+	if !do {
+		stripDNSSEC(resp, q.Qtype)
+	}
+}
+
+// mapUpstreamResponse copies an upstream answer into resp, the reply built
+// from the client's request. resp keeps its own OPT record (the client's
+// payload size and DO bit) with the upstream's allowed options merged in, so
+// the reply never carries two OPT records.
+func (s *Server) mapUpstreamResponse(resp, upstream *dns.Msg) {
+	opt := resp.IsEdns0()
+
 	resp.Answer = upstream.Answer
 	resp.Ns = upstream.Ns
-	resp.Extra = upstream.Extra
+	resp.Extra = withoutOPT(upstream.Extra)
 	resp.Rcode = upstream.Rcode
 	resp.RecursionAvailable = upstream.RecursionAvailable
+	resp.AuthenticatedData = upstream.AuthenticatedData
 
-	s.writeResponse(w, resp, udpSize)
+	if opt == nil {
+		// Extended rcodes (e.g. BADCOOKIE) need an OPT record to travel in.
+		if resp.Rcode > 0xF {
+			resp.Rcode = dns.RcodeServerFailure
+		}
+		return
+	}
+	opt.Option = nil
+	if uopt := upstream.IsEdns0(); uopt != nil {
+		opt.Option = s.edns.options(uopt.Option)
+	}
+	resp.Extra = append(resp.Extra, opt)
 }
 
 // fetchFromDocker uses singleflight to coalesce concurrent cache misses for
@@ -188,6 +413,7 @@ func (s *Server) fetchFromDocker(domain, suffix string) ([]string, error) {
 		ctx, cancel := context.WithTimeout(context.Background(), s.cfg.DockerTimeout)
 		defer cancel()
 
+		defer s.metrics.DockerLookupDuration.ObserveSince(time.Now())
 		return s.docker.ContainerIPs(ctx, containerName)
 	})
 	if err != nil {
@@ -213,8 +439,12 @@ func extractContainerName(fqdn, suffix string) string {
 
 // writeResponse writes a DNS response, enforcing EDNS0 UDP payload limits and
 // setting the TC (truncation) bit when the message exceeds the UDP budget.
-// TCP connections are written without size constraints.
-func (s *Server) writeResponse(w dns.ResponseWriter, msg *dns.Msg, maxUDPSize uint16) {
+// TCP connections are written without size constraints. source records which
+// path produced the answer for the response metrics.
+func (s *Server) writeResponse(w dns.ResponseWriter, msg *dns.Msg, maxUDPSize uint16, source string) {
+	s.observeResponse(msg, source)
+	traceOf(w).attach(msg, source)
+
 	if _, isTCP := w.RemoteAddr().(*net.TCPAddr); isTCP {
 		if err := w.WriteMsg(msg); err != nil {
 			s.log.Error("tcp write failed", "error", err)
@@ -230,10 +460,15 @@ func (s *Server) writeResponse(w dns.ResponseWriter, msg *dns.Msg, maxUDPSize ui
 
 	if uint16(len(packed)) > maxUDPSize {
 		// Strip payload sections and set TC so the client retries over TCP.
+		// The OPT record stays: it carries the extended rcode and DO bit.
+		opt := msg.IsEdns0()
 		msg.Truncated = true
 		msg.Answer = nil
 		msg.Ns = nil
 		msg.Extra = nil
+		if opt != nil {
+			msg.Extra = []dns.RR{opt}
+		}
 		s.log.Debug("response truncated", "size", len(packed), "limit", maxUDPSize)
 	}
 
@@ -241,3 +476,12 @@ func (s *Server) writeResponse(w dns.ResponseWriter, msg *dns.Msg, maxUDPSize ui
 		s.log.Error("udp write failed", "error", err)
 	}
 }
+
+// observeResponse records msg in the per-qtype/rcode/source response counter.
+func (s *Server) observeResponse(msg *dns.Msg, source string) {
+	qtype := "NONE"
+	if len(msg.Question) > 0 {
+		qtype = dns.Type(msg.Question[0].Qtype).String()
+	}
+	s.metrics.Responses.Inc(qtype, dns.RcodeToString[msg.Rcode], source)
+}
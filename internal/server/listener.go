@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// gatewayRefresh is how often the addresses of bridge: and network: listen
+// endpoints are re-resolved.
+const gatewayRefresh = 10 * time.Second
+
+// dynamicListener serves DNS on the addresses a bridge: or network: listen
+// endpoint currently resolves to, and rebinds when they change, e.g. after
+// the Docker network was recreated with another subnet.
+type dynamicListener struct {
+	s       *Server
+	addr    string // the --listen value, used as the metrics label
+	spec    config.ListenSpec
+	handler dns.Handler
+	bound   map[string][]*dns.Server // host:port -> UDP and TCP servers
+}
+
+func (s *Server) newDynamicListener(addr string, spec config.ListenSpec, next dns.Handler) *dynamicListener {
+	return &dynamicListener{
+		s:       s,
+		addr:    addr,
+		spec:    spec,
+		handler: next,
+		bound:   make(map[string][]*dns.Server),
+	}
+}
+
+// run keeps the bindings current until ctx is cancelled, then shuts them
+// down.
+func (l *dynamicListener) run(ctx context.Context) {
+	l.refresh(ctx)
+	t := time.NewTicker(gatewayRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for hostport := range l.bound {
+				l.unbind(shutCtx, hostport)
+			}
+			return
+		case <-t.C:
+			l.refresh(ctx)
+		}
+	}
+}
+
+// refresh binds new addresses and releases the ones that went away. When
+// the addresses cannot be resolved the current bindings are kept.
+func (l *dynamicListener) refresh(ctx context.Context) {
+	ips, err := l.resolve(ctx)
+	if err != nil {
+		l.s.log.Warn("resolving listen address failed", "listen", l.addr, "error", err)
+		return
+	}
+	want := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		want = append(want, net.JoinHostPort(ip.String(), l.spec.Port))
+	}
+	if len(want) == 0 && len(l.bound) == 0 {
+		l.s.log.Warn("listen address has no IP yet", "listen", l.addr)
+	}
+	for hostport := range l.bound {
+		if !slices.Contains(want, hostport) {
+			l.unbind(ctx, hostport)
+		}
+	}
+	for _, hostport := range want {
+		if _, ok := l.bound[hostport]; ok {
+			continue
+		}
+		if err := l.bind(hostport); err != nil {
+			l.s.log.Warn("binding listen address failed; retrying later", "listen", l.addr, "addr", hostport, "error", err)
+		}
+	}
+}
+
+// resolve returns the addresses of the interface or the gateways of the
+// Docker network.
+func (l *dynamicListener) resolve(ctx context.Context) ([]net.IP, error) {
+	if l.spec.Kind == config.ListenNetwork {
+		ctx, cancel := context.WithTimeout(ctx, l.s.cfg.DockerTimeout)
+		defer cancel()
+		gateways, err := l.s.docker.NetworkGateways(ctx, l.spec.Host)
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		for _, g := range gateways {
+			if ip := net.ParseIP(g); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+
+	iface, err := net.InterfaceByName(l.spec.Host)
+	if err != nil {
+		// The bridge does not exist until Docker creates it.
+		return nil, nil
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("reading addresses of %s: %w", l.spec.Host, err)
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		// Link-local IPv6 addresses need a zone to bind to; skip them.
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+func (l *dynamicListener) bind(hostport string) error {
+	pc, err := net.ListenPacket("udp", hostport)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", hostport)
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	srvs := []*dns.Server{
+		{PacketConn: pc, Net: "udp", Handler: l.s.listenerHandler(l.handler, l.addr, "udp")},
+		{Listener: ln, Net: "tcp", Handler: l.s.listenerHandler(l.handler, l.addr, "tcp")},
+	}
+	if err := l.serve(srvs); err != nil {
+		_ = pc.Close()
+		_ = ln.Close()
+		return err
+	}
+	l.bound[hostport] = srvs
+	l.s.selfIPs.add(hostport)
+	l.s.log.Info("listening", "listen", l.addr, "addr", hostport)
+	return nil
+}
+
+// serve starts srvs and waits until each one is serving, so that a quick
+// unbind can shut them down. If one fails to start, those already started are
+// shut down and its error is returned.
+func (l *dynamicListener) serve(srvs []*dns.Server) error {
+	for i, srv := range srvs {
+		started := make(chan struct{})
+		failed := make(chan error, 1)
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() {
+			err := srv.ActivateAndServe()
+			select {
+			case <-started:
+				if err != nil {
+					l.s.log.Warn("dynamic listener stopped", "listen", l.addr, "net", srv.Net, "error", err)
+				}
+			default:
+				failed <- err // reported by the caller
+			}
+		}()
+		select {
+		case <-started:
+		case err := <-failed:
+			for _, running := range srvs[:i] {
+				_ = running.Shutdown()
+			}
+			if err == nil {
+				err = errors.New("stopped before serving")
+			}
+			return fmt.Errorf("serving %s: %w", srv.Net, err)
+		}
+	}
+	return nil
+}
+
+func (l *dynamicListener) unbind(ctx context.Context, hostport string) {
+	for _, srv := range l.bound[hostport] {
+		_ = srv.ShutdownContext(ctx)
+	}
+	delete(l.bound, hostport)
+	l.s.selfIPs.remove(hostport)
+	l.s.log.Info("stopped listening", "listen", l.addr, "addr", hostport)
+}
+
+// boundIPs counts the bindings of the dynamic listeners per address, so that
+// resolver discovery can leave out the addresses docker-dns serves itself.
+type boundIPs struct {
+	mu  sync.Mutex
+	ips map[netip.Addr]int
+}
+
+func (b *boundIPs) add(hostport string) {
+	ap, err := netip.ParseAddrPort(hostport)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ips == nil {
+		b.ips = make(map[netip.Addr]int)
+	}
+	b.ips[ap.Addr()]++
+}
+
+func (b *boundIPs) remove(hostport string) {
+	ap, err := netip.ParseAddrPort(hostport)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ips[ap.Addr()]--; b.ips[ap.Addr()] <= 0 {
+		delete(b.ips, ap.Addr())
+	}
+}
+
+func (b *boundIPs) contains(addr netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ips[addr.Unmap().WithZone("")] > 0
+}
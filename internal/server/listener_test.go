@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestDynamicListener_Rebind(t *testing.T) {
+	var gateway atomic.Value
+	gateway.Store("127.0.0.1")
+	dc := &mockDockerClient{
+		ipsFunc: func(context.Context, string) ([]string, error) { return []string{"172.17.0.2"}, nil },
+		gatewaysFunc: func(_ context.Context, name string) ([]string, error) {
+			if name != "my-net" {
+				return nil, nil
+			}
+			return []string{gateway.Load().(string)}, nil
+		},
+	}
+	srv := newTestServer(t, dc, defaultTestConfig())
+	spec := config.ListenSpec{Kind: config.ListenNetwork, Host: "my-net", Port: "0"}
+	l := srv.newDynamicListener("network:my-net:0", spec, dns.HandlerFunc(srv.handleQuery))
+	ctx := context.Background()
+	t.Cleanup(func() {
+		for hostport := range l.bound {
+			l.unbind(ctx, hostport)
+		}
+	})
+
+	query := func(hostport string) {
+		t.Helper()
+		udp := l.bound[hostport][0].PacketConn.LocalAddr().String()
+		m := new(dns.Msg)
+		m.SetQuestion("web.docker.", dns.TypeA)
+		c := &dns.Client{Timeout: time.Second}
+		resp, _, err := c.Exchange(m, udp)
+		if err != nil || len(resp.Answer) != 1 {
+			t.Fatalf("query via %s: %v %v", udp, resp, err)
+		}
+	}
+
+	l.refresh(ctx)
+	if _, ok := l.bound["127.0.0.1:0"]; !ok || len(l.bound) != 1 {
+		t.Fatalf("bound = %v, want the network gateway", l.bound)
+	}
+	query("127.0.0.1:0")
+	if got := srv.metrics.ListenerQueries.Get("network:my-net:0", "udp"); got != 1 {
+		t.Errorf("listener_queries_total = %d, want 1", got)
+	}
+
+	// The network was recreated with another gateway.
+	gateway.Store("127.0.0.2")
+	l.refresh(ctx)
+	if _, ok := l.bound["127.0.0.2:0"]; !ok || len(l.bound) != 1 {
+		t.Fatalf("bound = %v, want only the new gateway", l.bound)
+	}
+	query("127.0.0.2:0")
+	if srv.selfIPs.contains(netip.MustParseAddr("127.0.0.1")) || !srv.selfIPs.contains(netip.MustParseAddr("127.0.0.2")) {
+		t.Error("resolver discovery would not skip the current gateway binding")
+	}
+
+	// A Docker error keeps the current binding.
+	dc.gatewaysFunc = func(context.Context, string) ([]string, error) { return nil, context.DeadlineExceeded }
+	l.refresh(ctx)
+	if len(l.bound) != 1 {
+		t.Errorf("bound = %v after a lookup error, want it unchanged", l.bound)
+	}
+}
+
+func TestDynamicListener_MissingBridge(t *testing.T) {
+	srv := newTestServer(t, noopDocker(), defaultTestConfig())
+	spec := config.ListenSpec{Kind: config.ListenBridge, Host: "no-such-bridge0", Port: "0"}
+	l := srv.newDynamicListener("bridge:no-such-bridge0:0", spec, dns.HandlerFunc(srv.handleQuery))
+	if ips, err := l.resolve(context.Background()); err != nil || len(ips) != 0 {
+		t.Errorf("resolve() = %v, %v; want nothing until the bridge exists", ips, err)
+	}
+}
+
+func TestDynamicListener_ServeFailure(t *testing.T) {
+	srv := newTestServer(t, noopDocker(), defaultTestConfig())
+	spec := config.ListenSpec{Kind: config.ListenBridge, Host: "docker0", Port: "0"}
+	l := srv.newDynamicListener("bridge:docker0:0", spec, dns.HandlerFunc(srv.handleQuery))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := &dns.Server{Listener: ln, Net: "tcp", Handler: dns.HandlerFunc(srv.handleQuery)}
+	broken := &dns.Server{Net: "udp"} // no socket: fails before serving
+
+	done := make(chan error, 1)
+	go func() { done <- l.serve([]*dns.Server{running, broken}) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("serve() succeeded with a server that cannot start")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve() hangs when a server fails to start")
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("servers started before the failure are still listening")
+	}
+}
@@ -1,20 +1,247 @@
 package server
 
-import "sync/atomic"
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Answer sources used as the "source" label on response metrics.
+const (
+	sourceCache    = "cache"    // served from the record cache
+	sourceDocker   = "docker"   // resolved through the Docker API
+	sourceUpstream = "upstream" // forwarded to an upstream resolver
+	sourceLocal    = "local"    // synthesised by the server (errors, refusals)
+	sourceBlocked  = "blocked"  // answered by a blocklist policy
+)
 
 // Metrics holds atomic counters for all server events.
 // All fields are safe for concurrent access.
 type Metrics struct {
-	QueriesTotal  atomic.Uint64
-	CacheHits     atomic.Uint64
-	CacheMisses   atomic.Uint64
-	DockerLookups atomic.Uint64
-	DockerErrors  atomic.Uint64
+	QueriesTotal   atomic.Uint64
+	CacheHits      atomic.Uint64
+	CacheMisses    atomic.Uint64
+	DockerLookups  atomic.Uint64
+	DockerErrors   atomic.Uint64
 	ForwardQueries atomic.Uint64
 	ForwardErrors  atomic.Uint64
-	RateLimited   atomic.Uint64
+	RateLimited    atomic.Uint64
+
+	// Responses counts responses written to clients by qtype, rcode and source.
+	Responses *CounterVec
+	// UpstreamResponses counts upstream exchanges by resolver and rcode
+	// ("error" when the exchange itself failed).
+	UpstreamResponses *CounterVec
+	// DNSSECResults counts validated forwarded answers by outcome: secure,
+	// insecure or bogus.
+	DNSSECResults *CounterVec
+	// DoHRequests counts DNS-over-HTTPS requests by HTTP method and status.
+	DoHRequests *CounterVec
+	// BlockedQueries counts queries answered by a blocklist, by list name.
+	BlockedQueries *CounterVec
+	// ListenerQueries counts queries received by each DNS listener, by
+	// address and protocol (udp, tcp or tcp-tls).
+	ListenerQueries *CounterVec
+	// ConfigReloads counts SIGHUP configuration reloads by result: success
+	// or failure.
+	ConfigReloads *CounterVec
+
+	// QueryDuration is the end-to-end latency of handleQuery.
+	QueryDuration *Histogram
+	// DockerLookupDuration is the latency of Docker API container lookups.
+	DockerLookupDuration *Histogram
+	// UpstreamDuration is the latency of each upstream exchange, by resolver.
+	UpstreamDuration *HistogramVec
 }
 
 func newMetrics() *Metrics {
-	return &Metrics{}
+	return &Metrics{
+		Responses:            newCounterVec("qtype", "rcode", "source"),
+		UpstreamResponses:    newCounterVec("resolver", "rcode"),
+		DNSSECResults:        newCounterVec("result"),
+		BlockedQueries:       newCounterVec("list"),
+		DoHRequests:          newCounterVec("method", "status"),
+		ListenerQueries:      newCounterVec("listener", "proto"),
+		ConfigReloads:        newCounterVec("result"),
+		QueryDuration:        newHistogram(latencyBuckets),
+		DockerLookupDuration: newHistogram(latencyBuckets),
+		UpstreamDuration:     newHistogramVec(latencyBuckets, "resolver"),
+	}
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	labels []string
+	mu     sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+// LabeledValue is one series of a CounterVec snapshot.
+type LabeledValue struct {
+	Labels []string
+	Value  uint64
+}
+
+func newCounterVec(labels ...string) *CounterVec {
+	return &CounterVec{labels: labels, values: make(map[string]*atomic.Uint64)}
+}
+
+// labelSep cannot appear in DNS names, type mnemonics or resolver addresses.
+const labelSep = "\xff"
+
+// Inc increments the counter identified by values, which must match the
+// label names passed at construction in number and order.
+func (v *CounterVec) Inc(values ...string) {
+	key := strings.Join(values, labelSep)
+
+	v.mu.RLock()
+	c, ok := v.values[key]
+	v.mu.RUnlock()
+	if !ok {
+		v.mu.Lock()
+		if c, ok = v.values[key]; !ok {
+			c = new(atomic.Uint64)
+			v.values[key] = c
+		}
+		v.mu.Unlock()
+	}
+	c.Add(1)
+}
+
+// Get returns the current value of the counter identified by values.
+func (v *CounterVec) Get(values ...string) uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if c, ok := v.values[strings.Join(values, labelSep)]; ok {
+		return c.Load()
+	}
+	return 0
+}
+
+// Snapshot returns every series sorted by label values.
+func (v *CounterVec) Snapshot() []LabeledValue {
+	v.mu.RLock()
+	out := make([]LabeledValue, 0, len(v.values))
+	for k, c := range v.values {
+		out = append(out, LabeledValue{Labels: strings.Split(k, labelSep), Value: c.Load()})
+	}
+	v.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return slices.Compare(out[i].Labels, out[j].Labels) < 0 })
+	return out
+}
+
+// latencyBuckets are histogram upper bounds in seconds, spanning sub-millisecond
+// cache hits to multi-second upstream timeouts.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Histogram counts observations into fixed buckets. It is lock-free and safe
+// for concurrent use.
+type Histogram struct {
+	bounds  []float64
+	buckets []atomic.Uint64 // per-bucket (non-cumulative); last is +Inf
+	count   atomic.Uint64
+	sumBits atomic.Uint64 // float64 bits of the running sum
+}
+
+// HistogramSnapshot is a consistent-enough view of a Histogram for export.
+type HistogramSnapshot struct {
+	Bounds     []float64
+	Cumulative []uint64 // cumulative counts per bound, followed by +Inf
+	Count      uint64
+	Sum        float64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, buckets: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// Observe records a single value.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// ObserveSince records the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Snapshot returns cumulative bucket counts suitable for exposition.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Bounds:     h.bounds,
+		Cumulative: make([]uint64, len(h.buckets)),
+	}
+	var total uint64
+	for i := range h.buckets {
+		total += h.buckets[i].Load()
+		snap.Cumulative[i] = total
+	}
+	snap.Count = total
+	snap.Sum = math.Float64frombits(h.sumBits.Load())
+	return snap
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	bounds []float64
+	labels []string
+	mu     sync.RWMutex
+	values map[string]*Histogram
+}
+
+// LabeledHistogram is one series of a HistogramVec snapshot.
+type LabeledHistogram struct {
+	Labels []string
+	HistogramSnapshot
+}
+
+func newHistogramVec(bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{bounds: bounds, labels: labels, values: make(map[string]*Histogram)}
+}
+
+// With returns the histogram for the given label values, creating it on
+// first use.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	key := strings.Join(values, labelSep)
+
+	v.mu.RLock()
+	h, ok := v.values[key]
+	v.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if h, ok = v.values[key]; !ok {
+		h = newHistogram(v.bounds)
+		v.values[key] = h
+	}
+	return h
+}
+
+// Snapshot returns every series sorted by label values.
+func (v *HistogramVec) Snapshot() []LabeledHistogram {
+	v.mu.RLock()
+	out := make([]LabeledHistogram, 0, len(v.values))
+	for k, h := range v.values {
+		out = append(out, LabeledHistogram{Labels: strings.Split(k, labelSep), HistogramSnapshot: h.Snapshot()})
+	}
+	v.mu.RUnlock()
+
+	sort.Slice(out, func(i, j int) bool { return slices.Compare(out[i].Labels, out[j].Labels) < 0 })
+	return out
 }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCounterVec(t *testing.T) {
+	v := newCounterVec("qtype", "rcode")
+	v.Inc("A", "NOERROR")
+	v.Inc("A", "NOERROR")
+	v.Inc("AAAA", "NXDOMAIN")
+
+	if got := v.Get("A", "NOERROR"); got != 2 {
+		t.Errorf("Get(A, NOERROR) = %d, want 2", got)
+	}
+	if got := v.Get("MX", "NOERROR"); got != 0 {
+		t.Errorf("Get(MX, NOERROR) = %d, want 0", got)
+	}
+	snap := v.Snapshot()
+	if len(snap) != 2 || snap[0].Labels[0] != "A" || snap[1].Labels[0] != "AAAA" {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.01, 0.1, 1})
+	for _, v := range []float64{0.005, 0.05, 0.05, 0.5, 3} {
+		h.Observe(v)
+	}
+	snap := h.Snapshot()
+
+	want := []uint64{1, 3, 4, 5}
+	for i, w := range want {
+		if snap.Cumulative[i] != w {
+			t.Errorf("bucket %d: cumulative = %d, want %d", i, snap.Cumulative[i], w)
+		}
+	}
+	if snap.Count != 5 {
+		t.Errorf("count = %d, want 5", snap.Count)
+	}
+	if math.Abs(snap.Sum-3.605) > 1e-9 {
+		t.Errorf("sum = %g, want 3.605", snap.Sum)
+	}
+}
+
+func TestFormatLabels_Escaping(t *testing.T) {
+	got := formatLabels([]string{"a", "b"}, []string{`x"y`, "back\\slash\nnl"})
+	want := `a="x\"y",b="back\\slash\nnl"`
+	if got != want {
+		t.Errorf("formatLabels = %s, want %s", got, want)
+	}
+}
+
+func TestMetrics_PrometheusAndJSON(t *testing.T) {
+	upstream := startFakeUpstream(t, "1.2.3.4", dns.RcodeSuccess)
+	dc := &mockDockerClient{
+		ipsFunc: func(_ context.Context, name string) ([]string, error) {
+			if name == "web" {
+				return []string{"172.17.0.2"}, nil
+			}
+			return nil, nil
+		},
+	}
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{upstream}
+	srv := newTestServer(t, dc, cfg)
+	addr := serveTestDNS(t, srv)
+
+	queryDNS(t, addr, "web.docker.", dns.TypeA)   // docker
+	queryDNS(t, addr, "web.docker.", dns.TypeA)   // cache
+	queryDNS(t, addr, "ghost.docker.", dns.TypeA) // docker NXDOMAIN
+	queryDNS(t, addr, "example.com.", dns.TypeA)  // upstream
+
+	// The query latency is observed after the response is written.
+	deadline := time.Now().Add(time.Second)
+	for srv.metrics.QueryDuration.Snapshot().Count < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.httpMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("default content type = %q, want text/plain", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE docker_dns_queries_total counter",
+		"docker_dns_queries_total 4",
+		`docker_dns_responses_total{qtype="A",rcode="NOERROR",source="docker"} 1`,
+		`docker_dns_responses_total{qtype="A",rcode="NOERROR",source="cache"} 1`,
+		`docker_dns_responses_total{qtype="A",rcode="NXDOMAIN",source="docker"} 1`,
+		`docker_dns_responses_total{qtype="A",rcode="NOERROR",source="upstream"} 1`,
+		`docker_dns_upstream_responses_total{resolver="` + upstream + `",rcode="NOERROR"} 1`,
+		"docker_dns_cache_entries 1",
+		"# TYPE docker_dns_query_duration_seconds histogram",
+		`docker_dns_query_duration_seconds_bucket{le="+Inf"} 4`,
+		"docker_dns_query_duration_seconds_count 4",
+		"docker_dns_docker_lookup_duration_seconds_count 2",
+		`docker_dns_upstream_duration_seconds_count{resolver="` + upstream + `"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q\n%s", want, body)
+		}
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/metrics?format=json", nil),
+		func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			r.Header.Set("Accept", "application/json")
+			return r
+		}(),
+	} {
+		rec := httptest.NewRecorder()
+		srv.httpMetrics(rec, req)
+		var payload map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+			t.Fatalf("%s: expected JSON, got %q", req.URL, rec.Body.String())
+		}
+		if payload["queries_total"].(float64) != 4 {
+			t.Errorf("%s: queries_total = %v, want 4", req.URL, payload["queries_total"])
+		}
+	}
+}
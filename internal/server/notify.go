@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/systemd"
+	"github.com/miekg/dns"
+)
+
+// statusInterval is how often the systemd STATUS= line is refreshed when no
+// watchdog asks for more frequent notifications.
+const statusInterval = 30 * time.Second
+
+// adoptActivated hands the sockets passed by systemd socket activation to
+// the servers configured for the same address, so they serve on them
+// instead of binding (which needs CAP_NET_BIND_SERVICE for port 53).
+// Sockets matching no configured endpoint are served as plain DNS.
+func (s *Server) adoptActivated(srvs []*dns.Server, packets []net.PacketConn, streams []net.Listener, next dns.Handler) []*dns.Server {
+	for _, srv := range srvs {
+		switch srv.Net {
+		case "udp":
+			if i := slices.IndexFunc(packets, func(pc net.PacketConn) bool { return sameAddr(pc.LocalAddr(), srv.Addr) }); i >= 0 {
+				srv.PacketConn = packets[i]
+				packets = slices.Delete(packets, i, i+1)
+			}
+		case "tcp", "tcp-tls":
+			if i := slices.IndexFunc(streams, func(ln net.Listener) bool { return sameAddr(ln.Addr(), srv.Addr) }); i >= 0 {
+				srv.Listener = streams[i]
+				if srv.TLSConfig != nil {
+					srv.Listener = tls.NewListener(streams[i], srv.TLSConfig)
+				}
+				streams = slices.Delete(streams, i, i+1)
+			}
+		}
+	}
+	for _, pc := range packets {
+		addr := pc.LocalAddr().String()
+		srvs = append(srvs, &dns.Server{Addr: addr, Net: "udp", PacketConn: pc, Handler: s.listenerHandler(next, addr, "udp")})
+	}
+	for _, ln := range streams {
+		addr := ln.Addr().String()
+		srvs = append(srvs, &dns.Server{Addr: addr, Net: "tcp", Listener: ln, Handler: s.listenerHandler(next, addr, "tcp")})
+	}
+	return srvs
+}
+
+// sameAddr reports whether a socket address is the configured ip:port.
+func sameAddr(a net.Addr, want string) bool {
+	got, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return false
+	}
+	w, err := netip.ParseAddrPort(want)
+	if err != nil {
+		return false
+	}
+	return got.Addr().Unmap() == w.Addr().Unmap() && got.Port() == w.Port()
+}
+
+// notify sends state to systemd; it is a no-op outside Type=notify units.
+func (s *Server) notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		s.log.Warn("systemd notification failed", "error", err)
+	}
+}
+
+// status is the one-line summary shown by "systemctl status".
+func (s *Server) status() string {
+	return fmt.Sprintf("STATUS=%d queries, %d forwarded, %d cache hits, %d rate-limited",
+		s.metrics.QueriesTotal.Load(), s.metrics.ForwardQueries.Load(),
+		s.metrics.CacheHits.Load(), s.metrics.RateLimited.Load())
+}
+
+// notifyLoop refreshes the systemd status and pets the watchdog (when
+// WatchdogSec= is set) until ctx is cancelled.
+func (s *Server) notifyLoop(ctx context.Context) {
+	watchdog := systemd.WatchdogInterval()
+	interval := statusInterval
+	if watchdog > 0 {
+		interval = watchdog / 2
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			state := s.status()
+			if watchdog > 0 {
+				state = "WATCHDOG=1\n" + state
+			}
+			s.notify(state)
+		}
+	}
+}
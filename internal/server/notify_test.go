@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAdoptActivated(t *testing.T) {
+	srv := newTestServer(t, noopDocker(), defaultTestConfig())
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	extra, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer extra.Close()
+
+	h := dns.HandlerFunc(srv.handleQuery)
+	udpAddr, tcpAddr := pc.LocalAddr().String(), ln.Addr().String()
+	configured := []*dns.Server{
+		{Addr: udpAddr, Net: "udp"},
+		{Addr: tcpAddr, Net: "tcp"},
+		{Addr: "127.0.0.1:1", Net: "udp"},
+	}
+	got := srv.adoptActivated(configured, []net.PacketConn{pc}, []net.Listener{ln, extra}, h)
+
+	if got[0].PacketConn != pc || got[1].Listener != ln {
+		t.Error("configured endpoints must use the activated sockets of the same address")
+	}
+	if got[2].PacketConn != nil {
+		t.Error("an endpoint without an activated socket must bind itself")
+	}
+	if len(got) != 4 || got[3].Listener != extra || got[3].Net != "tcp" {
+		t.Errorf("an unmatched activated socket must be served too, got %d servers", len(got))
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+		ok   bool
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.153"), Port: 53}, "127.0.0.153:53", true},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 53}, "[::1]:53", true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.153").To16(), Port: 53}, "127.0.0.153:53", true},
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.153"), Port: 5353}, "127.0.0.153:53", false},
+		{&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}, "127.0.0.153:53", false},
+	}
+	for _, tt := range tests {
+		if got := sameAddr(tt.addr, tt.want); got != tt.ok {
+			t.Errorf("sameAddr(%s, %s) = %v, want %v", tt.addr, tt.want, got, tt.ok)
+		}
+	}
+}
+
+func TestRun_NotifiesReady(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	cfg := defaultTestConfig()
+	cfg.Listen = []string{freeAddr(t, "127.0.0.1")}
+	srv := newTestServer(t, noopDocker(), cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 256)
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no notification: %v", err)
+		}
+		return string(buf[:n])
+	}
+	if msg := read(); !strings.HasPrefix(msg, "READY=1\nSTATUS=") {
+		t.Errorf("first notification = %q, want READY=1 with a status", msg)
+	}
+
+	// The listeners really are up once READY=1 is sent.
+	m := new(dns.Msg)
+	m.SetQuestion("web.docker.", dns.TypeA)
+	if _, _, err := (&dns.Client{Timeout: time.Second}).Exchange(m, cfg.Listen[0]); err != nil {
+		t.Errorf("query after READY=1: %v", err)
+	}
+
+	cancel()
+	if msg := read(); msg != "STOPPING=1" {
+		t.Errorf("notification on shutdown = %q, want STOPPING=1", msg)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Run: %v", err)
+	}
+}
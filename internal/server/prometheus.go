@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// metricsNamespace prefixes every exported Prometheus metric name.
+const metricsNamespace = "docker_dns_"
+
+// promWriter renders metrics in the Prometheus text exposition format
+// (version 0.0.4). The first write error is kept and reported by flush.
+type promWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newPromWriter(w io.Writer) *promWriter {
+	return &promWriter{w: bufio.NewWriter(w)}
+}
+
+func (p *promWriter) printf(format string, args ...any) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, format, args...)
+	}
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.printf("# HELP %s%s %s\n", metricsNamespace, name, help)
+	p.printf("# TYPE %s%s %s\n", metricsNamespace, name, typ)
+}
+
+// counter writes a single unlabeled counter.
+func (p *promWriter) counter(name, help string, v uint64) {
+	p.header(name, "counter", help)
+	p.printf("%s%s %d\n", metricsNamespace, name, v)
+}
+
+// gauge writes a single unlabeled gauge.
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.printf("%s%s %g\n", metricsNamespace, name, v)
+}
+
+// counterVec writes every series of vec under one metric family.
+func (p *promWriter) counterVec(name, help string, vec *CounterVec) {
+	p.header(name, "counter", help)
+	for _, s := range vec.Snapshot() {
+		p.printf("%s%s{%s} %d\n", metricsNamespace, name, formatLabels(vec.labels, s.Labels), s.Value)
+	}
+}
+
+// histogram writes a single unlabeled histogram.
+func (p *promWriter) histogram(name, help string, h *Histogram) {
+	p.header(name, "histogram", help)
+	p.histogramSeries(name, nil, nil, h.Snapshot())
+}
+
+// histogramVec writes every series of vec under one metric family.
+func (p *promWriter) histogramVec(name, help string, vec *HistogramVec) {
+	p.header(name, "histogram", help)
+	for _, s := range vec.Snapshot() {
+		p.histogramSeries(name, vec.labels, s.Labels, s.HistogramSnapshot)
+	}
+}
+
+func (p *promWriter) histogramSeries(name string, names, values []string, snap HistogramSnapshot) {
+	labels := formatLabels(names, values)
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	for i, c := range snap.Cumulative {
+		le := "+Inf"
+		if i < len(snap.Bounds) {
+			le = strconv.FormatFloat(snap.Bounds[i], 'g', -1, 64)
+		}
+		p.printf("%s%s_bucket{%sle=\"%s\"} %d\n", metricsNamespace, name, prefix, le, c)
+	}
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	p.printf("%s%s_sum%s %g\n", metricsNamespace, name, labels, snap.Sum)
+	p.printf("%s%s_count%s %d\n", metricsNamespace, name, labels, snap.Count)
+}
+
+func (p *promWriter) flush() error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// formatLabels renders name="value" pairs with Prometheus escaping.
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// labelEscaper applies the escaping required for label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheus renders all server and cache metrics to w.
+func (s *Server) writePrometheus(w io.Writer) error {
+	m := s.metrics
+	cs := s.cache.Stats()
+	p := newPromWriter(w)
+
+	p.counter("queries_total", "Total DNS queries received.", m.QueriesTotal.Load())
+	p.counterVec("responses_total", "DNS responses sent, by query type, response code and answer source.", m.Responses)
+	p.counter("cache_hits_total", "Local queries answered from the record cache.", m.CacheHits.Load())
+	p.counter("cache_misses_total", "Local queries that missed the record cache.", m.CacheMisses.Load())
+	p.gauge("cache_entries", "Entries currently held in the record cache.", float64(cs.Entries))
+	p.header("cache_lookups_total", "counter", "Lookups against the record cache store, by result.")
+	p.printf("%scache_lookups_total{result=\"hit\"} %d\n", metricsNamespace, cs.Hits)
+	p.printf("%scache_lookups_total{result=\"miss\"} %d\n", metricsNamespace, cs.Misses)
+	if s.answers != nil {
+		fs := s.answers.stats()
+		p.gauge("forward_cache_entries", "Forwarded answers currently held in the forward cache.", float64(fs.Entries))
+		p.header("forward_cache_lookups_total", "counter", "Lookups of forwarded answers in the forward cache, by result.")
+		p.printf("%sforward_cache_lookups_total{result=\"hit\"} %d\n", metricsNamespace, fs.Hits)
+		p.printf("%sforward_cache_lookups_total{result=\"miss\"} %d\n", metricsNamespace, fs.Misses)
+	}
+	p.counter("docker_lookups_total", "Docker API container lookups.", m.DockerLookups.Load())
+	p.counter("docker_errors_total", "Failed Docker API container lookups.", m.DockerErrors.Load())
+	p.counter("forward_queries_total", "Queries forwarded to upstream resolvers.", m.ForwardQueries.Load())
+	p.counter("forward_errors_total", "Forwarded queries that no upstream resolver answered.", m.ForwardErrors.Load())
+	p.counterVec("upstream_responses_total", "Upstream exchanges, by resolver and response code (\"error\" on transport failure).", m.UpstreamResponses)
+	p.counterVec("dnssec_validations_total", "Forwarded answers validated with DNSSEC, by result (secure, insecure, bogus).", m.DNSSECResults)
+	p.counterVec("doh_requests_total", "DNS-over-HTTPS requests, by HTTP method and status code.", m.DoHRequests)
+	p.counterVec("blocked_queries_total", "Queries answered by a blocklist policy, by list.", m.BlockedQueries)
+	p.counterVec("listener_queries_total", "DNS queries received, by listener address and protocol.", m.ListenerQueries)
+	p.counterVec("config_reloads_total", "Configuration reloads on SIGHUP, by result (success, failure).", m.ConfigReloads)
+	if s.blocker != nil {
+		p.header("blocklist_entries", "gauge", "Names blocked by each blocklist, as last loaded.")
+		for _, l := range s.blocker.lists {
+			p.printf("%sblocklist_entries{list=\"%s\"} %d\n", metricsNamespace, labelEscaper.Replace(l.cfg.Name), l.rules.Load().block.len())
+		}
+	}
+	p.counter("rate_limited_total", "Queries refused by the per-client rate limiter.", m.RateLimited.Load())
+	p.header("upstream_healthy", "gauge", "Whether an upstream resolver is in rotation (1) or backed off (0).")
+	status := s.router.Status()
+	for _, st := range status {
+		healthy := 0
+		if st.Healthy {
+			healthy = 1
+		}
+		p.printf("%supstream_healthy{resolver=\"%s\"} %d\n", metricsNamespace, labelEscaper.Replace(st.Addr), healthy)
+	}
+	p.header("upstream_rtt_seconds", "gauge", "Moving average round-trip time of successful upstream exchanges.")
+	for _, st := range status {
+		p.printf("%supstream_rtt_seconds{resolver=\"%s\"} %g\n", metricsNamespace, labelEscaper.Replace(st.Addr), st.RTTSeconds)
+	}
+	p.histogram("query_duration_seconds", "End-to-end DNS query handling latency.", m.QueryDuration)
+	p.histogram("docker_lookup_duration_seconds", "Docker API container lookup latency.", m.DockerLookupDuration)
+	p.histogramVec("upstream_duration_seconds", "Upstream resolver exchange latency, by resolver.", m.UpstreamDuration)
+
+	return p.flush()
+}
@@ -17,7 +17,8 @@ type limiterEntry struct {
 	lastSeen time.Time
 }
 
-// RateLimiter is a per-IP token-bucket rate limiter.
+// RateLimiter is a per-IP token-bucket rate limiter. A limit of 0 allows
+// every query; limits can be changed at runtime with setLimits.
 // Idle entries (no activity for rateLimiterIdleTimeout) are removed
 // by a background goroutine to prevent unbounded memory growth.
 type RateLimiter struct {
@@ -40,6 +41,10 @@ func newRateLimiter(qps float64, burst int, log *slog.Logger) *RateLimiter {
 // Allow returns true if the client IP has not exceeded its quota.
 func (r *RateLimiter) Allow(ip string) bool {
 	r.mu.Lock()
+	if r.limit <= 0 {
+		r.mu.Unlock()
+		return true
+	}
 	e, ok := r.entries[ip]
 	if !ok {
 		e = &limiterEntry{limiter: rate.NewLimiter(r.limit, r.burst)}
@@ -51,6 +56,23 @@ func (r *RateLimiter) Allow(ip string) bool {
 	return ok
 }
 
+// setLimits changes the rate and burst of every client, including the ones
+// already tracked, whose current tokens are kept. A qps of 0 disables
+// limiting.
+func (r *RateLimiter) setLimits(qps float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit, r.burst = rate.Limit(qps), burst
+	if r.limit <= 0 {
+		clear(r.entries)
+		return
+	}
+	for _, e := range r.entries {
+		e.limiter.SetLimit(r.limit)
+		e.limiter.SetBurst(r.burst)
+	}
+}
+
 // cleanupLoop removes entries that have been idle longer than rateLimiterIdleTimeout.
 // It runs until ctx is cancelled.
 func (r *RateLimiter) cleanupLoop(ctx context.Context) {
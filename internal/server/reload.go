@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/medunes/docker-dns/internal/config"
+)
+
+// reloadableFields are the Config fields Reload applies to the running
+// server. Changes to any other field are logged as needing a restart.
+var reloadableFields = []string{
+	"TLDs", "Resolvers", "ForwardRules", "ForwardStrategy", "ForwardRace",
+	"RateLimit", "RateBurst", "LogLevel",
+}
+
+// localSuffix returns the managed TLD suffix (e.g. ".docker.") of domain,
+// or "" when it is not a container name.
+func (s *Server) localSuffix(domain string) string {
+	return s.tlds.Load().MatchLocalSuffix(domain)
+}
+
+// Reload loads a new configuration and applies it without touching the
+// listeners or the caches: the managed TLDs, the resolvers, forward rules
+// and strategy, and the rate limits are swapped atomically. Settings that
+// need a restart are logged and keep their running values. It returns the
+// loaded configuration, so that the caller can apply its log level.
+func (s *Server) Reload(load func() (*config.Config, error)) (*config.Config, error) {
+	next, err := load()
+	if err != nil {
+		return nil, s.reloadFailed(err)
+	}
+
+	applied := *s.cfg
+	applied.Resolvers = next.Resolvers
+	applied.ForwardRules = next.ForwardRules
+	applied.ForwardStrategy = next.ForwardStrategy
+	applied.ForwardRace = next.ForwardRace
+	applied.RateLimit = next.RateLimit
+	applied.RateBurst = next.RateBurst
+	applied.LogLevel = next.LogLevel
+	pinned := changedFields(s.cfg, next)
+	if s.signer == nil {
+		applied.TLDs = next.TLDs
+	} else if !equalField(s.cfg, next, "TLDs") {
+		// The signing keys and chains are built per TLD at startup.
+		pinned = append(pinned, "TLDs")
+	}
+
+	if err := s.router.reconfigure(&applied); err != nil {
+		return nil, s.reloadFailed(err)
+	}
+	s.tlds.Store(&applied)
+	s.rateLim.setLimits(applied.RateLimit, applied.RateBurst)
+
+	if len(pinned) > 0 {
+		s.log.Warn("changed settings need a restart to take effect", "settings", pinned)
+	}
+	s.metrics.ConfigReloads.Inc("success")
+	s.log.Info("configuration reloaded",
+		"tlds", applied.TLDs,
+		"resolvers", applied.Resolvers,
+		"forward_rules", len(applied.ForwardRules),
+		"strategy", applied.ForwardStrategy,
+		"rate_limit", applied.RateLimit,
+		"rate_burst", applied.RateBurst,
+		"log_level", applied.LogLevel,
+	)
+	return next, nil
+}
+
+func (s *Server) reloadFailed(err error) error {
+	s.metrics.ConfigReloads.Inc("failure")
+	s.log.Error("configuration reload failed; keeping the running configuration", "error", err)
+	return fmt.Errorf("reloading configuration: %w", err)
+}
+
+// changedFields returns the names of the non-reloadable fields that differ
+// between a and b.
+func changedFields(a, b *config.Config) []string {
+	var changed []string
+	t := reflect.TypeOf(*a)
+	for i := range t.NumField() {
+		name := t.Field(i).Name
+		if slices.Contains(reloadableFields, name) {
+			continue
+		}
+		if !equalField(a, b, name) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func equalField(a, b *config.Config, name string) bool {
+	return reflect.DeepEqual(
+		reflect.ValueOf(*a).FieldByName(name).Interface(),
+		reflect.ValueOf(*b).FieldByName(name).Interface(),
+	)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestReload_SwapsRuntimeSettings(t *testing.T) {
+	oldUpstream := startFakeUpstream(t, "192.0.2.1", dns.RcodeSuccess)
+	newUpstream := startFakeUpstream(t, "192.0.2.2", dns.RcodeSuccess)
+	dc := &mockDockerClient{ipsFunc: func(context.Context, string) ([]string, error) {
+		return []string{"172.17.0.2"}, nil
+	}}
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{oldUpstream}
+	srv := newTestServer(t, dc, cfg)
+	addr := serveTestDNS(t, srv)
+	srv.cache.Set("web.docker.", []string{"172.17.0.9"})
+
+	ask := func(name string) string {
+		t.Helper()
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		resp, _, err := (&dns.Client{Timeout: 2 * time.Second}).Exchange(m, addr)
+		if err != nil || len(resp.Answer) == 0 {
+			t.Fatalf("%s: %v %v", name, resp, err)
+		}
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+	if got := ask("web.local."); got != "192.0.2.1" {
+		t.Fatalf("before reload web.local. = %s, want the upstream answer", got)
+	}
+
+	next := defaultTestConfig()
+	next.TLDs = []string{"docker", "local"}
+	next.Resolvers = []string{newUpstream}
+	next.RateLimit, next.RateBurst = 1000, 100
+	next.LogLevel = "warn"
+	next.MaxCacheSize = 5 // needs a restart
+	applied, err := srv.Reload(func() (*config.Config, error) { return next, nil })
+	if err != nil || applied != next {
+		t.Fatalf("Reload() = %v, %v", applied, err)
+	}
+
+	if got := ask("web.local."); got != "172.17.0.2" {
+		t.Errorf("web.local. = %s, want the container after adding the TLD", got)
+	}
+	if got := ask("example.com."); got != "192.0.2.2" {
+		t.Errorf("example.com. = %s, want the new resolver", got)
+	}
+	if got := ask("web.docker."); got != "172.17.0.9" {
+		t.Errorf("web.docker. = %s, want the cached entry to survive the reload", got)
+	}
+	if srv.rateLim.limit != 1000 || srv.rateLim.burst != 100 {
+		t.Errorf("rate limiter = %v/%d, want 1000/100", srv.rateLim.limit, srv.rateLim.burst)
+	}
+	if got := srv.metrics.ConfigReloads.Get("success"); got != 1 {
+		t.Errorf("config_reloads_total{result=success} = %d, want 1", got)
+	}
+}
+
+func TestReload_FailureKeepsRunningConfig(t *testing.T) {
+	srv := newTestServer(t, noopDocker(), defaultTestConfig())
+	if _, err := srv.Reload(func() (*config.Config, error) { return nil, errors.New("bad flag") }); err == nil {
+		t.Fatal("want the load error")
+	}
+	if got := srv.metrics.ConfigReloads.Get("failure"); got != 1 {
+		t.Errorf("config_reloads_total{result=failure} = %d, want 1", got)
+	}
+	if srv.localSuffix("web.docker.") != ".docker." {
+		t.Error("the running TLDs must be kept")
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	a, b := defaultTestConfig(), defaultTestConfig()
+	b.TLDs = []string{"local"}
+	b.Resolvers = []string{"9.9.9.9"}
+	b.RateLimit = 7
+	b.Listen = []string{"127.0.0.2:53"}
+	b.TTL = time.Minute
+	if got := changedFields(a, b); !slices.Equal(got, []string{"Listen", "TTL"}) {
+		t.Errorf("changedFields() = %v, want [Listen TTL]", got)
+	}
+}
+
+func TestRateLimiter_SetLimits(t *testing.T) {
+	r := newRateLimiter(0, 1, discardLogger())
+	for range 5 {
+		if !r.Allow("198.51.100.1") {
+			t.Fatal("a zero limit must allow every query")
+		}
+	}
+	r.setLimits(0.001, 1)
+	if !r.Allow("198.51.100.1") || r.Allow("198.51.100.1") {
+		t.Error("want one query within the new burst, then a refusal")
+	}
+	r.setLimits(0, 1)
+	if !r.Allow("198.51.100.1") || len(r.entries) != 0 {
+		t.Error("disabling the limit must allow queries and drop tracked clients")
+	}
+}
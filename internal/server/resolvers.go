@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/medunes/docker-dns/internal/discovery"
+)
+
+// watchResolvers follows the configured dynamic resolver source, replacing
+// the default resolvers whenever it changes, until ctx is cancelled. It
+// returns immediately for the static source.
+func (s *Server) watchResolvers(ctx context.Context) {
+	// Never forward to ourselves, e.g. when resolv.conf points at docker-dns.
+	var exclude []net.IP
+	for _, addr := range s.cfg.Listen {
+		if spec, err := config.ParseListen(addr); err == nil && spec.Kind == "" {
+			exclude = append(exclude, net.ParseIP(spec.Host))
+		}
+	}
+
+	var src discovery.Source
+	switch s.cfg.ResolverSource {
+	case config.SourceFile:
+		src = &discovery.File{Path: s.cfg.ResolvConf, Exclude: exclude}
+	case config.SourceResolved:
+		src = &discovery.Resolved{Exclude: exclude}
+	default:
+		return
+	}
+	discovery.Watch(ctx, notSelf{src, &s.selfIPs}, s.cfg.ResolverPoll, s.log, s.applyResolvers)
+}
+
+// notSelf drops the addresses of the bridge: and network: listeners from the
+// resolvers src reports. Those change at runtime, so they are checked on
+// every poll rather than excluded up front.
+type notSelf struct {
+	discovery.Source
+	bound *boundIPs
+}
+
+func (n notSelf) Resolvers(ctx context.Context) ([]string, error) {
+	found, err := n.Source.Resolvers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(found, func(addr string) bool {
+		ap, err := netip.ParseAddrPort(addr)
+		return err == nil && n.bound.contains(ap.Addr())
+	}), nil
+}
+
+// applyResolvers installs discovered resolvers as the default group, falling
+// back to --resolvers when discovery found none.
+func (s *Server) applyResolvers(found []string) {
+	if len(found) == 0 {
+		s.log.Warn("no upstream resolvers discovered; using configured resolvers", "source", s.cfg.ResolverSource)
+	}
+	if err := s.router.setDefaultResolvers(found); err != nil {
+		s.log.Error("applying discovered resolvers failed", "resolvers", found, "error", err)
+		return
+	}
+	s.log.Info("upstream resolvers updated", "source", s.cfg.ResolverSource, "resolvers", found)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestApplyResolvers_SwapsDefaultGroup(t *testing.T) {
+	first := startFakeUpstream(t, "10.0.0.1", dns.RcodeSuccess)
+	second := startFakeUpstream(t, "10.0.0.2", dns.RcodeSuccess)
+
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{first}
+	srv := newTestServer(t, noopDocker(), cfg)
+	addr := serveTestDNS(t, srv)
+
+	answer := func() string {
+		t.Helper()
+		resp := queryDNS(t, addr, "example.com.", dns.TypeA)
+		if len(resp.Answer) != 1 {
+			t.Fatalf("expected one answer, got %v", resp.Answer)
+		}
+		return resp.Answer[0].(*dns.A).A.String()
+	}
+
+	if got := answer(); got != "10.0.0.1" {
+		t.Fatalf("before swap: got %s, want 10.0.0.1", got)
+	}
+	srv.applyResolvers([]string{second})
+	if got := answer(); got != "10.0.0.2" {
+		t.Errorf("after swap: got %s, want 10.0.0.2", got)
+	}
+	if st := srv.router.Status(); len(st) != 1 || st[0].Addr != second {
+		t.Errorf("status should list only the new resolver, got %+v", st)
+	}
+
+	// Discovering nothing falls back to the configured resolvers.
+	srv.applyResolvers(nil)
+	if got := answer(); got != "10.0.0.1" {
+		t.Errorf("after empty discovery: got %s, want 10.0.0.1", got)
+	}
+}
+
+func TestSetDefaultResolvers_KeepsHealthOfRetainedUpstreams(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{"127.0.0.1:5301", "127.0.0.1:5302"}
+	r, err := newRouter(cfg, discardLogger(), newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := r.route("example.com.").upstreams[1]
+	for i := 0; i < upstreamFailThreshold; i++ {
+		kept.recordFailure(time.Now())
+	}
+
+	if err := r.setDefaultResolvers([]string{"127.0.0.1:5302", "127.0.0.1:5303"}); err != nil {
+		t.Fatal(err)
+	}
+	ups := r.route("example.com.").upstreams
+	if ups[0] != kept {
+		t.Fatal("expected the retained resolver to keep its upstream")
+	}
+	if ups[0].healthy() {
+		t.Error("expected the retained upstream to stay unhealthy across the swap")
+	}
+}
+
+type staticSource []string
+
+func (s staticSource) Resolvers(context.Context) ([]string, error) { return slices.Clone(s), nil }
+
+func TestNotSelf_SkipsDynamicListenerAddresses(t *testing.T) {
+	var bound boundIPs
+	src := notSelf{staticSource{"172.17.0.1:53", "[fe80::1%eth0]:53", "8.8.8.8:53"}, &bound}
+	resolvers := func() []string {
+		t.Helper()
+		found, err := src.Resolvers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	bound.add("172.17.0.1:53")
+	bound.add("[fe80::1]:5353")
+	if got := resolvers(); !slices.Equal(got, []string{"8.8.8.8:53"}) {
+		t.Errorf("with docker-dns on the gateway: %v, want only 8.8.8.8:53", got)
+	}
+	if !bound.contains(netip.MustParseAddr("::ffff:172.17.0.1")) {
+		t.Error("IPv4-mapped address not recognised")
+	}
+
+	bound.remove("172.17.0.1:53")
+	bound.remove("[fe80::1]:5353")
+	if got := resolvers(); len(got) != 3 {
+		t.Errorf("after unbinding: %v, want all three", got)
+	}
+}
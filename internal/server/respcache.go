@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/cache"
+	"github.com/miekg/dns"
+)
+
+// responseCache stores forwarded answers for the TTL of their records, in a
+// bounded cache of its own. An answer that upstream scoped to part of the
+// client subnet sent with the query (ECS) is only reused for clients inside
+// that part (RFC 7871 §7.3).
+type responseCache struct {
+	entries *cache.LRU[storedResponse]
+	now     func() time.Time
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// storedResponse is a cached answer and when it was stored, to age its TTLs.
+type storedResponse struct {
+	msg    *dns.Msg
+	stored time.Time
+}
+
+func newResponseCache(maxSize int) *responseCache {
+	return &responseCache{entries: cache.NewLRU[storedResponse](maxSize), now: time.Now}
+}
+
+// cachedResponse is a cache hit: the stored answer with TTLs aged, and the
+// ECS scope it was stored under.
+type cachedResponse struct {
+	msg   *dns.Msg
+	scope uint8
+}
+
+// baseKey identifies the question and the flags that change the answer: DO
+// (signatures included), CD (validation skipped) and AD (AD reported).
+func baseKey(q *dns.Msg) string {
+	var do bool
+	if opt := q.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	qq := q.Question[0]
+	return fmt.Sprintf("%s/%s/%s/do=%t,cd=%t,ad=%t",
+		strings.ToLower(qq.Name), dns.Type(qq.Qtype), dns.Class(qq.Qclass),
+		do, q.CheckingDisabled, q.AuthenticatedData)
+}
+
+// scopedKey narrows base to the subnet's address truncated to scope bits.
+func scopedKey(base string, subnet *dns.EDNS0_SUBNET, scope uint8) string {
+	bits := 32
+	if subnet.Family == 2 {
+		bits = 128
+	}
+	addr := subnet.Address.Mask(net.CIDRMask(int(scope), bits))
+	return fmt.Sprintf("%s/ecs=%s/%d", base, addr, scope)
+}
+
+// get returns the answer cached for query, which carried subnet upstream
+// (nil when it carried no ECS). The most specific scope wins.
+func (rc *responseCache) get(query *dns.Msg, subnet *dns.EDNS0_SUBNET) (*cachedResponse, bool) {
+	base := baseKey(query)
+	if subnet != nil {
+		for scope := subnet.SourceNetmask; scope > 0; scope-- {
+			if hit, ok := rc.load(scopedKey(base, subnet, scope)); ok {
+				rc.hits.Add(1)
+				hit.scope = scope
+				return hit, true
+			}
+		}
+	}
+	hit, ok := rc.load(base)
+	if ok {
+		rc.hits.Add(1)
+	} else {
+		rc.misses.Add(1)
+	}
+	return hit, ok
+}
+
+// set stores resp, the answer to query, under the ECS scope it applies to.
+// Only complete NOERROR and NXDOMAIN answers with a positive TTL are kept.
+func (rc *responseCache) set(query *dns.Msg, subnet *dns.EDNS0_SUBNET, scope uint8, resp *dns.Msg) {
+	if resp.Truncated || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := responseTTL(resp)
+	if ttl <= 0 {
+		return
+	}
+
+	key := baseKey(query)
+	if subnet != nil && scope > 0 {
+		key = scopedKey(key, subnet, scope)
+	}
+
+	// Keep only what a hit replays; resp itself is still written to the
+	// client (and possibly truncated) after this.
+	msg := &dns.Msg{MsgHdr: dns.MsgHdr{
+		Rcode:              resp.Rcode,
+		AuthenticatedData:  resp.AuthenticatedData,
+		RecursionAvailable: resp.RecursionAvailable,
+	}}
+	msg.Answer = copyRRs(resp.Answer)
+	msg.Ns = copyRRs(resp.Ns)
+	msg.Extra = copyRRs(withoutOPT(resp.Extra))
+	rc.entries.Set(key, storedResponse{msg: msg, stored: rc.now()}, ttl)
+}
+
+// load copies the entry at key, aging its TTLs by the time spent cached.
+func (rc *responseCache) load(key string) (*cachedResponse, bool) {
+	e, ok := rc.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+	age := uint32(max(rc.now().Sub(e.stored)/time.Second, 0))
+
+	msg := &dns.Msg{MsgHdr: e.msg.MsgHdr}
+	msg.Answer = copyRRs(e.msg.Answer)
+	msg.Ns = copyRRs(e.msg.Ns)
+	msg.Extra = copyRRs(e.msg.Extra)
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			h := rr.Header()
+			if h.Ttl > age {
+				h.Ttl -= age
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+	return &cachedResponse{msg: msg}, true
+}
+
+// stats returns the hits and misses of get and the number of stored answers.
+func (rc *responseCache) stats() cache.Stats {
+	return cache.Stats{
+		Hits:    rc.hits.Load(),
+		Misses:  rc.misses.Load(),
+		Entries: rc.entries.Stats().Entries,
+	}
+}
+
+// copyRRs deep-copies rrs, so that cached records are never shared with a
+// message being written.
+func copyRRs(rrs []dns.RR) []dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+	}
+	return out
+}
+
+// responseTTL is how long resp may be cached: the smallest record TTL, with
+// negative answers bounded by their SOA (RFC 2308 §5). Answers without any
+// record, such as a NODATA lacking an SOA, are not cacheable.
+func responseTTL(resp *dns.Msg) time.Duration {
+	ttl := uint32(math.MaxUint32)
+	seen := false
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, withoutOPT(resp.Extra)} {
+		for _, rr := range rrs {
+			seen = true
+			ttl = min(ttl, rr.Header().Ttl)
+			if soa, ok := rr.(*dns.SOA); ok && len(resp.Answer) == 0 {
+				ttl = min(ttl, soa.Minttl)
+			}
+		}
+	}
+	if !seen || (len(resp.Answer) == 0 && !hasSOA(resp.Ns)) {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func hasSOA(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestResponseCache(t *testing.T) *responseCache {
+	t.Helper()
+	return newResponseCache(100)
+}
+
+func TestResponseTTL(t *testing.T) {
+	soa := mustRR(t, "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 60")
+	tests := []struct {
+		name string
+		msg  *dns.Msg
+		want time.Duration
+	}{
+		{"smallest record TTL", &dns.Msg{Answer: []dns.RR{
+			mustRR(t, "a.example. 120 IN CNAME b.example."),
+			mustRR(t, "b.example. 30 IN A 192.0.2.1"),
+		}}, 30 * time.Second},
+		{"negative answer bounded by SOA minimum", &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{soa}}, 60 * time.Second},
+		{"NODATA without SOA", &dns.Msg{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := responseTTL(tt.msg); got != tt.want {
+				t.Errorf("responseTTL = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseCache_AgesTTL(t *testing.T) {
+	rc := newTestResponseCache(t)
+	now := time.Now()
+	rc.now = func() time.Time { return now }
+
+	q := ednsQuery("www.example.")
+	resp := &dns.Msg{MsgHdr: dns.MsgHdr{AuthenticatedData: true}, Answer: []dns.RR{mustRR(t, "www.example. 60 IN A 192.0.2.1")}}
+	rc.set(q, nil, 0, resp)
+
+	now = now.Add(25 * time.Second)
+	hit, ok := rc.get(q, nil)
+	if !ok {
+		t.Fatal("expected a cache hit")
+	}
+	if ttl := hit.msg.Answer[0].Header().Ttl; ttl != 35 {
+		t.Errorf("aged TTL = %d, want 35", ttl)
+	}
+	if !hit.msg.AuthenticatedData {
+		t.Error("AD flag lost in the cache")
+	}
+
+	other := ednsQuery("www.example.")
+	other.CheckingDisabled = true
+	if _, ok := rc.get(other, nil); ok {
+		t.Error("a CD query must not reuse an answer cached for validation")
+	}
+}
+
+func TestResponseCache_ScopeSelection(t *testing.T) {
+	rc := newTestResponseCache(t)
+	subnet := func(ip string, bits uint8) *dns.EDNS0_SUBNET {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: bits, Address: net.ParseIP(ip).To4()}
+	}
+	q := ednsQuery("cdn.example.")
+	resp := &dns.Msg{Answer: []dns.RR{mustRR(t, "cdn.example. 60 IN A 192.0.2.1")}}
+	rc.set(q, subnet("10.1.2.0", 24), 16, resp)
+
+	if hit, ok := rc.get(q, subnet("10.1.9.0", 24)); !ok || hit.scope != 16 {
+		t.Errorf("client inside the /16 scope should hit, got ok=%v", ok)
+	}
+	if _, ok := rc.get(q, subnet("10.2.0.0", 24)); ok {
+		t.Error("client outside the scope must miss")
+	}
+	if _, ok := rc.get(q, nil); ok {
+		t.Error("a query without ECS must not reuse a scoped answer")
+	}
+}
+
+func TestResponseCache_CopiesAndBounds(t *testing.T) {
+	rc := newResponseCache(1)
+	q := ednsQuery("www.example.")
+	resp := &dns.Msg{Answer: []dns.RR{mustRR(t, "www.example. 60 IN A 192.0.2.1")}}
+	rc.set(q, nil, 0, resp)
+
+	resp.Answer[0].(*dns.A).A = net.ParseIP("192.0.2.99") // written on after set
+	hit, ok := rc.get(q, nil)
+	if !ok || hit.msg.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("cached answer changed with the response: %v", hit)
+	}
+	hit.msg.Answer[0].Header().Ttl = 1
+	if again, _ := rc.get(q, nil); again.msg.Answer[0].Header().Ttl != 60 {
+		t.Error("a hit must not share records with the cache")
+	}
+
+	rc.set(ednsQuery("other.example."), nil, 0, resp)
+	if _, ok := rc.get(q, nil); ok {
+		t.Error("want the least recently used answer evicted at the size limit")
+	}
+	if s := rc.stats(); s.Entries != 1 || s.Hits != 2 || s.Misses != 1 {
+		t.Errorf("stats() = %+v, want 1 entry, 2 hits and 1 miss", s)
+	}
+}
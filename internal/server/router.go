@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// router picks the Forwarder for a query name: the group of the longest
+// forward-rule zone containing the name, or the default resolvers when no
+// rule matches. Groups that list the same resolver share its upstream.
+//
+// The default resolvers and the rules can be replaced at runtime; the
+// routing table is rebuilt and swapped atomically, so in-flight queries
+// finish on the old one.
+type router struct {
+	cfg     *config.Config
+	log     *slog.Logger
+	metrics *Metrics
+
+	mu       sync.Mutex // serialises rebuilds and guards cfg and defaults
+	defaults []string   // discovered default resolvers; nil = cfg.Resolvers
+	set      *upstreamSet
+	table    atomic.Pointer[routeTable]
+}
+
+// routeTable is an immutable snapshot of the routing configuration.
+type routeTable struct {
+	fallback  *Forwarder
+	zones     map[string]*Forwarder // lower-case FQDN zone -> resolver group
+	groups    []*Forwarder          // fallback first, then rules in order
+	upstreams []*upstream           // every distinct upstream, for status
+}
+
+func newRouter(cfg *config.Config, log *slog.Logger, m *Metrics) (*router, error) {
+	opts, err := newTransportOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &router{cfg: cfg, log: log, metrics: m, set: newUpstreamSet(opts)}
+	if err := r.rebuild(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// setDefaultResolvers rebuilds the routing table with resolvers as the
+// default group; an empty list restores the configured resolvers.
+func (r *router) setDefaultResolvers(resolvers []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.defaults
+	r.defaults = resolvers
+	if err := r.rebuild(); err != nil {
+		r.defaults = prev
+		return err
+	}
+	return nil
+}
+
+// reconfigure rebuilds the routing table from cfg's resolvers, forward
+// rules and strategy. Discovered default resolvers stay in use.
+func (r *router) reconfigure(cfg *config.Config) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prev := r.cfg
+	r.cfg = cfg
+	if err := r.rebuild(); err != nil {
+		r.cfg = prev
+		return err
+	}
+	return nil
+}
+
+// rebuild swaps in a routing table for the current configuration. Upstreams
+// that remain in use keep their connections and health state; ones no
+// longer referenced are closed. r.mu must be held.
+func (r *router) rebuild() error {
+	resolvers := r.defaults
+	if len(resolvers) == 0 {
+		resolvers = r.cfg.Resolvers
+	}
+	fallback, err := newForwarderFromSet(r.set, resolvers, r.cfg, r.log, r.metrics)
+	if err != nil {
+		return err
+	}
+	t := &routeTable{
+		fallback: fallback,
+		zones:    make(map[string]*Forwarder),
+		groups:   []*Forwarder{fallback},
+	}
+	for _, rule := range r.cfg.ForwardRules {
+		f, err := newForwarderFromSet(r.set, rule.Resolvers, r.cfg, r.log, r.metrics)
+		if err != nil {
+			return err
+		}
+		f.zones = rule.Zones
+		t.groups = append(t.groups, f)
+		for _, zone := range rule.Zones {
+			t.zones[zone] = f
+		}
+	}
+
+	inUse := make(map[*upstream]bool)
+	for _, f := range t.groups {
+		for _, u := range f.upstreams {
+			if !inUse[u] {
+				inUse[u] = true
+				t.upstreams = append(t.upstreams, u)
+			}
+		}
+	}
+	r.table.Store(t)
+
+	for _, u := range r.set.prune(inUse) {
+		if c, ok := u.transport.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+	return nil
+}
+
+// route returns the Forwarder responsible for name.
+func (r *router) route(name string) *Forwarder {
+	t := r.table.Load()
+	if len(t.zones) > 0 {
+		name = dns.Fqdn(strings.ToLower(name))
+		// Walk from the full name towards the root so the first hit is the
+		// longest matching zone.
+		for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+			if f, ok := t.zones[name[off:]]; ok {
+				return f
+			}
+		}
+	}
+	return t.fallback
+}
+
+// probeLoop re-probes unhealthy upstreams of the current routing table until
+// ctx is cancelled. Shared upstreams are probed once at a time.
+func (r *router) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(upstreamProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, f := range r.table.Load().groups {
+				f.probeDue(ctx)
+			}
+		}
+	}
+}
+
+// Status returns a health snapshot of every distinct upstream in use.
+func (r *router) Status() []UpstreamStatus {
+	ups := r.table.Load().upstreams
+	out := make([]UpstreamStatus, len(ups))
+	for i, u := range ups {
+		out[i] = u.status()
+	}
+	return out
+}
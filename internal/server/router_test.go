@@ -0,0 +1,132 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestRouter_LongestSuffixWins(t *testing.T) {
+	public, publicHits := startCountingUpstream(t, "1.1.1.1", dns.RcodeSuccess)
+	corp, corpHits := startCountingUpstream(t, "10.0.0.1", dns.RcodeSuccess)
+	lab, labHits := startCountingUpstream(t, "10.0.0.2", dns.RcodeSuccess)
+
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{public}
+	cfg.ForwardRules = []config.ForwardRule{
+		{Zones: []string{"corp.example."}, Resolvers: []string{corp}},
+		{Zones: []string{"lab.corp.example."}, Resolvers: []string{lab}},
+	}
+	addr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"corp.example.", "10.0.0.1"},
+		{"Intranet.CORP.example.", "10.0.0.1"},
+		{"host.lab.corp.example.", "10.0.0.2"},
+		{"lab.corp.example.", "10.0.0.2"},
+		{"notcorp.example.", "1.1.1.1"},
+		{"example.com.", "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		resp := queryDNS(t, addr, tt.name, dns.TypeA)
+		if len(resp.Answer) != 1 {
+			t.Fatalf("%s: expected one answer, got %v", tt.name, resp.Answer)
+		}
+		if got := resp.Answer[0].(*dns.A).A.String(); got != tt.want {
+			t.Errorf("%s: routed to the resolver answering %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if publicHits.Load() != 2 || corpHits.Load() != 2 || labHits.Load() != 2 {
+		t.Errorf("unexpected query split: public=%d corp=%d lab=%d",
+			publicHits.Load(), corpHits.Load(), labHits.Load())
+	}
+}
+
+func TestRouter_ReverseZoneFromCIDR(t *testing.T) {
+	public, publicHits := startCountingUpstream(t, "", dns.RcodeNameError)
+	internal, internalHits := startCountingUpstream(t, "", dns.RcodeNameError)
+
+	rule, err := config.ParseForwardRule("172.16.0.0/12=" + internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{public}
+	cfg.ForwardRules = []config.ForwardRule{rule}
+	addr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+
+	queryDNS(t, addr, "4.3.20.172.in-addr.arpa.", dns.TypePTR) // 172.20.3.4
+	queryDNS(t, addr, "4.3.32.172.in-addr.arpa.", dns.TypePTR) // 172.32.3.4, outside the /12
+	if internalHits.Load() != 1 || publicHits.Load() != 1 {
+		t.Errorf("expected one PTR query each, got internal=%d public=%d", internalHits.Load(), publicHits.Load())
+	}
+}
+
+func TestRouter_SharesUpstreamsAcrossGroups(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{"127.0.0.1:5301", "127.0.0.1:5302"}
+	cfg.ForwardRules = []config.ForwardRule{
+		{Zones: []string{"corp.example."}, Resolvers: []string{"127.0.0.1:5302", "127.0.0.1:5303"}},
+	}
+	r, err := newRouter(cfg, discardLogger(), newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(r.Status()); got != 3 {
+		t.Errorf("expected 3 distinct upstreams, got %d", got)
+	}
+	corp := r.route("www.corp.example.")
+	if corp == r.table.Load().fallback {
+		t.Fatal("expected corp.example to use its own group")
+	}
+	if corp.upstreams[0] != r.table.Load().fallback.upstreams[1] {
+		t.Error("expected the resolver listed in both groups to share one upstream")
+	}
+}
+
+func TestRouter_SeparatesUpstreamsByServerName(t *testing.T) {
+	pki := newTestPKI(t)
+	addr, _ := startTLSUpstream(t, pki, "5.6.7.8")
+
+	cfg := defaultTestConfig()
+	cfg.UpstreamCA = pki.caFile
+	cfg.ForwardRules = []config.ForwardRule{
+		{Zones: []string{"corp.example."}, Resolvers: []string{"tls://" + addr + "@dns.test"}},
+		{Zones: []string{"lab.example."}, Resolvers: []string{"tls://" + addr + "@other.test"}},
+	}
+	r, err := newRouter(cfg, discardLogger(), newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward := func(name string) error {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		_, err := r.route(name).Forward(t.Context(), req)
+		return err
+	}
+
+	if err := forward("www.corp.example."); err != nil {
+		t.Errorf("dns.test rule: %v", err)
+	}
+	if err := forward("www.lab.example."); err == nil {
+		t.Error("other.test rule was verified against dns.test")
+	}
+
+	// A reload that only changes the server name must verify the new one.
+	next := *cfg
+	next.ForwardRules = []config.ForwardRule{
+		cfg.ForwardRules[0],
+		{Zones: []string{"lab.example."}, Resolvers: []string{"tls://" + addr + "@dns.test"}},
+	}
+	if err := r.reconfigure(&next); err != nil {
+		t.Fatal(err)
+	}
+	if err := forward("www.lab.example."); err != nil {
+		t.Errorf("lab rule after reload: %v", err)
+	}
+}
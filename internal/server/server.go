@@ -5,99 +5,286 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/medunes/docker-dns/internal/cache"
 	"github.com/medunes/docker-dns/internal/config"
 	"github.com/medunes/docker-dns/internal/docker"
+	"github.com/medunes/docker-dns/internal/systemd"
 	"github.com/miekg/dns"
 	"golang.org/x/sync/singleflight"
 )
 
 // Server is the top-level DNS service.
 type Server struct {
-	cfg       *config.Config
-	cache     *cache.Cache
-	docker    docker.Client
-	log       *slog.Logger
-	metrics   *Metrics
-	sfGroup   singleflight.Group
-	forwarder *Forwarder
-	rateLim   *RateLimiter
+	cfg     *config.Config
+	cache   *cache.Cache
+	docker  docker.Client
+	log     *slog.Logger
+	metrics *Metrics
+	sfGroup singleflight.Group
+	router  *router
+	rateLim *RateLimiter
+	tlds    atomic.Pointer[config.Config] // configuration whose TLDs are managed, swapped on reload
+	edns    ednsFilter
+	ecs     ecsPolicy
+	answers *responseCache // nil unless forwarded answers are cached
+	dnssec  *validator     // nil unless DNSSEC validation is enabled
+	signer  *signer        // nil unless the managed zones are signed
+	blocker *blocker       // nil unless blocklists are configured
+	dohCert *serverCert    // nil unless a dedicated DoH listener is configured
+	proxies []netip.Prefix // proxies trusted to name the DoH client
+	dotCert *serverCert    // nil unless the DoT listener is configured
+	selfIPs boundIPs       // addresses bound by bridge: and network: listeners
 }
 
-// New constructs a Server. All arguments are required.
-func New(cfg *config.Config, c *cache.Cache, dc docker.Client, log *slog.Logger) *Server {
+// New constructs a Server. All arguments are required. It fails when the
+// upstream configuration cannot be turned into transports (e.g. an
+// unreadable CA bundle).
+func New(cfg *config.Config, c *cache.Cache, dc docker.Client, log *slog.Logger) (*Server, error) {
 	s := &Server{
 		cfg:     cfg,
 		cache:   c,
 		docker:  dc,
 		log:     log,
 		metrics: newMetrics(),
+		edns:    newForwardEDNSFilter(cfg),
+		ecs:     newECSPolicy(cfg),
 	}
-	s.forwarder = newForwarder(cfg.Resolvers, cfg.ForwardTimeout, log, s.metrics)
-	if cfg.RateLimit > 0 {
-		s.rateLim = newRateLimiter(cfg.RateLimit, cfg.RateBurst, log)
+	s.tlds.Store(cfg)
+	r, err := newRouter(cfg, log, s.metrics)
+	if err != nil {
+		return nil, err
 	}
-	return s
+	s.router = r
+	if cfg.ForwardCache {
+		s.answers = newResponseCache(cfg.ForwardCacheSize)
+	}
+	if cfg.DNSSECValidate {
+		s.dnssec = newValidator(cfg.DNSSECNegativeAnchors, s.validationQuery, log)
+	}
+	if cfg.DNSSECSign {
+		sg, err := newSigner(cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = sg
+	}
+	for _, p := range cfg.DoHTrustedProxies {
+		prefix, err := config.ProxyPrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid doh-trusted-proxies entry %q: %w", p, err)
+		}
+		s.proxies = append(s.proxies, prefix)
+	}
+	if cfg.DoHAddr != "" {
+		s.dohCert, err = newServerCert(cfg.DoHCert, cfg.DoHKey, "", "h2", "http/1.1")
+		if err != nil {
+			return nil, fmt.Errorf("loading DoH certificate: %w", err)
+		}
+	}
+	if cfg.DoTAddr != "" {
+		s.dotCert, err = newServerCert(cfg.DoTCert, cfg.DoTKey, cfg.DoTClientCA, "dot")
+		if err != nil {
+			return nil, fmt.Errorf("loading DoT certificate: %w", err)
+		}
+	}
+	if len(cfg.Blocklists) > 0 {
+		b, err := newBlocker(cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		s.blocker = b
+	}
+	// Always present, so that a reload can turn rate limiting on.
+	s.rateLim = newRateLimiter(cfg.RateLimit, cfg.RateBurst, log)
+	return s, nil
 }
 
-// Run starts the DNS servers (UDP + TCP) and the optional HTTP server.
-// It blocks until ctx is cancelled, then performs a graceful drain.
+// validationQuery fetches a record the DNSSEC validator needs through the
+// upstreams serving that name. DS records belong to the parent zone, so they
+// follow the parent's route.
+func (s *Server) validationQuery(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.CheckingDisabled = true
+	m.SetEdns0(validationUDPSize, true)
+	route := name
+	if qtype == dns.TypeDS {
+		route = parentZone(name)
+	}
+	return s.router.route(route).Forward(ctx, m)
+}
+
+// ReloadCertificates re-reads the certificates, keys and client CA bundles
+// of the TLS listeners. A listener whose files fail to load keeps its
+// previous certificate.
+func (s *Server) ReloadCertificates() error {
+	var errs []error
+	for _, l := range []struct {
+		name string
+		cert *serverCert
+	}{{"doh", s.dohCert}, {"dot", s.dotCert}} {
+		if l.cert == nil {
+			continue
+		}
+		if err := l.cert.reload(); err != nil {
+			s.log.Error("certificate reload failed; keeping the previous one", "listener", l.name, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", l.name, err))
+			continue
+		}
+		s.log.Info("certificate reloaded", "listener", l.name, "cert", l.cert.certFile)
+	}
+	return errors.Join(errs...)
+}
+
+// Run starts the DNS servers (UDP and TCP on every --listen endpoint, and
+// the optional DoT listener) and the optional HTTP servers. Sockets passed
+// by systemd socket activation are used instead of binding the matching
+// addresses, and systemd is notified once every DNS server is up. It blocks
+// until ctx is cancelled, then performs a graceful drain.
 func (s *Server) Run(ctx context.Context) error {
 	mux := dns.NewServeMux()
 	mux.HandleFunc(".", s.handleQuery)
 
-	addr := fmt.Sprintf("%s:53", s.cfg.ListenIP)
-	udpSrv := &dns.Server{Addr: addr, Net: "udp", Handler: mux}
-	tcpSrv := &dns.Server{Addr: addr, Net: "tcp", Handler: mux}
+	var (
+		dnsSrvs []*dns.Server
+		dynamic []*dynamicListener
+	)
+	for _, addr := range s.cfg.Listen {
+		spec, err := config.ParseListen(addr)
+		if err != nil {
+			return err
+		}
+		if spec.Kind != "" {
+			dynamic = append(dynamic, s.newDynamicListener(addr, spec, mux))
+			continue
+		}
+		for _, network := range []string{"udp", "tcp"} {
+			dnsSrvs = append(dnsSrvs, &dns.Server{Addr: addr, Net: network, Handler: s.listenerHandler(mux, addr, network)})
+		}
+	}
+	if s.dotCert != nil {
+		dnsSrvs = append(dnsSrvs, &dns.Server{
+			Addr:      s.cfg.DoTAddr,
+			Net:       "tcp-tls",
+			TLSConfig: s.dotCert.tlsConfig(),
+			Handler:   s.listenerHandler(mux, s.cfg.DoTAddr, "tcp-tls"),
+		})
+	}
+	packets, streams, err := systemd.Listeners()
+	if err != nil {
+		return fmt.Errorf("socket activation: %w", err)
+	}
+	dnsSrvs = s.adoptActivated(dnsSrvs, packets, streams, mux)
 
 	s.log.Info("starting DNS server",
-		"addr", addr,
+		"listen", s.cfg.Listen,
+		"activated_sockets", len(packets)+len(streams),
 		"tlds", s.cfg.TLDs,
 		"ttl", s.cfg.TTL,
 		"resolvers", s.cfg.Resolvers,
+		"resolver_source", s.cfg.ResolverSource,
+		"strategy", s.cfg.ForwardStrategy,
+		"forward_rules", len(s.cfg.ForwardRules),
+		"forward_cache", s.cfg.ForwardCache,
+		"ecs", s.cfg.ECSPolicy,
+		"blocklists", len(s.cfg.Blocklists),
+		"doh_http", s.cfg.DoHServeHTTP,
+		"doh_addr", s.cfg.DoHAddr,
+		"dot_addr", s.cfg.DoTAddr,
+		"dot_client_auth", s.cfg.DoTClientCA != "",
+		"dnssec_validate", s.cfg.DNSSECValidate,
+		"dnssec_sign", s.cfg.DNSSECSign,
 	)
 
-	errCh := make(chan error, 3)
+	errCh := make(chan error, len(dnsSrvs)+3)
 	var wg sync.WaitGroup
 
-	launch := func(srv *dns.Server, label string) {
+	// READY=1 once every DNS server serves; a failing one ends Run instead.
+	var pending atomic.Int32
+	pending.Store(int32(len(dnsSrvs)))
+	ready := func() {
+		if pending.Add(-1) <= 0 {
+			s.notify("READY=1\n" + s.status())
+		}
+	}
+	if len(dnsSrvs) == 0 {
+		ready()
+	}
+	for _, srv := range dnsSrvs {
+		srv.NotifyStartedFunc = ready
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := srv.ListenAndServe(); err != nil {
-				errCh <- fmt.Errorf("%s: %w", label, err)
+			var err error
+			if srv.PacketConn != nil || srv.Listener != nil {
+				err = srv.ActivateAndServe()
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil {
+				errCh <- fmt.Errorf("%s dns on %s: %w", srv.Net, srv.Addr, err)
 			}
 		}()
 	}
-	launch(udpSrv, "udp dns")
-	launch(tcpSrv, "tcp dns")
+	go s.notifyLoop(ctx)
 
-	var httpSrv *http.Server
-	if s.cfg.HTTPAddr != "" {
-		httpSrv = s.newHTTPServer()
+	for _, l := range dynamic {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.run(ctx)
+		}()
+	}
+
+	var httpSrvs []*http.Server
+	launchHTTP := func(srv *http.Server, label string) {
+		httpSrvs = append(httpSrvs, srv)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			s.log.Info("starting HTTP server", "addr", s.cfg.HTTPAddr)
-			if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				errCh <- fmt.Errorf("http: %w", err)
+			s.log.Info("starting "+label+" server", "addr", srv.Addr)
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("%s: %w", label, err)
 			}
 		}()
 	}
+	if s.cfg.HTTPAddr != "" {
+		launchHTTP(s.newHTTPServer(), "http")
+	}
+	if s.cfg.AdminAddr != "" {
+		launchHTTP(s.newAdminServer(), "admin")
+	}
+	if s.dohCert != nil {
+		launchHTTP(s.newDoHServer(), "doh")
+	}
 
-	if s.rateLim != nil {
-		go s.rateLim.cleanupLoop(ctx)
+	go s.rateLim.cleanupLoop(ctx)
+	go s.router.probeLoop(ctx)
+	go s.watchResolvers(ctx)
+	if s.blocker != nil && s.cfg.BlocklistReload > 0 {
+		go s.blocker.reloadLoop(ctx, s.cfg.BlocklistReload)
 	}
 
 	select {
 	case <-ctx.Done():
 		s.log.Info("shutdown signal received")
+		s.notify("STOPPING=1")
 	case err := <-errCh:
 		s.log.Error("server error", "error", err)
 		return err
@@ -106,21 +293,40 @@ func (s *Server) Run(ctx context.Context) error {
 	shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if httpSrv != nil {
-		_ = httpSrv.Shutdown(shutCtx)
+	for _, srv := range httpSrvs {
+		_ = srv.Shutdown(shutCtx)
+	}
+	for _, srv := range dnsSrvs {
+		_ = srv.ShutdownContext(shutCtx)
 	}
-	_ = udpSrv.ShutdownContext(shutCtx)
-	_ = tcpSrv.ShutdownContext(shutCtx)
 	wg.Wait()
 
 	s.log.Info("all servers stopped cleanly")
 	return nil
 }
 
+// listenerHandler counts the queries received on one listener before
+// passing them to next.
+func (s *Server) listenerHandler(next dns.Handler, addr, network string) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		s.metrics.ListenerQueries.Inc(addr, network)
+		next.ServeDNS(w, r)
+	})
+}
+
 func (s *Server) newHTTPServer() *http.Server {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.httpHealth)
 	mux.HandleFunc("/metrics", s.httpMetrics)
+	if s.cfg.DoHServeHTTP {
+		mux.HandleFunc(dohPath, s.serveDoH)
+	}
+	if s.signer != nil {
+		mux.HandleFunc("/dnssec/ds", s.httpDS)
+	}
+	if s.cfg.AdminEnabled() && s.cfg.AdminAddr == "" {
+		s.registerAdminRoutes(mux)
+	}
 	return &http.Server{
 		Addr:         s.cfg.HTTPAddr,
 		Handler:      mux,
@@ -134,7 +340,27 @@ func (s *Server) httpHealth(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write([]byte(`{"status":"ok"}`))
 }
 
-func (s *Server) httpMetrics(w http.ResponseWriter, _ *http.Request) {
+// httpDS lists the DS records of the signed zones, one per line, ready to be
+// installed as trust anchors in a validating resolver.
+func (s *Server) httpDS(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, ds := range s.signer.trustAnchors() {
+		_, _ = fmt.Fprintln(w, ds.String())
+	}
+}
+
+// httpMetrics serves the Prometheus text format by default. The legacy flat
+// JSON view is returned for "?format=json" or an Accept header that asks
+// for application/json.
+func (s *Server) httpMetrics(w http.ResponseWriter, r *http.Request) {
+	if !wantsJSON(r) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := s.writePrometheus(w); err != nil {
+			s.log.Debug("writing metrics failed", "error", err)
+		}
+		return
+	}
+
 	cs := s.cache.Stats()
 	payload := map[string]any{
 		"queries_total":   s.metrics.QueriesTotal.Load(),
@@ -146,7 +372,38 @@ func (s *Server) httpMetrics(w http.ResponseWriter, _ *http.Request) {
 		"forward_queries": s.metrics.ForwardQueries.Load(),
 		"forward_errors":  s.metrics.ForwardErrors.Load(),
 		"rate_limited":    s.metrics.RateLimited.Load(),
+
+		"query_duration_seconds":         latencySummary(s.metrics.QueryDuration.Snapshot()),
+		"docker_lookup_duration_seconds": latencySummary(s.metrics.DockerLookupDuration.Snapshot()),
+	}
+	upstreams := make(map[string]any)
+	for _, h := range s.metrics.UpstreamDuration.Snapshot() {
+		upstreams[h.Labels[0]] = latencySummary(h.HistogramSnapshot)
+	}
+	payload["upstream_duration_seconds"] = upstreams
+	payload["upstreams"] = s.router.Status()
+	if s.answers != nil {
+		fs := s.answers.stats()
+		payload["forward_cache_hits"] = fs.Hits
+		payload["forward_cache_misses"] = fs.Misses
+		payload["forward_cache_entries"] = fs.Entries
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(payload)
 }
+
+// latencySummary condenses a histogram into count, sum and mean for the JSON view.
+func latencySummary(h HistogramSnapshot) map[string]any {
+	mean := 0.0
+	if h.Count > 0 {
+		mean = h.Sum / float64(h.Count)
+	}
+	return map[string]any{"count": h.Count, "sum": h.Sum, "mean": mean}
+}
+
+func wantsJSON(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// freeAddr returns host:port with a port that was free for TCP a moment ago.
+func freeAddr(t *testing.T, host string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", host, err)
+	}
+	defer ln.Close()
+	return net.JoinHostPort(host, strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+}
+
+func TestRun_MultipleListeners(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.Listen = []string{freeAddr(t, "127.0.0.1"), freeAddr(t, "::1")}
+	srv := newTestServer(t, &mockDockerClient{ipsFunc: func(context.Context, string) ([]string, error) {
+		return []string{"172.17.0.2"}, nil
+	}}, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+
+	m := new(dns.Msg)
+	m.SetQuestion("web.docker.", dns.TypeA)
+	for _, addr := range cfg.Listen {
+		for _, network := range []string{"udp", "tcp"} {
+			c := &dns.Client{Net: network, Timeout: time.Second}
+			var (
+				resp *dns.Msg
+				err  error
+			)
+			// The listeners start asynchronously.
+			for range 20 {
+				if resp, _, err = c.Exchange(m, addr); err == nil {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("%s %s: %v", network, addr, err)
+			}
+			if len(resp.Answer) != 1 {
+				t.Errorf("%s %s: unexpected answer %v", network, addr, resp.Answer)
+			}
+			if got := srv.metrics.ListenerQueries.Get(addr, network); got != 1 {
+				t.Errorf("listener_queries_total{listener=%q,proto=%q} = %d, want 1", addr, network, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+)
+
+// serverCert holds the TLS configuration of a listener, built from files
+// that can be re-read while the listener keeps running. Handshakes that
+// start after a reload use the new certificate; established connections
+// are unaffected.
+type serverCert struct {
+	certFile, keyFile string
+	clientCA          string   // "" = no client certificates required
+	nextProtos        []string // ALPN protocols offered to clients
+	current           atomic.Pointer[tls.Config]
+}
+
+func newServerCert(certFile, keyFile, clientCA string, nextProtos ...string) (*serverCert, error) {
+	c := &serverCert{certFile: certFile, keyFile: keyFile, clientCA: clientCA, nextProtos: nextProtos}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the certificate, key and client CA bundle. On error the
+// previous configuration stays in use.
+func (c *serverCert) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", c.certFile, err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   c.nextProtos,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.clientCA != "" {
+		pool, err := loadCertPool(c.clientCA)
+		if err != nil {
+			return fmt.Errorf("loading client CA: %w", err)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	c.current.Store(cfg)
+	return nil
+}
+
+// tlsConfig returns the configuration to hand to a listener. It defers to
+// the latest loaded configuration on every handshake.
+func (c *serverCert) tlsConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos: c.nextProtos,
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.current.Load(), nil
+		},
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// copyFile copies src to dst, replacing dst.
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedLeaf returns the leaf certificate a TLS listener at addr presents.
+func servedLeaf(t *testing.T, addr string) []byte {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Raw
+}
+
+func TestServerCert_Reload(t *testing.T) {
+	first, second := newTestPKI(t), newTestPKI(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	copyFile(t, first.certFile, certFile)
+	copyFile(t, first.keyFile, keyFile)
+
+	c, err := newServerCert(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", c.tlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = conn.(*tls.Conn).Handshake(); _ = conn.Close() }()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	if !bytes.Equal(servedLeaf(t, addr), first.serverTLS.Certificates[0].Certificate[0]) {
+		t.Fatal("listener does not serve the initial certificate")
+	}
+
+	copyFile(t, second.certFile, certFile)
+	copyFile(t, second.keyFile, keyFile)
+	if err := c.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !bytes.Equal(servedLeaf(t, addr), second.serverTLS.Certificates[0].Certificate[0]) {
+		t.Error("new handshakes must use the reloaded certificate")
+	}
+
+	_ = os.WriteFile(certFile, []byte("garbage"), 0o600)
+	if err := c.reload(); err == nil {
+		t.Error("want an error for a broken certificate")
+	}
+	if !bytes.Equal(servedLeaf(t, addr), second.serverTLS.Certificates[0].Certificate[0]) {
+		t.Error("a failed reload must keep the previous certificate")
+	}
+}
+
+func TestDoTListener_ClientAuth(t *testing.T) {
+	pki := newTestPKI(t)
+	cfg := defaultTestConfig()
+	cfg.DoTAddr, cfg.DoTCert, cfg.DoTKey, cfg.DoTClientCA = "127.0.0.1:0", pki.certFile, pki.keyFile, pki.caFile
+	srv := newTestServer(t, &mockDockerClient{ipsFunc: func(context.Context, string) ([]string, error) {
+		return []string{"172.17.0.2"}, nil
+	}}, cfg)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := &dns.Server{Listener: tls.NewListener(ln, srv.dotCert.tlsConfig()), Net: "tcp-tls", Handler: dns.HandlerFunc(srv.handleQuery)}
+	go func() { _ = dot.ActivateAndServe() }()
+	t.Cleanup(func() { _ = dot.Shutdown() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.ca)
+	exchange := func(certs ...tls.Certificate) (*dns.Msg, error) {
+		c := &dns.Client{Net: "tcp-tls", Timeout: 3 * time.Second, TLSConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "dns.test",
+			Certificates: certs,
+			NextProtos:   []string{"dot"},
+		}}
+		m := new(dns.Msg)
+		m.SetQuestion("web.docker.", dns.TypeA)
+		resp, _, err := c.Exchange(m, ln.Addr().String())
+		return resp, err
+	}
+
+	if _, err := exchange(); err == nil {
+		t.Error("a client without a certificate must be rejected")
+	}
+	resp, err := exchange(pki.clientCert(t))
+	if err != nil {
+		t.Fatalf("exchange with a client certificate: %v", err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "172.17.0.2" {
+		t.Errorf("unexpected answer %v", resp.Answer)
+	}
+}
+
+func TestReloadCertificates(t *testing.T) {
+	pki := newTestPKI(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	copyFile(t, pki.certFile, certFile)
+	copyFile(t, pki.keyFile, keyFile)
+
+	cfg := defaultTestConfig()
+	cfg.DoTAddr, cfg.DoTCert, cfg.DoTKey = "127.0.0.1:0", certFile, keyFile
+	srv := newTestServer(t, noopDocker(), cfg)
+	if err := srv.ReloadCertificates(); err != nil {
+		t.Errorf("reload of unchanged files: %v", err)
+	}
+	_ = os.Remove(keyFile)
+	if err := srv.ReloadCertificates(); err == nil {
+		t.Error("want an error when the key disappears")
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto"
+	"encoding/base32"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// Online signatures are made per answer, so they only need to outlive
+// downstream caching; inception is backdated to tolerate clock skew.
+const (
+	signatureValidity = 24 * time.Hour
+	signatureSkew     = time.Hour
+)
+
+// typeNXNAME in a black lie's type bitmap marks the name as non-existent
+// (RFC 9824), letting resolvers restore the NXDOMAIN.
+const typeNXNAME uint16 = 128
+
+// signer signs the managed TLD zones online, one key per zone.
+type signer struct {
+	zones []*zoneSigner
+}
+
+// zoneSigner holds the key and parameters of one signed zone.
+type zoneSigner struct {
+	zone   string // lower-case FQDN, e.g. "docker."
+	key    *dns.DNSKEY
+	priv   crypto.Signer
+	denial string // config.DenialNSEC or config.DenialNSEC3
+	ttl    uint32
+	serial uint32
+	now    func() time.Time
+}
+
+// newSigner loads or generates a key for every managed TLD.
+func newSigner(cfg *config.Config, log *slog.Logger) (*signer, error) {
+	s := &signer{}
+	for _, tld := range cfg.TLDs {
+		zone := dns.Fqdn(tld)
+		key, priv, err := loadZoneKey(cfg.DNSSECKeyDir, zone, log)
+		if err != nil {
+			return nil, err
+		}
+		z := &zoneSigner{
+			zone:   zone,
+			key:    key,
+			priv:   priv,
+			denial: cfg.DNSSECDenial,
+			ttl:    uint32(cfg.TTL.Seconds()),
+			serial: uint32(time.Now().Unix()),
+			now:    time.Now,
+		}
+		s.zones = append(s.zones, z)
+		log.Info("signing zone", "zone", zone, "key_tag", key.KeyTag(), "ds", z.ds().String())
+	}
+	return s, nil
+}
+
+// zone returns the signer of the managed zone containing name, or nil.
+func (s *signer) zone(name string) *zoneSigner {
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z.zone, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// trustAnchors returns the DS record of every signed zone.
+func (s *signer) trustAnchors() []*dns.DS {
+	out := make([]*dns.DS, len(s.zones))
+	for i, z := range s.zones {
+		out[i] = z.ds()
+	}
+	return out
+}
+
+// loadZoneKey reads zone's BIND-format key pair (K<zone>+<alg>+<tag>.key and
+// .private) from dir, generating and saving one when none exists. An empty
+// dir yields a throwaway key.
+func loadZoneKey(dir, zone string, log *slog.Logger) (*dns.DNSKEY, crypto.Signer, error) {
+	if dir != "" {
+		matches, err := filepath.Glob(filepath.Join(dir, "K"+zone+"+*.private"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("dnssec key dir: %w", err)
+		}
+		if len(matches) > 0 {
+			sort.Strings(matches)
+			return readZoneKey(strings.TrimSuffix(matches[0], ".private"), zone)
+		}
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257, // zone key + secure entry point: a single combined key
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating key for %s: %w", zone, err)
+	}
+	if dir == "" {
+		log.Warn("using a throwaway DNSSEC key; its DS changes on every restart", "zone", zone)
+		return key, priv.(crypto.Signer), nil
+	}
+
+	base := filepath.Join(dir, fmt.Sprintf("K%s+%03d+%05d", zone, key.Algorithm, key.KeyTag()))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("dnssec key dir: %w", err)
+	}
+	if err := os.WriteFile(base+".private", []byte(key.PrivateKeyString(priv)), 0o600); err != nil {
+		return nil, nil, fmt.Errorf("saving key for %s: %w", zone, err)
+	}
+	if err := os.WriteFile(base+".key", []byte(key.String()+"\n"), 0o644); err != nil {
+		return nil, nil, fmt.Errorf("saving key for %s: %w", zone, err)
+	}
+	log.Info("generated DNSSEC key", "zone", zone, "file", base+".key")
+	return key, priv.(crypto.Signer), nil
+}
+
+// readZoneKey loads the key pair stored under base (without extension).
+func readZoneKey(base, zone string) (*dns.DNSKEY, crypto.Signer, error) {
+	pub, err := os.Open(base + ".key")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading key for %s: %w", zone, err)
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, base+".key")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading key for %s: %w", zone, err)
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok || !strings.EqualFold(key.Hdr.Name, zone) {
+		return nil, nil, fmt.Errorf("%s.key is not a DNSKEY for %s", base, zone)
+	}
+
+	private, err := os.Open(base + ".private")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading key for %s: %w", zone, err)
+	}
+	defer private.Close()
+	priv, err := key.ReadPrivateKey(private, base+".private")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading key for %s: %w", zone, err)
+	}
+	ps, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s.private: unsupported key type", base)
+	}
+	return key, ps, nil
+}
+
+func (z *zoneSigner) header(name string, rtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rtype, Class: dns.ClassINET, Ttl: z.ttl}
+}
+
+// soa returns the zone's synthesized SOA record.
+func (z *zoneSigner) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr:     z.header(z.zone, dns.TypeSOA),
+		Ns:      z.zone,
+		Mbox:    "hostmaster." + z.zone,
+		Serial:  z.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  z.ttl,
+	}
+}
+
+// ds returns the DS record to install as a trust anchor for the zone.
+func (z *zoneSigner) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+// sign returns rrs followed by an RRSIG for each of their RRsets.
+func (z *zoneSigner) sign(rrs []dns.RR) ([]dns.RR, error) {
+	out := slices.Clone(rrs)
+	now := z.now()
+	for _, set := range splitRRsets(rrs) {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: set.rrs[0].Header().Ttl},
+			Algorithm:  z.key.Algorithm,
+			KeyTag:     z.key.KeyTag(),
+			SignerName: z.zone,
+			Inception:  uint32(now.Add(-signatureSkew).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := sig.Sign(z.priv, set.rrs); err != nil {
+			return nil, fmt.Errorf("signing %s %s: %w", set.rrs[0].Header().Name, dns.TypeToString[set.rrs[0].Header().Rrtype], err)
+		}
+		out = append(out, sig)
+	}
+	return out, nil
+}
+
+// blackLie returns an NSEC or NSEC3 record claiming that name holds exactly
+// types, so that every other type is denied without enumerating the zone
+// (RFC 4470). A name that does not exist gets the NXNAME type instead.
+func (z *zoneSigner) blackLie(name string, types []uint16, exists bool) dns.RR {
+	name = strings.ToLower(name)
+	bitmap := slices.Clone(types)
+	if !exists {
+		bitmap = []uint16{typeNXNAME}
+	}
+
+	if z.denial == config.DenialNSEC3 {
+		if exists {
+			bitmap = append(bitmap, dns.TypeRRSIG)
+		}
+		slices.Sort(bitmap)
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		return &dns.NSEC3{
+			Hdr:        z.header(strings.ToLower(hash)+"."+z.zone, dns.TypeNSEC3),
+			Hash:       dns.SHA1,
+			HashLength: 20,
+			NextDomain: nextHash(hash),
+			TypeBitMap: bitmap,
+		}
+	}
+
+	bitmap = append(bitmap, dns.TypeRRSIG, dns.TypeNSEC)
+	slices.Sort(bitmap)
+	return &dns.NSEC{
+		Hdr:        z.header(name, dns.TypeNSEC),
+		NextDomain: `\000.` + name,
+		TypeBitMap: bitmap,
+	}
+}
+
+// nextHash returns the base32hex hash immediately after h, so that an NSEC3
+// owned by h covers no other name.
+func nextHash(h string) string {
+	enc := base32.HexEncoding.WithPadding(base32.NoPadding)
+	b, err := enc.DecodeString(h)
+	if err != nil {
+		return h
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			break
+		}
+	}
+	return enc.EncodeToString(b)
+}
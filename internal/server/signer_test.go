@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestLoadZoneKey_GeneratesAndReloads(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+
+	key, _, err := loadZoneKey(dir, "docker.", discardLogger())
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "Kdocker.+013+*"))
+	if len(matches) != 2 {
+		t.Fatalf("expected .key and .private files, got %v", matches)
+	}
+	for _, m := range matches {
+		if fi, _ := os.Stat(m); strings.HasSuffix(m, ".private") && fi.Mode().Perm() != 0o600 {
+			t.Errorf("private key mode = %o, want 600", fi.Mode().Perm())
+		}
+	}
+
+	again, priv, err := loadZoneKey(dir, "docker.", discardLogger())
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if again.KeyTag() != key.KeyTag() || again.PublicKey != key.PublicKey {
+		t.Errorf("reloaded key %d differs from generated key %d", again.KeyTag(), key.KeyTag())
+	}
+	if priv == nil {
+		t.Error("reloaded private key is nil")
+	}
+}
+
+func TestReadZoneKey_WrongZone(t *testing.T) {
+	dir := t.TempDir()
+	key, _, err := loadZoneKey(dir, "docker.", discardLogger())
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.key"))
+	if _, _, err := readZoneKey(strings.TrimSuffix(matches[0], ".key"), "local."); err == nil {
+		t.Errorf("key %d for docker. must not load for local.", key.KeyTag())
+	}
+}
+
+func TestNextHash(t *testing.T) {
+	h := dns.HashName("web.docker.", dns.SHA1, 0, "")
+	n := &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(h) + ".docker."},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: nextHash(h),
+	}
+	if !n.Match("web.docker.") {
+		t.Fatal("black lie NSEC3 must match its own name")
+	}
+	for _, other := range []string{"db.docker.", "a.web.docker.", "docker."} {
+		if n.Cover(other) {
+			t.Errorf("black lie NSEC3 for web.docker. covers %s", other)
+		}
+	}
+	if got := nextHash("0000000000000000000000000000000V"); got != "00000000000000000000000000000010" {
+		t.Errorf("nextHash carry = %s", got)
+	}
+}
+
+// startSignedZoneServer serves the docker. zone signed with denial, where
+// only the container "web" exists.
+func startSignedZoneServer(t *testing.T, denial string) (string, *Server) {
+	t.Helper()
+	dc := &mockDockerClient{ipsFunc: func(_ context.Context, name string) ([]string, error) {
+		if name == "web" {
+			return []string{"172.17.0.2"}, nil
+		}
+		return nil, nil
+	}}
+	cfg := defaultTestConfig()
+	cfg.DNSSECSign = true
+	cfg.DNSSECDenial = denial
+	srv := newTestServer(t, dc, cfg)
+	return serveTestDNS(t, srv), srv
+}
+
+// verifySigned checks that every RRset in rrs is signed by key.
+func verifySigned(t *testing.T, key *dns.DNSKEY, rrs []dns.RR) {
+	t.Helper()
+	for _, set := range splitRRsets(rrs) {
+		h := set.rrs[0].Header()
+		if len(set.sigs) == 0 {
+			t.Errorf("%s %s is not signed", h.Name, dns.TypeToString[h.Rrtype])
+			continue
+		}
+		for _, sig := range set.sigs {
+			if err := sig.Verify(key, set.rrs); err != nil || !sig.ValidityPeriod(time.Now()) {
+				t.Errorf("bad RRSIG on %s %s: %v", h.Name, dns.TypeToString[h.Rrtype], err)
+			}
+		}
+	}
+}
+
+func TestSignedZone(t *testing.T) {
+	for _, denial := range []string{config.DenialNSEC, config.DenialNSEC3} {
+		t.Run(denial, func(t *testing.T) {
+			addr, srv := startSignedZoneServer(t, denial)
+			c := &dns.Client{Timeout: 3 * time.Second}
+			exchange := func(name string, qtype uint16, do bool) *dns.Msg {
+				t.Helper()
+				m := new(dns.Msg)
+				m.SetQuestion(name, qtype)
+				if do {
+					m.SetEdns0(1232, true)
+				}
+				resp, _, err := c.Exchange(m, addr)
+				if err != nil {
+					t.Fatalf("exchange %s: %v", name, err)
+				}
+				return resp
+			}
+
+			keys := exchange("docker.", dns.TypeDNSKEY, true)
+			var key *dns.DNSKEY
+			for _, rr := range keys.Answer {
+				if k, ok := rr.(*dns.DNSKEY); ok {
+					key = k
+				}
+			}
+			if key == nil {
+				t.Fatalf("no DNSKEY at the apex: %v", keys)
+			}
+			verifySigned(t, key, keys.Answer)
+			if ds := srv.signer.trustAnchors(); len(ds) != 1 || !matchesDS(key, ds) {
+				t.Fatalf("published DS %v does not match the served key", ds)
+			}
+
+			a := exchange("web.docker.", dns.TypeA, true)
+			if a.Rcode != dns.RcodeSuccess || !a.Authoritative || len(a.Answer) != 2 {
+				t.Fatalf("want signed A answer, got %v", a)
+			}
+			verifySigned(t, key, a.Answer)
+
+			negatives := []struct {
+				name  string
+				qtype uint16
+			}{
+				{"web.docker.", dns.TypeAAAA}, // NODATA
+				{"web.docker.", dns.TypeMX},   // NODATA for a type docker-dns never serves
+				{"nope.docker.", dns.TypeA},   // NXDOMAIN as a black lie
+			}
+			for _, n := range negatives {
+				resp := exchange(n.name, n.qtype, true)
+				if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+					t.Errorf("%s %s: want NOERROR without answers, got %s", n.name, dns.TypeToString[n.qtype], dns.RcodeToString[resp.Rcode])
+					continue
+				}
+				verifySigned(t, key, resp.Ns)
+				proof := &denialProof{}
+				for _, set := range splitRRsets(resp.Ns) {
+					proof.add(set)
+				}
+				if got := proof.deny(n.name, n.qtype, false); got != denialProven {
+					t.Errorf("%s %s: denial not proven by %v", n.name, dns.TypeToString[n.qtype], resp.Ns)
+				}
+			}
+
+			nx := exchange("nope.docker.", dns.TypeA, true)
+			if !proofHasType(nx.Ns, typeNXNAME) {
+				t.Errorf("black lie for a missing name must carry NXNAME: %v", nx.Ns)
+			}
+			if proofHasType(a.Ns, typeNXNAME) {
+				t.Errorf("positive answer must not carry a denial")
+			}
+		})
+	}
+}
+
+// proofHasType reports whether an NSEC or NSEC3 in rrs lists rtype.
+func proofHasType(rrs []dns.RR, rtype uint16) bool {
+	for _, rr := range rrs {
+		switch r := rr.(type) {
+		case *dns.NSEC:
+			return slices.Contains(r.TypeBitMap, rtype)
+		case *dns.NSEC3:
+			return slices.Contains(r.TypeBitMap, rtype)
+		}
+	}
+	return false
+}
+
+func TestSignedZone_WithoutDO(t *testing.T) {
+	addr, _ := startSignedZoneServer(t, config.DenialNSEC)
+
+	nx := queryDNS(t, addr, "nope.docker.", dns.TypeA)
+	if nx.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s, want NXDOMAIN for clients without DO", dns.RcodeToString[nx.Rcode])
+	}
+	if len(nx.Ns) != 1 || nx.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("want only the SOA in the authority section, got %v", nx.Ns)
+	}
+
+	soa := queryDNS(t, addr, "docker.", dns.TypeSOA)
+	if len(soa.Answer) != 1 || soa.Answer[0].Header().Rrtype != dns.TypeSOA || !soa.Authoritative {
+		t.Errorf("want an authoritative SOA at the apex, got %v", soa)
+	}
+
+	a := queryDNS(t, addr, "web.docker.", dns.TypeA)
+	if len(a.Answer) != 1 {
+		t.Errorf("want a bare A answer without signatures, got %v", a.Answer)
+	}
+}
+
+func TestHTTPDS(t *testing.T) {
+	_, srv := startSignedZoneServer(t, config.DenialNSEC)
+	rec := httptest.NewRecorder()
+	srv.newHTTPServer().Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/dnssec/ds", nil))
+
+	rr, err := dns.NewRR(strings.TrimSpace(rec.Body.String()))
+	if err != nil {
+		t.Fatalf("parse %q: %v", rec.Body.String(), err)
+	}
+	ds, ok := rr.(*dns.DS)
+	if !ok || ds.Hdr.Name != "docker." || ds.KeyTag != srv.signer.zones[0].key.KeyTag() {
+		t.Errorf("unexpected DS %v", rr)
+	}
+}
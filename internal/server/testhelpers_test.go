@@ -2,9 +2,20 @@ package server
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
 	"log/slog"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,12 +30,20 @@ import (
 
 // mockDockerClient implements docker.Client for unit tests without a real daemon.
 type mockDockerClient struct {
-	ipsFunc func(ctx context.Context, name string) ([]string, error)
+	ipsFunc      func(ctx context.Context, name string) ([]string, error)
+	gatewaysFunc func(ctx context.Context, name string) ([]string, error)
 }
 
 func (m *mockDockerClient) ContainerIPs(ctx context.Context, name string) ([]string, error) {
 	return m.ipsFunc(ctx, name)
 }
+
+func (m *mockDockerClient) NetworkGateways(ctx context.Context, name string) ([]string, error) {
+	if m.gatewaysFunc == nil {
+		return nil, nil
+	}
+	return m.gatewaysFunc(ctx, name)
+}
 func (m *mockDockerClient) Close() error { return nil }
 
 // Compile-time assertion (requires the docker package's Client interface).
@@ -38,17 +57,44 @@ func (m *mockDockerClient) Close() error { return nil }
 // defaultTestConfig returns a minimal valid config for tests.
 func defaultTestConfig() *config.Config {
 	return &config.Config{
-		ListenIP:       "127.0.0.1",
-		TLDs:           []string{"docker"},
-		TTL:            10 * time.Second,
-		Resolvers:      []string{"8.8.8.8"},
-		LogLevel:       "debug",
-		RateLimit:      0,
-		RateBurst:      10,
-		MaxCacheSize:   100,
-		DockerTimeout:  2 * time.Second,
-		ForwardTimeout: 2 * time.Second,
+		Listen:          []string{"127.0.0.1:0"},
+		TLDs:            []string{"docker"},
+		TTL:             10 * time.Second,
+		Resolvers:       []string{"8.8.8.8"},
+		LogLevel:        "debug",
+		RateLimit:       0,
+		RateBurst:       10,
+		MaxCacheSize:    100,
+		DockerTimeout:   2 * time.Second,
+		ForwardTimeout:  2 * time.Second,
+		ForwardStrategy: config.StrategyParallel,
+		ForwardRace:     2,
+		DoHMethod:       "POST",
+		ResolverSource:  config.SourceStatic,
+		ECSPolicy:       config.ECSPass,
+		ECSPrefix4:      24,
+		ECSPrefix6:      56,
+		DNSSECDenial:    config.DenialNSEC,
+		ForwardEDNSOptions: []uint16{
+			dns.EDNS0NSID, dns.EDNS0SUBNET, dns.EDNS0EDE,
+		},
+	}
+}
+
+// newTestServer builds a Server backed by a fresh cache that is stopped when
+// the test finishes.
+func newTestServer(t *testing.T, dc *mockDockerClient, cfg *config.Config) *Server {
+	t.Helper()
+
+	c := cache.New(cfg.TTL, cfg.MaxCacheSize)
+	t.Cleanup(c.Stop)
+
+	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	srv, err := New(cfg, c, dc, log)
+	if err != nil {
+		t.Fatalf("server.New: %v", err)
 	}
+	return srv
 }
 
 // startTestDNSServer spins up a UDP-only DNS server on a random OS-assigned
@@ -70,11 +116,13 @@ func startTestDNSServer(t *testing.T, dc *mockDockerClient, resolvers []string)
 func startTestDNSServerWithConfig(t *testing.T, dc *mockDockerClient, cfg *config.Config) string {
 	t.Helper()
 
-	c := cache.New(cfg.TTL, cfg.MaxCacheSize)
-	t.Cleanup(c.Stop)
+	return serveTestDNS(t, newTestServer(t, dc, cfg))
+}
 
-	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
-	srv := New(cfg, c, dc, log)
+// serveTestDNS serves srv over UDP on a random loopback port, for tests that
+// need to inspect the Server after sending queries.
+func serveTestDNS(t *testing.T, srv *Server) string {
+	t.Helper()
 
 	// Bind once; hand the conn to dns.Server to avoid releasing it between bind and use.
 	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
@@ -105,6 +153,21 @@ func startTestDNSServerWithConfig(t *testing.T, dc *mockDockerClient, cfg *confi
 // startFakeUpstream starts a minimal DNS server that answers every query with
 // the given rcode and, on success, the provided IP.
 func startFakeUpstream(t *testing.T, answerIP string, rcode int) string {
+	t.Helper()
+	addr, _ := startCountingUpstream(t, answerIP, rcode)
+	return addr
+}
+
+// startCountingUpstream is like startFakeUpstream but also returns a counter
+// of the queries the upstream has received.
+func startCountingUpstream(t *testing.T, answerIP string, rcode int) (string, *atomic.Int64) {
+	t.Helper()
+	var count atomic.Int64
+	return startUpstream(t, fakeUpstreamHandler(answerIP, rcode, &count)), &count
+}
+
+// startUpstream serves h over UDP on a random loopback port.
+func startUpstream(t *testing.T, h dns.Handler) string {
 	t.Helper()
 	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
 	if err != nil {
@@ -112,8 +175,23 @@ func startFakeUpstream(t *testing.T, answerIP string, rcode int) string {
 	}
 	addr := pc.LocalAddr().String()
 
-	mux := dns.NewServeMux()
-	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+	srv := &dns.Server{PacketConn: pc, Net: "udp", Handler: h}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return addr
+}
+
+// fakeUpstreamHandler answers every query with rcode and, on success, an A
+// record for answerIP. count, when non-nil, tracks the queries received.
+func fakeUpstreamHandler(answerIP string, rcode int, count *atomic.Int64) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if count != nil {
+			count.Add(1)
+		}
 		resp := new(dns.Msg)
 		resp.SetReply(req)
 		resp.Rcode = rcode
@@ -130,17 +208,166 @@ func startFakeUpstream(t *testing.T, answerIP string, rcode int) string {
 		}
 		_ = w.WriteMsg(resp)
 	})
+}
+
+// testPKI is a throwaway CA and a server certificate it issued for
+// "dns.test" and 127.0.0.1.
+type testPKI struct {
+	caFile    string // PEM path, suitable for Config.UpstreamCA
+	certFile  string // PEM server certificate, e.g. for Config.DoHCert
+	keyFile   string // PEM server key, e.g. for Config.DoHKey
+	serverTLS *tls.Config
+	ca        *x509.Certificate
+	caKey     *ecdsa.PrivateKey
+}
+
+// clientCert issues a client certificate for mutual TLS.
+func (p *testPKI) clientCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating client key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "ci-runner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatalf("creating client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating CA key: %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "docker-dns test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating server key: %v", err)
+	}
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, caCert, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating server certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatalf("encoding server key: %v", err)
+	}
+	dir := t.TempDir()
+	pki := &testPKI{
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "server.pem"),
+		keyFile:  filepath.Join(dir, "server.key"),
+		ca:       caCert,
+		caKey:    caKey,
+	}
+	for path, block := range map[string]*pem.Block{
+		pki.caFile:   {Type: "CERTIFICATE", Bytes: caDER},
+		pki.certFile: {Type: "CERTIFICATE", Bytes: leafDER},
+		pki.keyFile:  {Type: "PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	pki.serverTLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leafDER}, PrivateKey: leafKey}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return pki
+}
+
+// countingListener counts accepted connections.
+type countingListener struct {
+	net.Listener
+	accepts atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepts.Add(1)
+	}
+	return c, err
+}
+
+// startTLSUpstream starts a DNS-over-TLS stand-in answering with answerIP and
+// returns its address and a counter of accepted connections.
+func startTLSUpstream(t *testing.T, pki *testPKI, answerIP string) (string, *atomic.Int64) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("bind TLS upstream: %v", err)
+	}
+	cl := &countingListener{Listener: ln}
 
-	srv := &dns.Server{PacketConn: pc, Net: "udp", Handler: mux}
+	srv := &dns.Server{
+		Listener: tls.NewListener(cl, pki.serverTLS),
+		Net:      "tcp-tls",
+		Handler:  fakeUpstreamHandler(answerIP, dns.RcodeSuccess, nil),
+	}
 	started := make(chan struct{})
 	srv.NotifyStartedFunc = func() { close(started) }
 	go func() { _ = srv.ActivateAndServe() }()
 	<-started
 	t.Cleanup(func() { _ = srv.Shutdown() })
 
+	return ln.Addr().String(), &cl.accepts
+}
+
+// deadUpstream returns a loopback address with nothing listening on it, so
+// UDP exchanges fail fast with "connection refused".
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	_ = pc.Close()
 	return addr
 }
 
+// discardLogger returns a logger that drops everything, for unit tests that
+// exercise components directly.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
 // queryDNS sends a single DNS query and returns the response.
 func queryDNS(t *testing.T, addr, domain string, qtype uint16) *dns.Msg {
 	t.Helper()
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+const (
+	// streamMaxIdle caps the idle connections kept per stream upstream.
+	streamMaxIdle = 4
+	// streamIdleTimeout discards pooled connections the upstream has most
+	// likely closed already (RFC 7766 suggests servers wait ~10s).
+	streamIdleTimeout = 10 * time.Second
+)
+
+// transport performs a single DNS exchange with one upstream.
+type transport interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// transportOptions carries the settings shared by every upstream transport.
+type transportOptions struct {
+	timeout time.Duration
+	// roots verifies encrypted upstreams; nil means the system roots.
+	roots *x509.CertPool
+	// dialer resolves upstream host names through the bootstrap resolvers.
+	dialer    *net.Dialer
+	dohMethod string
+	// forceTCP sends plain-DNS upstream queries over TCP only.
+	forceTCP bool
+}
+
+func newTransportOptions(cfg *config.Config) (transportOptions, error) {
+	roots, err := loadCertPool(cfg.UpstreamCA)
+	if err != nil {
+		return transportOptions{}, err
+	}
+	var bootstrap []string
+	for _, b := range cfg.BootstrapResolvers {
+		addr, err := config.ParseBootstrap(b)
+		if err != nil {
+			return transportOptions{}, err
+		}
+		bootstrap = append(bootstrap, addr)
+	}
+	return transportOptions{
+		timeout:   cfg.ForwardTimeout,
+		roots:     roots,
+		dialer:    newBootstrapDialer(bootstrap, cfg.ForwardTimeout),
+		dohMethod: cfg.DoHMethod,
+		forceTCP:  cfg.ForceTCP,
+	}, nil
+}
+
+// newTransport builds the transport for a parsed resolver specification.
+func newTransport(r config.Resolver, opts transportOptions) transport {
+	switch r.Proto {
+	case config.ProtoTLS:
+		return newStreamTransport(r.Addr, &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   opts.timeout,
+			Dialer:    opts.dialer,
+			TLSConfig: opts.tlsConfig(r.ServerName),
+		})
+	case config.ProtoHTTPS:
+		return newHTTPSTransport(r, opts)
+	case config.ProtoQUIC:
+		return newQUICTransport(r, opts)
+	default:
+		if opts.forceTCP {
+			return newStreamTransport(r.Addr, &dns.Client{Net: "tcp", Timeout: opts.timeout})
+		}
+		return newUDPTransport(r.Addr, opts.timeout)
+	}
+}
+
+func (o transportOptions) tlsConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		RootCAs:    o.roots,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// loadCertPool reads a PEM bundle for verifying upstream certificates. An
+// empty path returns nil so the system roots are used.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// newBootstrapDialer returns a dialer whose host-name lookups go to the
+// given plain-DNS servers (host:port) in turn instead of the system resolver,
+// which may well be docker-dns itself.
+func newBootstrapDialer(servers []string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout}
+	if len(servers) == 0 {
+		return d
+	}
+	var next atomic.Uint64
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			addr := servers[(next.Add(1)-1)%uint64(len(servers))]
+			var bd net.Dialer
+			return bd.DialContext(ctx, network, addr)
+		},
+	}
+	return d
+}
+
+// udpTransport is the classic plain-DNS transport on port 53. Truncated
+// (TC=1) answers are retried over pooled TCP connections (RFC 7766 §5).
+type udpTransport struct {
+	addr    string
+	timeout time.Duration
+	tcp     *streamTransport
+}
+
+func newUDPTransport(addr string, timeout time.Duration) *udpTransport {
+	return &udpTransport{
+		addr:    addr,
+		timeout: timeout,
+		tcp:     newStreamTransport(addr, &dns.Client{Net: "tcp", Timeout: timeout}),
+	}
+}
+
+func (t *udpTransport) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: t.timeout}
+	resp, _, err := c.ExchangeContext(ctx, m, t.addr)
+	if resp == nil || !resp.Truncated {
+		return resp, err
+	}
+	if resp, err = t.tcp.Exchange(ctx, m); err != nil {
+		return nil, fmt.Errorf("retrying truncated answer over TCP: %w", err)
+	}
+	return resp, nil
+}
+
+// Close drops the idle TCP connections used for truncated answers.
+func (t *udpTransport) Close() error {
+	return t.tcp.Close()
+}
+
+// pooledConn is an idle stream connection waiting for reuse.
+type pooledConn struct {
+	conn      *dns.Conn
+	idleSince time.Time
+}
+
+// streamTransport exchanges messages over pooled stream connections (TCP or
+// TLS). Each connection carries one query at a time and is returned to the
+// pool afterwards, so steady traffic reuses established TLS sessions.
+type streamTransport struct {
+	addr   string
+	client *dns.Client
+	idle   chan pooledConn
+	closed atomic.Bool
+}
+
+func newStreamTransport(addr string, c *dns.Client) *streamTransport {
+	return &streamTransport{addr: addr, client: c, idle: make(chan pooledConn, streamMaxIdle)}
+}
+
+func (t *streamTransport) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	if co := t.get(); co != nil {
+		resp, _, err := t.client.ExchangeWithConnContext(ctx, m, co)
+		if err == nil {
+			t.put(co)
+			return resp, nil
+		}
+		_ = co.Close()
+		// The upstream may have closed the idle connection; retry once on a
+		// fresh one while the deadline allows.
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	co, err := t.client.DialContext(ctx, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := t.client.ExchangeWithConnContext(ctx, m, co)
+	if err != nil {
+		_ = co.Close()
+		return nil, err
+	}
+	t.put(co)
+	return resp, nil
+}
+
+// get returns a pooled connection that is still fresh, or nil.
+func (t *streamTransport) get() *dns.Conn {
+	for {
+		select {
+		case pc := <-t.idle:
+			if time.Since(pc.idleSince) < streamIdleTimeout {
+				return pc.conn
+			}
+			_ = pc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// put returns co to the pool, closing it when the pool is full or the
+// transport has been closed.
+func (t *streamTransport) put(co *dns.Conn) {
+	if t.closed.Load() {
+		_ = co.Close()
+		return
+	}
+	select {
+	case t.idle <- pooledConn{conn: co, idleSince: time.Now()}:
+	default:
+		_ = co.Close()
+	}
+}
+
+// Close drops all idle connections; connections still in use are closed
+// when their exchange completes.
+func (t *streamTransport) Close() error {
+	t.closed.Store(true)
+	for {
+		select {
+		case pc := <-t.idle:
+			_ = pc.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
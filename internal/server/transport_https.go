@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the RFC 8484 wire-format content type.
+const dohMediaType = "application/dns-message"
+
+// httpsTransport speaks DNS over HTTPS (RFC 8484). The underlying
+// http.Transport negotiates HTTP/2 and multiplexes queries over one
+// connection per upstream.
+type httpsTransport struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func newHTTPSTransport(r config.Resolver, opts transportOptions) *httpsTransport {
+	tr := &http.Transport{
+		DialContext:         opts.dialer.DialContext,
+		TLSClientConfig:     opts.tlsConfig(r.ServerName),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: streamMaxIdle,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: opts.timeout,
+	}
+	// config.ParseResolver has already parsed the URL successfully.
+	u, _ := url.Parse(r.URL)
+	return &httpsTransport{
+		url:    u,
+		method: opts.dohMethod,
+		client: &http.Client{Transport: tr, Timeout: opts.timeout},
+	}
+}
+
+func (t *httpsTransport) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 §4.1: use ID 0 so that identical queries are HTTP-cacheable.
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing query: %w", err)
+	}
+
+	var req *http.Request
+	if t.method == http.MethodGet {
+		// Keep any query string of the endpoint, e.g. a templated one.
+		u := *t.url
+		params := u.Query()
+		params.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+		u.RawQuery = params.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.url.String(), bytes.NewReader(packed))
+		if req != nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH status %s", httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading DoH response: %w", err)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpacking DoH response: %w", err)
+	}
+	resp.Id = m.Id
+	return resp, nil
+}
+
+// Close releases idle HTTP connections.
+func (t *httpsTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// dohUpstream is a fake RFC 8484 server backed by fakeUpstreamHandler.
+type dohUpstream struct {
+	url   string
+	conns atomic.Int64
+
+	mu      sync.Mutex
+	methods []string
+	protos  []int
+	ids     []uint16
+	queries []url.Values
+}
+
+func startDoHUpstream(t *testing.T, pki *testPKI, answerIP string) *dohUpstream {
+	t.Helper()
+	u := &dohUpstream{}
+	handler := fakeUpstreamHandler(answerIP, dns.RcodeSuccess, nil)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wire []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = io.ReadAll(r.Body)
+		}
+		req := new(dns.Msg)
+		if err != nil || req.Unpack(wire) != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+
+		u.mu.Lock()
+		u.methods = append(u.methods, r.Method)
+		u.protos = append(u.protos, r.ProtoMajor)
+		u.ids = append(u.ids, req.Id)
+		u.queries = append(u.queries, r.URL.Query())
+		u.mu.Unlock()
+
+		rw := &capturingWriter{}
+		handler.ServeDNS(rw, req)
+		packed, _ := rw.msg.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(packed)
+	}))
+	srv.EnableHTTP2 = true
+	srv.TLS = pki.serverTLS.Clone()
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			u.conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	u.url = srv.URL + "/dns-query"
+	return u
+}
+
+// capturingWriter is a dns.ResponseWriter that keeps the written message.
+type capturingWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *capturingWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+
+func TestHTTPSUpstream_POSTOverHTTP2(t *testing.T) {
+	pki := newTestPKI(t)
+	up := startDoHUpstream(t, pki, "5.6.7.8")
+
+	f := newTestForwarderWithCA(t, []string{up.url}, pki.caFile)
+	for i := 0; i < 3; i++ {
+		resp := forwardA(t, f, "example.com.")
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+			t.Fatalf("query %d: unexpected answer %v", i, resp.Answer)
+		}
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	for i := range up.methods {
+		if up.methods[i] != http.MethodPost || up.protos[i] != 2 {
+			t.Errorf("request %d: got %s over HTTP/%d, want POST over HTTP/2", i, up.methods[i], up.protos[i])
+		}
+		if up.ids[i] != 0 {
+			t.Errorf("request %d: message ID %d on the wire, want 0", i, up.ids[i])
+		}
+	}
+	if n := up.conns.Load(); n != 1 {
+		t.Errorf("expected queries to share one connection, got %d", n)
+	}
+}
+
+func TestHTTPSUpstream_GETRestoresID(t *testing.T) {
+	pki := newTestPKI(t)
+	up := startDoHUpstream(t, pki, "5.6.7.8")
+
+	cfg := defaultTestConfig()
+	cfg.UpstreamCA = pki.caFile
+	cfg.DoHMethod = http.MethodGet
+	opts, err := newTransportOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := config.ParseResolver(up.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTransport(r, opts)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 4242
+	resp, err := tr.Exchange(t.Context(), req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if resp.Id != 4242 {
+		t.Errorf("response ID = %d, want the query's 4242", resp.Id)
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if len(up.methods) != 1 || up.methods[0] != http.MethodGet {
+		t.Errorf("expected one GET request, got %v", up.methods)
+	}
+}
+
+func TestHTTPSUpstream_GETKeepsEndpointQuery(t *testing.T) {
+	pki := newTestPKI(t)
+	up := startDoHUpstream(t, pki, "5.6.7.8")
+
+	cfg := defaultTestConfig()
+	cfg.UpstreamCA = pki.caFile
+	cfg.DoHMethod = http.MethodGet
+	opts, err := newTransportOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := config.ParseResolver(up.url + "?tenant=home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := newTransport(r, opts).Exchange(t.Context(), req); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if len(up.queries) != 1 || up.queries[0].Get("tenant") != "home" || up.queries[0].Get("dns") == "" {
+		t.Errorf("query parameters = %v, want tenant=home and dns", up.queries)
+	}
+}
+
+func TestHTTPSUpstream_ResolvesHostThroughBootstrap(t *testing.T) {
+	pki := newTestPKI(t)
+	up := startDoHUpstream(t, pki, "5.6.7.8")
+	// The bootstrap resolver maps every name, including dns.test, to loopback.
+	bootstrap, lookups := startCountingUpstream(t, "127.0.0.1", dns.RcodeSuccess)
+
+	cfg := defaultTestConfig()
+	cfg.UpstreamCA = pki.caFile
+	cfg.BootstrapResolvers = []string{bootstrap}
+	url := strings.Replace(up.url, "127.0.0.1", "dns.test", 1)
+	f, err := newForwarder([]string{url}, cfg, discardLogger(), newMetrics())
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+
+	if resp := forwardA(t, f, "example.com."); len(resp.Answer) != 1 {
+		t.Fatalf("expected one answer, got %v", resp.Answer)
+	}
+	if lookups.Load() == 0 {
+		t.Error("expected the upstream host name to be resolved through the bootstrap resolver")
+	}
+}
+
+func TestHTTPSUpstream_RejectsNon200(t *testing.T) {
+	pki := newTestPKI(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	srv.TLS = pki.serverTLS.Clone()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	f := newTestForwarderWithCA(t, []string{srv.URL + "/dns-query"}, pki.caFile)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := f.Forward(t.Context(), req); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("expected an HTTP status error, got %v", err)
+	}
+}
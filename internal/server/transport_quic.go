@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// doqALPN is the TLS application protocol for DNS over QUIC (RFC 9250 §4.1).
+	doqALPN = "doq"
+	// doqNoError is the DOQ_NO_ERROR application error code.
+	doqNoError = 0
+	// quicIdleTimeout is how long an unused QUIC connection is kept open.
+	quicIdleTimeout = 30 * time.Second
+)
+
+// quicTransport speaks DNS over QUIC (RFC 9250). Queries share one QUIC
+// connection, each on its own bidirectional stream; the connection is redialled
+// when it dies. TLS session tickets are cached so that reconnects can resume
+// with 0-RTT.
+type quicTransport struct {
+	addr     string
+	tlsConf  *tls.Config
+	quicConf *quic.Config
+	resolver *net.Resolver // resolves host names via the bootstrap resolvers
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+func newQUICTransport(r config.Resolver, opts transportOptions) *quicTransport {
+	tlsConf := opts.tlsConfig(r.ServerName)
+	tlsConf.MinVersion = tls.VersionTLS13 // QUIC requires TLS 1.3
+	tlsConf.NextProtos = []string{doqALPN}
+	tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	resolver := opts.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &quicTransport{
+		addr:     r.Addr,
+		tlsConf:  tlsConf,
+		quicConf: &quic.Config{HandshakeIdleTimeout: opts.timeout, MaxIdleTimeout: quicIdleTimeout},
+		resolver: resolver,
+	}
+}
+
+func (t *quicTransport) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := t.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.exchange(ctx, conn, m)
+	if err == nil || !reused || ctx.Err() != nil {
+		return resp, err
+	}
+
+	// The cached connection may have been closed by the upstream; retry once
+	// on a fresh one.
+	t.drop(conn)
+	if conn, _, err = t.connection(ctx); err != nil {
+		return nil, err
+	}
+	return t.exchange(ctx, conn, m)
+}
+
+// connection returns the live shared connection, dialling one if needed.
+// reused reports whether the connection existed before this call.
+func (t *quicTransport) connection(ctx context.Context) (conn *quic.Conn, reused bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, true, nil
+	}
+
+	addr, err := t.resolve(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err = quic.DialAddrEarly(ctx, addr, t.tlsConf, t.quicConf)
+	if err != nil {
+		return nil, false, err
+	}
+	t.conn = conn
+	return conn, false, nil
+}
+
+// resolve turns t.addr into an IP:port, looking host names up through the
+// bootstrap resolvers.
+func (t *quicTransport) resolve(ctx context.Context) (string, error) {
+	host, port, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return t.addr, nil
+	}
+	ips, err := t.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	return net.JoinHostPort(ips[0].Unmap().String(), port), nil
+}
+
+// drop closes conn if it is still the shared connection.
+func (t *quicTransport) drop(conn *quic.Conn) {
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mu.Unlock()
+	_ = conn.CloseWithError(doqNoError, "")
+}
+
+// exchange sends m on a new stream of conn and reads the reply.
+func (t *quicTransport) exchange(ctx context.Context, conn *quic.Conn, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 9250 §4.2.1: the message ID must be 0 on the wire.
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing query: %w", err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	// Each message carries a 2-byte length prefix, as over TCP. Closing the
+	// stream sends FIN, telling the server no further queries follow.
+	buf := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	copy(buf[2:], packed)
+	if _, err := stream.Write(buf); err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, err
+	}
+	_ = stream.Close()
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, fmt.Errorf("reading DoQ response: %w", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, fmt.Errorf("reading DoQ response: %w", err)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpacking DoQ response: %w", err)
+	}
+	resp.Id = m.Id
+	return resp, nil
+}
+
+// Close closes the shared connection, if any.
+func (t *quicTransport) Close() error {
+	t.mu.Lock()
+	conn := t.conn
+	t.conn = nil
+	t.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if err := conn.CloseWithError(doqNoError, ""); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
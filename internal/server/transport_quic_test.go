@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqUpstream is a local RFC 9250 stand-in backed by fakeUpstreamHandler.
+type doqUpstream struct {
+	addr  string
+	conns atomic.Int64
+	// oneShot makes the server close a connection instead of answering a
+	// second query on it, as if it had dropped the connection while idle.
+	oneShot atomic.Bool
+
+	mu  sync.Mutex
+	ids []uint16
+}
+
+func startDoQUpstream(t *testing.T, pki *testPKI, answerIP string) *doqUpstream {
+	t.Helper()
+	tlsConf := pki.serverTLS.Clone()
+	tlsConf.NextProtos = []string{doqALPN}
+	ln, err := quic.ListenAddr("127.0.0.1:0", tlsConf, nil)
+	if err != nil {
+		t.Fatalf("listen QUIC: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	u := &doqUpstream{addr: ln.Addr().String()}
+	handler := fakeUpstreamHandler(answerIP, dns.RcodeSuccess, nil)
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			u.conns.Add(1)
+			go u.serveConn(conn, handler)
+		}
+	}()
+	return u
+}
+
+func (u *doqUpstream) serveConn(conn *quic.Conn, handler dns.Handler) {
+	for answered := false; ; answered = true {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		if answered && u.oneShot.Load() {
+			_ = conn.CloseWithError(doqNoError, "")
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(stream, length[:]); err != nil {
+			return
+		}
+		wire := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(stream, wire); err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(wire); err != nil {
+			return
+		}
+		u.mu.Lock()
+		u.ids = append(u.ids, req.Id)
+		u.mu.Unlock()
+
+		rw := &capturingWriter{}
+		handler.ServeDNS(rw, req)
+		packed, _ := rw.msg.Pack()
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+		_, _ = stream.Write(append(out, packed...))
+		_ = stream.Close()
+	}
+}
+
+func TestQUICUpstream_ResolvesAndReusesConnection(t *testing.T) {
+	pki := newTestPKI(t)
+	up := startDoQUpstream(t, pki, "5.6.7.8")
+
+	cfg := defaultTestConfig()
+	cfg.UpstreamCA = pki.caFile
+	cfg.Resolvers = []string{"quic://" + up.addr + "@dns.test"}
+	srv := newTestServer(t, noopDocker(), cfg)
+	dnsAddr := serveTestDNS(t, srv)
+
+	for i := 0; i < 5; i++ {
+		resp := queryDNS(t, dnsAddr, "example.com.", dns.TypeA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: expected one answer, got rcode=%s answers=%d",
+				i, dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		}
+		if a := resp.Answer[0].(*dns.A); a.A.String() != "5.6.7.8" {
+			t.Errorf("query %d: got %s, want 5.6.7.8", i, a.A)
+		}
+	}
+	if n := up.conns.Load(); n != 1 {
+		t.Errorf("expected queries to share one QUIC connection, got %d", n)
+	}
+
+	up.mu.Lock()
+	for i, id := range up.ids {
+		if id != 0 {
+			t.Errorf("query %d: message ID %d on the wire, want 0", i, id)
+		}
+	}
+	up.mu.Unlock()
+
+	label := "quic://" + up.addr + "@dns.test"
+	if n := srv.metrics.UpstreamResponses.Get(label, "NOERROR"); n != 5 {
+		t.Errorf("upstream NOERROR count for %s = %d, want 5", label, n)
+	}
+}
+
+func TestQUICUpstream_RedialsClosedConnection(t *testing.T) {
+	pki := newTestPKI(t)
+	up := startDoQUpstream(t, pki, "5.6.7.8")
+	up.oneShot.Store(true)
+
+	f := newTestForwarderWithCA(t, []string{"quic://" + up.addr + "@dns.test"}, pki.caFile)
+	for i := 0; i < 3; i++ {
+		if resp := forwardA(t, f, "example.com."); len(resp.Answer) != 1 {
+			t.Fatalf("query %d: expected one answer, got %v", i, resp.Answer)
+		}
+	}
+	if n := up.conns.Load(); n < 2 {
+		t.Errorf("expected the client to redial after the server closed, got %d connections", n)
+	}
+}
+
+func TestQUICUpstream_RejectsUntrustedCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	up := startDoQUpstream(t, pki, "5.6.7.8")
+
+	other := newTestPKI(t)
+	f := newTestForwarderWithCA(t, []string{"quic://" + up.addr + "@dns.test"}, other.caFile)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := f.Forward(t.Context(), req); err == nil {
+		t.Fatal("expected certificate verification to fail")
+	}
+}
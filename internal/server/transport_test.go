@@ -0,0 +1,195 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/medunes/docker-dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestTLSUpstream_ResolvesAndReusesConnections(t *testing.T) {
+	pki := newTestPKI(t)
+	addr, accepts := startTLSUpstream(t, pki, "5.6.7.8")
+
+	cfg := defaultTestConfig()
+	cfg.UpstreamCA = pki.caFile
+	cfg.Resolvers = []string{"tls://" + addr + "@dns.test"}
+	dnsAddr := startTestDNSServerWithConfig(t, noopDocker(), cfg)
+
+	for i := 0; i < 5; i++ {
+		resp := queryDNS(t, dnsAddr, "example.com.", dns.TypeA)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: expected one answer, got rcode=%s answers=%d",
+				i, dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		}
+		if a := resp.Answer[0].(*dns.A); a.A.String() != "5.6.7.8" {
+			t.Errorf("query %d: got %s, want 5.6.7.8", i, a.A)
+		}
+	}
+	if n := accepts.Load(); n != 1 {
+		t.Errorf("expected sequential queries to reuse one TLS connection, got %d connections", n)
+	}
+}
+
+func TestTLSUpstream_VerifiesIPSANWithoutServerName(t *testing.T) {
+	pki := newTestPKI(t)
+	addr, _ := startTLSUpstream(t, pki, "5.6.7.8")
+
+	f := newTestForwarderWithCA(t, []string{"tls://" + addr}, pki.caFile)
+	if resp := forwardA(t, f, "example.com."); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected NOERROR, got %s", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestTLSUpstream_RejectsUntrustedCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	addr, _ := startTLSUpstream(t, pki, "5.6.7.8")
+
+	// A different CA must not be able to vouch for the upstream.
+	other := newTestPKI(t)
+	f := newTestForwarderWithCA(t, []string{"tls://" + addr + "@dns.test"}, other.caFile)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := f.Forward(t.Context(), req); err == nil {
+		t.Fatal("expected certificate verification to fail")
+	}
+}
+
+func TestTLSUpstream_RejectsWrongServerName(t *testing.T) {
+	pki := newTestPKI(t)
+	addr, _ := startTLSUpstream(t, pki, "5.6.7.8")
+
+	f := newTestForwarderWithCA(t, []string{"tls://" + addr + "@other.test"}, pki.caFile)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := f.Forward(t.Context(), req); err == nil {
+		t.Fatal("expected server name verification to fail")
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	if pool, err := loadCertPool(""); pool != nil || err != nil {
+		t.Errorf("empty path should select system roots, got %v, %v", pool, err)
+	}
+	if _, err := loadCertPool("/nonexistent/ca.pem"); err == nil {
+		t.Error("expected error for missing CA file")
+	}
+	if pool, err := loadCertPool(newTestPKI(t).caFile); pool == nil || err != nil {
+		t.Errorf("expected a pool from a valid PEM file, got %v, %v", pool, err)
+	}
+}
+
+func newTestForwarderWithCA(t *testing.T, resolvers []string, caFile string) *Forwarder {
+	t.Helper()
+	cfg := defaultTestConfig()
+	cfg.UpstreamCA = caFile
+	f, err := newForwarder(resolvers, cfg, discardLogger(), newMetrics())
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	return f
+}
+
+// startDualUpstream serves handler over UDP and TCP on the same loopback
+// port. udpAnswerTruncated makes UDP replies empty with TC=1, as a server
+// would for answers exceeding the UDP payload size.
+func startDualUpstream(t *testing.T, answerIP string, udpAnswerTruncated bool) (addr string, udpQueries, tcpConns *atomic.Int64) {
+	t.Helper()
+	udpQueries = new(atomic.Int64)
+	full := fakeUpstreamHandler(answerIP, dns.RcodeSuccess, nil)
+	udpHandler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		udpQueries.Add(1)
+		if !udpAnswerTruncated {
+			full.ServeDNS(w, req)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Truncated = true
+		_ = w.WriteMsg(resp)
+	})
+
+	// Grab a UDP port, then the TCP port with the same number; retry on the
+	// rare collision with another listener.
+	for attempt := 0; ; attempt++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("bind udp: %v", err)
+		}
+		addr = pc.LocalAddr().String()
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			_ = pc.Close()
+			if attempt < 10 {
+				continue
+			}
+			t.Fatalf("bind tcp: %v", err)
+		}
+		cl := &countingListener{Listener: ln}
+		tcpConns = &cl.accepts
+
+		for _, srv := range []*dns.Server{
+			{PacketConn: pc, Net: "udp", Handler: udpHandler},
+			{Listener: cl, Net: "tcp", Handler: full},
+		} {
+			started := make(chan struct{})
+			srv.NotifyStartedFunc = func() { close(started) }
+			go func() { _ = srv.ActivateAndServe() }()
+			<-started
+			t.Cleanup(func() { _ = srv.Shutdown() })
+		}
+		return addr, udpQueries, tcpConns
+	}
+}
+
+func TestUDPUpstream_RetriesTruncatedOverTCP(t *testing.T) {
+	addr, udpQueries, tcpConns := startDualUpstream(t, "5.6.7.8", true)
+
+	f := newTestForwarder(t, []string{addr}, config.StrategyParallel)
+	for i := 0; i < 3; i++ {
+		resp := forwardA(t, f, "big.example.")
+		if resp.Truncated || len(resp.Answer) != 1 {
+			t.Fatalf("query %d: expected the full answer over TCP, got TC=%v answers=%d", i, resp.Truncated, len(resp.Answer))
+		}
+	}
+	if n := udpQueries.Load(); n != 3 {
+		t.Errorf("expected every query to try UDP first, got %d UDP queries", n)
+	}
+	if n := tcpConns.Load(); n != 1 {
+		t.Errorf("expected TCP retries to share one pooled connection, got %d", n)
+	}
+}
+
+func TestUDPUpstream_UntruncatedStaysOnUDP(t *testing.T) {
+	addr, udpQueries, tcpConns := startDualUpstream(t, "5.6.7.8", false)
+
+	f := newTestForwarder(t, []string{addr}, config.StrategyParallel)
+	if resp := forwardA(t, f, "small.example."); len(resp.Answer) != 1 {
+		t.Fatalf("expected one answer, got %v", resp.Answer)
+	}
+	if udpQueries.Load() != 1 || tcpConns.Load() != 0 {
+		t.Errorf("expected one UDP query and no TCP, got udp=%d tcp=%d", udpQueries.Load(), tcpConns.Load())
+	}
+}
+
+func TestForceTCP(t *testing.T) {
+	addr, udpQueries, tcpConns := startDualUpstream(t, "5.6.7.8", false)
+
+	cfg := defaultTestConfig()
+	cfg.ForceTCP = true
+	f, err := newForwarder([]string{addr}, cfg, discardLogger(), newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if resp := forwardA(t, f, "example.com."); len(resp.Answer) != 1 {
+			t.Fatalf("query %d: expected one answer, got %v", i, resp.Answer)
+		}
+	}
+	if udpQueries.Load() != 0 || tcpConns.Load() != 1 {
+		t.Errorf("expected TCP only over one connection, got udp=%d tcp=%d", udpQueries.Load(), tcpConns.Load())
+	}
+}
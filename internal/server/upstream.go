@@ -0,0 +1,178 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/config"
+)
+
+const (
+	// upstreamFailThreshold is the number of consecutive failures after which
+	// an upstream is taken out of rotation.
+	upstreamFailThreshold = 3
+	// upstreamMinBackoff and upstreamMaxBackoff bound the delay before an
+	// unhealthy upstream is re-probed; the delay doubles on every failed probe.
+	upstreamMinBackoff = time.Second
+	upstreamMaxBackoff = time.Minute
+	// upstreamEWMAWeight is the weight of the newest sample in the RTT and
+	// failure-rate moving averages.
+	upstreamEWMAWeight = 0.3
+	// upstreamProbeInterval is how often the prober looks for due upstreams.
+	upstreamProbeInterval = 500 * time.Millisecond
+)
+
+// upstream is a single resolver together with its health statistics.
+type upstream struct {
+	addr      string // label used in logs and metrics
+	transport transport
+
+	mu                  sync.Mutex
+	rtt                 time.Duration // moving average of successful exchanges
+	failRate            float64       // moving average of failures in [0, 1]
+	consecutiveFailures int
+	unhealthy           bool
+	probing             bool
+	nextProbe           time.Time
+	backoff             time.Duration
+}
+
+// UpstreamStatus is a snapshot of an upstream's health, used by the metrics
+// endpoints.
+type UpstreamStatus struct {
+	Addr                string  `json:"addr"`
+	Healthy             bool    `json:"healthy"`
+	RTTSeconds          float64 `json:"rtt_seconds"`
+	FailureRate         float64 `json:"failure_rate"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+}
+
+func newUpstream(addr string, t transport) *upstream {
+	return &upstream{addr: addr, transport: t, backoff: upstreamMinBackoff}
+}
+
+// upstreamSet hands out one upstream per distinct resolver, so resolver groups
+// that share a server also share its connections and health state. It is not
+// safe for concurrent use.
+type upstreamSet struct {
+	opts   transportOptions
+	byAddr map[string]*upstream
+}
+
+func newUpstreamSet(opts transportOptions) *upstreamSet {
+	return &upstreamSet{opts: opts, byAddr: make(map[string]*upstream)}
+}
+
+// get returns the upstream for a resolver specification, creating it on
+// first use.
+func (s *upstreamSet) get(spec string) (*upstream, error) {
+	r, err := config.ParseResolver(spec)
+	if err != nil {
+		return nil, err
+	}
+	// The label names the verified server too, so resolvers dialling the
+	// same address under different names get their own transports.
+	addr := r.String()
+	if u, ok := s.byAddr[addr]; ok {
+		return u, nil
+	}
+	u := newUpstream(addr, newTransport(r, s.opts))
+	s.byAddr[addr] = u
+	return u, nil
+}
+
+// prune forgets every upstream not in keep and returns the removed ones.
+func (s *upstreamSet) prune(keep map[*upstream]bool) []*upstream {
+	var removed []*upstream
+	for addr, u := range s.byAddr {
+		if !keep[u] {
+			delete(s.byAddr, addr)
+			removed = append(removed, u)
+		}
+	}
+	return removed
+}
+
+// recordSuccess folds a successful exchange into the statistics and brings
+// the upstream back into rotation. It returns true when the upstream was
+// previously unhealthy.
+func (u *upstream) recordSuccess(rtt time.Duration) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	recovered := u.unhealthy
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = time.Duration(upstreamEWMAWeight*float64(rtt) + (1-upstreamEWMAWeight)*float64(u.rtt))
+	}
+	u.failRate *= 1 - upstreamEWMAWeight
+	u.consecutiveFailures = 0
+	u.unhealthy = false
+	u.backoff = upstreamMinBackoff
+	return recovered
+}
+
+// recordFailure folds a failed exchange into the statistics. It returns true
+// when this failure took the upstream out of rotation.
+func (u *upstream) recordFailure(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failRate = upstreamEWMAWeight + (1-upstreamEWMAWeight)*u.failRate
+	u.consecutiveFailures++
+	if u.unhealthy {
+		// A failed probe: back off further before the next one.
+		u.backoff = min(2*u.backoff, upstreamMaxBackoff)
+		u.nextProbe = now.Add(u.backoff)
+		return false
+	}
+	if u.consecutiveFailures >= upstreamFailThreshold {
+		u.unhealthy = true
+		u.nextProbe = now.Add(u.backoff)
+		return true
+	}
+	return false
+}
+
+func (u *upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.unhealthy
+}
+
+// claimProbe reports whether an unhealthy upstream is due for a re-probe and,
+// if so, marks a probe as in flight so that only one runs at a time.
+func (u *upstream) claimProbe(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.unhealthy || u.probing || now.Before(u.nextProbe) {
+		return false
+	}
+	u.probing = true
+	return true
+}
+
+func (u *upstream) finishProbe() {
+	u.mu.Lock()
+	u.probing = false
+	u.mu.Unlock()
+}
+
+// score ranks upstreams for the fastest-first strategy; lower is better.
+// Upstreams without RTT samples score zero so they get measured early.
+func (u *upstream) score() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return float64(u.rtt) * (1 + 4*u.failRate)
+}
+
+func (u *upstream) status() UpstreamStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return UpstreamStatus{
+		Addr:                u.addr,
+		Healthy:             !u.unhealthy,
+		RTTSeconds:          u.rtt.Seconds(),
+		FailureRate:         u.failRate,
+		ConsecutiveFailures: u.consecutiveFailures,
+	}
+}
@@ -0,0 +1,636 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/medunes/docker-dns/internal/cache"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// security is the outcome of validating a response (RFC 4035 §4.3).
+type security int
+
+const (
+	secSecure   security = iota // signatures chain up to a trust anchor
+	secInsecure                 // provably unsigned, or under a negative trust anchor
+	secBogus                    // signatures missing, expired or invalid
+)
+
+func (s security) String() string {
+	switch s {
+	case secSecure:
+		return "secure"
+	case secInsecure:
+		return "insecure"
+	default:
+		return "bogus"
+	}
+}
+
+// rootAnchors are the IANA root zone KSK trust anchors (KSK-2017 and
+// KSK-2024), as published at https://data.iana.org/root-anchors/.
+var rootAnchors = []string{
+	". 0 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 0 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// chainCacheSize bounds each of the validator's caches of validated DS and
+// DNSKEY sets, whose TTLs are bounded by the records and their signatures.
+const chainCacheSize = 4096
+
+// Singleflight key prefixes for chain lookups.
+const (
+	dnssecDSPrefix  = "ds:"   // delegation status of a name
+	dnssecKeyPrefix = "keys:" // validated DNSKEY set of a zone
+)
+
+// Delegation statuses of a name.
+const (
+	dsSecure   = "secure"   // with the validated DS records
+	dsInsecure = "insecure" // provably unsigned delegation or parent
+	dsNoCut    = "nocut"    // not a zone cut: the name is inside its parent zone
+)
+
+// delegation is the DS status of a name with its validated DS records.
+type delegation struct {
+	status string
+	ds     []*dns.DS
+}
+
+// validationUDPSize is the EDNS0 payload size advertised on queries whose
+// answers carry signatures; larger answers are retried over TCP.
+const validationUDPSize = 1232
+
+// validationTimeout bounds the chain lookups made to validate one answer.
+const validationTimeout = 5 * time.Second
+
+// maxChainDepth bounds the nesting of delegation lookups.
+const maxChainDepth = 32
+
+// chainKey is the context key for the delegations being resolved.
+type chainKey struct{}
+
+// errBogus marks chain failures that make the data bogus rather than
+// unreachable.
+var errBogus = errors.New("bogus")
+
+// queryFunc fetches name/qtype from upstream with DO and CD set.
+type queryFunc func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+// validator checks forwarded answers against the DNSSEC chain of trust,
+// fetching DS and DNSKEY records through query as needed.
+type validator struct {
+	anchors []*dns.DS
+	ntas    []string // lower-case FQDNs below which validation is skipped
+	keys    *cache.LRU[[]*dns.DNSKEY]
+	dss     *cache.LRU[delegation]
+	query   queryFunc
+	log     *slog.Logger
+	sf      singleflight.Group
+	now     func() time.Time
+}
+
+func newValidator(ntas []string, query queryFunc, log *slog.Logger) *validator {
+	v := &validator{
+		keys:  cache.NewLRU[[]*dns.DNSKEY](chainCacheSize),
+		dss:   cache.NewLRU[delegation](chainCacheSize),
+		query: query,
+		log:   log,
+		now:   time.Now,
+	}
+	for _, s := range rootAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(fmt.Sprintf("bad built-in trust anchor %q: %v", s, err))
+		}
+		v.anchors = append(v.anchors, rr.(*dns.DS))
+	}
+	for _, n := range ntas {
+		v.ntas = append(v.ntas, dns.Fqdn(strings.ToLower(n)))
+	}
+	return v
+}
+
+// prepare returns the query to forward when the answer is to be validated:
+// DO requests signatures and CD asks the upstream to return data even if it
+// considers it bogus, so that the verdict is ours.
+func (v *validator) prepare(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	m.CheckingDisabled = true
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(validationUDPSize, true)
+	}
+	return m
+}
+
+// underNTA reports whether name is at or below a negative trust anchor.
+func (v *validator) underNTA(name string) bool {
+	for _, nta := range v.ntas {
+		if dns.IsSubDomain(nta, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate classifies resp, the upstream answer to qname/qtype. The string
+// explains a bogus verdict.
+func (v *validator) validate(ctx context.Context, qname string, qtype uint16, resp *dns.Msg) (security, string) {
+	qname = strings.ToLower(qname)
+	if v.underNTA(qname) {
+		return secInsecure, ""
+	}
+
+	result := secSecure
+	combine := func(s security) {
+		if s > result {
+			result = s
+		}
+	}
+
+	var expanded []*rrset
+	for _, set := range splitRRsets(resp.Answer) {
+		sec, why := v.verifyRRset(ctx, set)
+		if sec == secBogus {
+			return secBogus, why
+		}
+		combine(sec)
+		if set.wildcard > 0 {
+			expanded = append(expanded, set)
+		}
+	}
+	if len(expanded) > 0 {
+		// A wildcard expansion is only valid if the name itself does not
+		// exist (RFC 4035 §5.3.4), or the wildcard could hide real data.
+		proof, sec, why := v.denialRecords(ctx, resp)
+		if sec == secBogus {
+			return secBogus, why
+		}
+		for _, set := range expanded {
+			owner := set.rrs[0].Header().Name
+			if !proof.wildcardExpansion(owner, set.wildcard) {
+				return secBogus, fmt.Sprintf("wildcard answer for %s lacks proof that the name does not exist", owner)
+			}
+		}
+	}
+
+	target, answered := chaseCNAME(qname, qtype, resp.Answer)
+	if answered {
+		return result, ""
+	}
+	if v.underNTA(target) {
+		return secInsecure, ""
+	}
+
+	// Negative answer (NXDOMAIN or NODATA) for the end of the CNAME chain:
+	// the authority section must prove it.
+	sec, why := v.verifyDenial(ctx, target, qtype, resp)
+	if sec == secBogus {
+		return secBogus, why
+	}
+	combine(sec)
+	return result, ""
+}
+
+// verifyRRset checks one RRset against the keys of its signer. Unsigned sets
+// are acceptable only inside a provably insecure zone.
+func (v *validator) verifyRRset(ctx context.Context, set *rrset) (security, string) {
+	owner := set.rrs[0].Header().Name
+	rtype := dns.TypeToString[set.rrs[0].Header().Rrtype]
+
+	if len(set.sigs) == 0 {
+		// DS records live in the parent zone.
+		zone := owner
+		if set.rrs[0].Header().Rrtype == dns.TypeDS {
+			zone = parentZone(owner)
+		}
+		sec, why := v.nameSecurity(ctx, zone)
+		if sec == secSecure {
+			return secBogus, fmt.Sprintf("missing RRSIG for %s %s", owner, rtype)
+		}
+		return sec, why
+	}
+
+	why := fmt.Sprintf("no valid RRSIG for %s %s", owner, rtype)
+	for _, sig := range set.sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dns.IsSubDomain(signer, strings.ToLower(owner)) {
+			continue
+		}
+		if sig.TypeCovered == dns.TypeDS && strings.EqualFold(signer, owner) {
+			continue // a zone cannot vouch for its own delegation
+		}
+		keys, sec, err := v.zoneKeys(ctx, signer)
+		if sec == secInsecure {
+			return secInsecure, ""
+		}
+		if err != nil {
+			why = err.Error()
+			continue
+		}
+		if v.verifySig(sig, set.rrs, keys) {
+			if int(sig.Labels) < dns.CountLabel(owner) && !strings.HasPrefix(owner, "*.") {
+				set.wildcard = int(sig.Labels)
+			}
+			return secSecure, ""
+		}
+	}
+	return secBogus, why
+}
+
+// verifySig reports whether sig is currently valid and verifies rrs with
+// one of keys.
+func (v *validator) verifySig(sig *dns.RRSIG, rrs []dns.RR, keys []*dns.DNSKEY) bool {
+	if !sig.ValidityPeriod(v.now()) {
+		return false
+	}
+	for _, k := range keys {
+		if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, rrs) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneKeys returns the validated DNSKEY set of zone. It reports secInsecure
+// when the zone is provably unsigned.
+func (v *validator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, security, error) {
+	if v.underNTA(zone) {
+		return nil, secInsecure, nil
+	}
+	if keys, ok := v.keys.Get(zone); ok {
+		return keys, secSecure, nil
+	}
+
+	var anchors []*dns.DS
+	if zone == "." {
+		anchors = v.anchors
+	} else {
+		status, ds, err := v.delegationOf(ctx, zone)
+		if err != nil {
+			return nil, secBogus, err
+		}
+		switch status {
+		case dsInsecure:
+			return nil, secInsecure, nil
+		case dsNoCut:
+			return nil, secBogus, fmt.Errorf("%w: signer %s is not a zone", errBogus, zone)
+		}
+		anchors = ds
+	}
+
+	res, err := v.shared(ctx, dnssecKeyPrefix+zone, func() (any, error) {
+		return v.fetchKeys(ctx, zone, anchors)
+	})
+	if err != nil {
+		return nil, secBogus, err
+	}
+	return res.([]*dns.DNSKEY), secSecure, nil
+}
+
+// fetchKeys queries zone's DNSKEY set and accepts it if it is self-signed by
+// a key matching one of anchors.
+func (v *validator) fetchKeys(ctx context.Context, zone string, anchors []*dns.DS) ([]*dns.DNSKEY, error) {
+	resp, err := v.fetch(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var set *rrset
+	for _, s := range splitRRsets(resp.Answer) {
+		h := s.rrs[0].Header()
+		if h.Rrtype == dns.TypeDNSKEY && strings.EqualFold(h.Name, zone) {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, fmt.Errorf("%w: no DNSKEY for signed zone %s", errBogus, zone)
+	}
+
+	keys := make([]*dns.DNSKEY, 0, len(set.rrs))
+	for _, rr := range set.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	var trusted []*dns.DNSKEY
+	for _, k := range keys {
+		if matchesDS(k, anchors) {
+			trusted = append(trusted, k)
+		}
+	}
+	for _, sig := range set.sigs {
+		if v.verifySig(sig, set.rrs, trusted) {
+			v.keys.Set(zone, keys, v.ttl(set))
+			return keys, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: DNSKEY set of %s not signed by a key matching its DS", errBogus, zone)
+}
+
+// delegationOf returns the DS status of name: dsSecure with the validated
+// DS records, dsInsecure, or dsNoCut.
+func (v *validator) delegationOf(ctx context.Context, name string) (string, []*dns.DS, error) {
+	if d, ok := v.dss.Get(name); ok {
+		return d.status, d.ds, nil
+	}
+
+	// Resolving a delegation may need the delegations above it, but never
+	// itself again; a malicious answer could otherwise recurse forever (or
+	// deadlock on the singleflight key).
+	chain, _ := ctx.Value(chainKey{}).([]string)
+	if slices.Contains(chain, name) || len(chain) >= maxChainDepth {
+		return "", nil, fmt.Errorf("%w: delegation loop at %s", errBogus, name)
+	}
+	ctx = context.WithValue(ctx, chainKey{}, append(chain[:len(chain):len(chain)], name))
+	res, err := v.shared(ctx, dnssecDSPrefix+name, func() (any, error) {
+		status, ds, err := v.fetchDelegation(ctx, name)
+		return delegation{status, ds}, err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	d := res.(delegation)
+	return d.status, d.ds, nil
+}
+
+// shared runs fn once for concurrent callers with the same key. Waiting is
+// bounded by ctx, so that lookups depending on each other from different
+// queries cannot block forever.
+func (v *validator) shared(ctx context.Context, key string, fn func() (any, error)) (any, error) {
+	select {
+	case res := <-v.sf.DoChan(key, fn):
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchDelegation queries the DS records of name and classifies the answer.
+func (v *validator) fetchDelegation(ctx context.Context, name string) (string, []*dns.DS, error) {
+	resp, err := v.fetch(ctx, name, dns.TypeDS)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, set := range splitRRsets(resp.Answer) {
+		h := set.rrs[0].Header()
+		if h.Rrtype != dns.TypeDS || !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		sec, why := v.verifyRRset(ctx, set)
+		switch sec {
+		case secBogus:
+			return "", nil, fmt.Errorf("%w: %s", errBogus, why)
+		case secInsecure:
+			v.dss.Set(name, delegation{status: dsInsecure}, v.ttl(set))
+			return dsInsecure, nil, nil
+		}
+		ds := make([]*dns.DS, 0, len(set.rrs))
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		v.dss.Set(name, delegation{dsSecure, ds}, v.ttl(set))
+		return dsSecure, ds, nil
+	}
+
+	// No DS: the parent must prove it, and its NSEC records tell a delegation
+	// (NS present) from a name inside the parent zone.
+	proof, sec, why := v.denialRecords(ctx, resp)
+	if sec != secSecure {
+		if sec == secBogus {
+			return "", nil, fmt.Errorf("%w: %s", errBogus, why)
+		}
+		v.dss.Set(name, delegation{status: dsInsecure}, proof.ttl)
+		return dsInsecure, nil, nil
+	}
+
+	var status string
+	switch d := proof.deny(name, dns.TypeDS, resp.Rcode == dns.RcodeNameError); {
+	case d == denialNone:
+		return "", nil, fmt.Errorf("%w: absence of DS for %s not proven", errBogus, name)
+	case d == denialOptOut, proof.hasType(name, dns.TypeNS):
+		status = dsInsecure
+	default:
+		status = dsNoCut
+	}
+	v.dss.Set(name, delegation{status: status}, proof.ttl)
+	return status, nil, nil
+}
+
+// nameSecurity decides whether name lies in a signed zone by walking the
+// delegations from the root towards it. It returns secSecure when the zone
+// holding name is signed.
+func (v *validator) nameSecurity(ctx context.Context, name string) (security, string) {
+	name = dns.Fqdn(strings.ToLower(name))
+	if v.underNTA(name) {
+		return secInsecure, ""
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		ancestor := dns.Fqdn(strings.Join(labels[i:], "."))
+		status, _, err := v.delegationOf(ctx, ancestor)
+		if err != nil {
+			return secBogus, err.Error()
+		}
+		if status == dsInsecure {
+			return secInsecure, ""
+		}
+	}
+	return secSecure, ""
+}
+
+// verifyDenial checks the authority section of a negative answer for name.
+func (v *validator) verifyDenial(ctx context.Context, name string, qtype uint16, resp *dns.Msg) (security, string) {
+	proof, sec, why := v.denialRecords(ctx, resp)
+	if sec == secBogus {
+		return secBogus, why
+	}
+	if sec == secInsecure {
+		return secInsecure, ""
+	}
+	if len(proof.nsec) == 0 && len(proof.nsec3) == 0 {
+		// Unsigned negative answer: fine only for an unsigned zone.
+		if s, why := v.nameSecurity(ctx, name); s != secSecure {
+			return s, why
+		}
+		return secBogus, fmt.Sprintf("missing denial of existence for %s", name)
+	}
+
+	nxdomain := resp.Rcode == dns.RcodeNameError
+	switch proof.deny(name, qtype, nxdomain) {
+	case denialNone:
+		return secBogus, fmt.Sprintf("denial of existence for %s %s not proven", name, dns.TypeToString[qtype])
+	case denialOptOut:
+		return secInsecure, ""
+	}
+	return secSecure, ""
+}
+
+// denialRecords verifies the signed RRsets of resp's authority section and
+// collects its NSEC and NSEC3 records.
+func (v *validator) denialRecords(ctx context.Context, resp *dns.Msg) (*denialProof, security, string) {
+	proof := &denialProof{ttl: time.Hour}
+	result := secSecure
+	for _, set := range splitRRsets(resp.Ns) {
+		h := set.rrs[0].Header()
+		if h.Rrtype != dns.TypeSOA && h.Rrtype != dns.TypeNSEC && h.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		sec, why := v.verifyRRset(ctx, set)
+		if sec == secBogus {
+			return nil, secBogus, why
+		}
+		if sec == secInsecure {
+			result = secInsecure
+		}
+		proof.add(set)
+		proof.ttl = min(proof.ttl, v.ttl(set))
+	}
+	return proof, result, ""
+}
+
+// fetch queries name/qtype and rejects failures other than NXDOMAIN.
+func (v *validator) fetch(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	resp, err := v.query(ctx, name, qtype)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s %s: %w", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("fetching %s %s: rcode %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// ttl is how long a validated set may be cached: its TTL, but no longer than
+// its signatures remain valid.
+func (v *validator) ttl(set *rrset) time.Duration {
+	ttl := time.Duration(set.rrs[0].Header().Ttl) * time.Second
+	for _, sig := range set.sigs {
+		if exp := time.Unix(int64(sig.Expiration), 0).Sub(v.now()); exp < ttl {
+			ttl = exp
+		}
+	}
+	return ttl
+}
+
+// parentZone returns name with its first label removed.
+func parentZone(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+// matchesDS reports whether key hashes to one of ds.
+func matchesDS(key *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+			continue
+		}
+		if got := key.ToDS(d.DigestType); got != nil && strings.EqualFold(got.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrset is the records of one owner and type together with their RRSIGs.
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+	// wildcard is the label count of the wildcard the set was expanded from,
+	// as found by verifyRRset, or 0.
+	wildcard int
+}
+
+// splitRRsets groups rrs into RRsets in order of first appearance. OPT
+// records are skipped.
+func splitRRsets(rrs []dns.RR) []*rrset {
+	type key struct {
+		name  string
+		rtype uint16
+	}
+	var (
+		sets  []*rrset
+		index = make(map[key]*rrset)
+		sigs  []*dns.RRSIG
+	)
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch h.Rrtype {
+		case dns.TypeOPT:
+			continue
+		case dns.TypeRRSIG:
+			sigs = append(sigs, rr.(*dns.RRSIG))
+			continue
+		}
+		k := key{strings.ToLower(h.Name), h.Rrtype}
+		set, ok := index[k]
+		if !ok {
+			set = &rrset{}
+			index[k] = set
+			sets = append(sets, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+	for _, sig := range sigs {
+		if set, ok := index[key{strings.ToLower(sig.Hdr.Name), sig.TypeCovered}]; ok {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets
+}
+
+// chaseCNAME follows the CNAME chain for qname through answer. It returns
+// the final name and whether answer holds qtype records for it.
+func chaseCNAME(qname string, qtype uint16, answer []dns.RR) (string, bool) {
+	name := qname
+	for range len(answer) + 1 {
+		next := ""
+		for _, rr := range answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue
+			}
+			if h.Rrtype == qtype || qtype == dns.TypeANY {
+				return name, true
+			}
+			if c, ok := rr.(*dns.CNAME); ok {
+				next = strings.ToLower(c.Target)
+			}
+		}
+		if next == "" {
+			return name, false
+		}
+		name = next
+	}
+	return name, false
+}
+
+// stripDNSSEC removes signatures and denial records a client did not ask
+// for (RFC 4035 §3.2.1), unless the query was for one of those types.
+func stripDNSSEC(msg *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	msg.Extra = strip(msg.Extra)
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone with a freshly generated signing key.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("generate key for %s: %v", name, err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrs followed by an RRSIG over them valid from inception to
+// expiration.
+func (z *testZone) sign(t *testing.T, inception, expiration time.Time, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrs[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatalf("sign %s: %v", rrs[0].Header().Name, err)
+	}
+	return append(append([]dns.RR(nil), rrs...), sig)
+}
+
+// signed signs rrs with a validity period around the current time.
+func (z *testZone) signed(t *testing.T, rrs ...dns.RR) []dns.RR {
+	now := time.Now()
+	return z.sign(t, now.Add(-time.Hour), now.Add(time.Hour), rrs...)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return rr
+}
+
+// signedTree is an authoritative view of a small signed hierarchy: the root,
+// the signed zone example. and its unsigned delegation insecure.example.
+type signedTree struct {
+	root    *testZone
+	answers map[string]*dns.Msg // keyed by "name/TYPE"
+	queries atomic.Int64
+}
+
+func newSignedTree(t *testing.T) *signedTree {
+	t.Helper()
+	root := newTestZone(t, ".")
+	ex := newTestZone(t, "example.")
+	tree := &signedTree{root: root, answers: make(map[string]*dns.Msg)}
+
+	soa := ex.signed(t, mustRR(t, "example. 300 IN SOA ns.example. admin.example. 1 3600 600 86400 300"))
+	apexNSEC := ex.signed(t, mustRR(t, "example. 300 IN NSEC insecure.example. NS SOA RRSIG NSEC DNSKEY"))
+	insecureNSEC := ex.signed(t, mustRR(t, "insecure.example. 300 IN NSEC www.example. NS RRSIG NSEC"))
+	wwwNSEC := ex.signed(t, mustRR(t, "www.example. 300 IN NSEC example. A RRSIG NSEC"))
+	join := func(sets ...[]dns.RR) []dns.RR {
+		var out []dns.RR
+		for _, s := range sets {
+			out = append(out, s...)
+		}
+		return out
+	}
+	add := func(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+		tree.answers[name+"/"+dns.TypeToString[qtype]] = &dns.Msg{
+			MsgHdr: dns.MsgHdr{Rcode: rcode},
+			Answer: answer,
+			Ns:     ns,
+		}
+	}
+
+	add(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.signed(t, root.key), nil)
+	add("example.", dns.TypeDS, dns.RcodeSuccess, root.signed(t, ex.key.ToDS(dns.SHA256)), nil)
+	add("example.", dns.TypeDNSKEY, dns.RcodeSuccess, ex.signed(t, ex.key), nil)
+
+	add("www.example.", dns.TypeA, dns.RcodeSuccess, ex.signed(t, mustRR(t, "www.example. 300 IN A 192.0.2.1")), nil)
+	add("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil, join(soa, wwwNSEC))
+	add("www.example.", dns.TypeDS, dns.RcodeSuccess, nil, join(soa, wwwNSEC))
+	add("nope.example.", dns.TypeA, dns.RcodeNameError, nil, join(soa, insecureNSEC, apexNSEC))
+
+	add("insecure.example.", dns.TypeDS, dns.RcodeSuccess, nil, join(soa, insecureNSEC))
+	add("host.insecure.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{mustRR(t, "host.insecure.example. 300 IN A 192.0.2.9")}, nil)
+
+	// Broken data inside the signed zone.
+	bad := ex.signed(t, mustRR(t, "bogus.example. 300 IN A 192.0.2.66"))
+	bad[0] = mustRR(t, "bogus.example. 300 IN A 192.0.2.99")
+	add("bogus.example.", dns.TypeA, dns.RcodeSuccess, bad, nil)
+	now := time.Now()
+	add("expired.example.", dns.TypeA, dns.RcodeSuccess,
+		ex.sign(t, now.Add(-2*time.Hour), now.Add(-time.Hour), mustRR(t, "expired.example. 300 IN A 192.0.2.7")), nil)
+	add("unsigned.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{mustRR(t, "unsigned.example. 300 IN A 192.0.2.8")}, nil)
+	add("unsigned.example.", dns.TypeDS, dns.RcodeNameError, nil, join(soa, insecureNSEC, apexNSEC))
+
+	// Answers synthesised from *.wild.example., with and without the NSEC
+	// proving that the queried name does not exist.
+	expand := func(name string) []dns.RR {
+		set := ex.signed(t, mustRR(t, "*.wild.example. 300 IN A 192.0.2.5"))
+		for _, rr := range set {
+			rr.Header().Name = name
+		}
+		return set
+	}
+	wildNSEC := ex.signed(t, mustRR(t, "*.wild.example. 300 IN NSEC www.example. A RRSIG NSEC"))
+	add("a.wild.example.", dns.TypeA, dns.RcodeSuccess, expand("a.wild.example."), wildNSEC)
+	add("b.wild.example.", dns.TypeA, dns.RcodeSuccess, expand("b.wild.example."), nil)
+	return tree
+}
+
+// anchors returns a trust anchor for the tree's root key.
+func (tr *signedTree) anchors() []*dns.DS {
+	return []*dns.DS{tr.root.key.ToDS(dns.SHA256)}
+}
+
+// answer builds the reply to req from the tree, or SERVFAIL for unknown names.
+func (tr *signedTree) answer(req *dns.Msg) *dns.Msg {
+	tr.queries.Add(1)
+	q := req.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	data, ok := tr.answers[strings.ToLower(q.Name)+"/"+dns.TypeToString[q.Qtype]]
+	if !ok {
+		resp.Rcode = dns.RcodeServerFailure
+		return resp
+	}
+	resp.Rcode = data.Rcode
+	resp.Answer = append(resp.Answer, data.Answer...)
+	resp.Ns = append(resp.Ns, data.Ns...)
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return resp
+}
+
+func (tr *signedTree) query(_ context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return tr.answer(req), nil
+}
+
+func (tr *signedTree) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	_ = w.WriteMsg(tr.answer(req))
+}
+
+func newTestValidator(t *testing.T, tree *signedTree, ntas ...string) *validator {
+	t.Helper()
+	v := newValidator(ntas, tree.query, discardLogger())
+	v.anchors = tree.anchors()
+	return v
+}
+
+func TestValidator_Validate(t *testing.T) {
+	tree := newSignedTree(t)
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		want  security
+	}{
+		{"signed answer", "www.example.", dns.TypeA, secSecure},
+		{"NODATA proven by NSEC", "www.example.", dns.TypeAAAA, secSecure},
+		{"NXDOMAIN proven by NSEC", "nope.example.", dns.TypeA, secSecure},
+		{"unsigned delegation", "host.insecure.example.", dns.TypeA, secInsecure},
+		{"invalid signature", "bogus.example.", dns.TypeA, secBogus},
+		{"expired signature", "expired.example.", dns.TypeA, secBogus},
+		{"unsigned answer in signed zone", "unsigned.example.", dns.TypeA, secBogus},
+		{"wildcard expansion proven by NSEC", "a.wild.example.", dns.TypeA, secSecure},
+		{"wildcard expansion without proof", "b.wild.example.", dns.TypeA, secBogus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestValidator(t, tree)
+			resp, _ := tree.query(context.Background(), tt.qname, tt.qtype)
+			got, why := v.validate(context.Background(), tt.qname, tt.qtype, resp)
+			if got != tt.want {
+				t.Errorf("validate(%s %s) = %s (%s), want %s", tt.qname, dns.TypeToString[tt.qtype], got, why, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidator_WrongTrustAnchor(t *testing.T) {
+	tree := newSignedTree(t)
+	v := newTestValidator(t, tree)
+	v.anchors = []*dns.DS{newTestZone(t, ".").key.ToDS(dns.SHA256)}
+
+	resp, _ := tree.query(context.Background(), "www.example.", dns.TypeA)
+	if got, _ := v.validate(context.Background(), "www.example.", dns.TypeA, resp); got != secBogus {
+		t.Errorf("answer under an untrusted root: got %s, want bogus", got)
+	}
+}
+
+func TestValidator_NegativeTrustAnchor(t *testing.T) {
+	tree := newSignedTree(t)
+	v := newTestValidator(t, tree, "Example")
+
+	resp, _ := tree.query(context.Background(), "bogus.example.", dns.TypeA)
+	if got, _ := v.validate(context.Background(), "bogus.example.", dns.TypeA, resp); got != secInsecure {
+		t.Errorf("bogus answer under an NTA: got %s, want insecure", got)
+	}
+	if tree.queries.Load() != 1 {
+		t.Errorf("NTA should skip chain lookups, saw %d queries", tree.queries.Load())
+	}
+}
+
+func TestValidator_CachesChain(t *testing.T) {
+	tree := newSignedTree(t)
+	v := newTestValidator(t, tree)
+
+	resp, _ := tree.query(context.Background(), "www.example.", dns.TypeA)
+	if got, why := v.validate(context.Background(), "www.example.", dns.TypeA, resp); got != secSecure {
+		t.Fatalf("first validation: %s (%s)", got, why)
+	}
+	before := tree.queries.Load()
+
+	resp, _ = tree.query(context.Background(), "nope.example.", dns.TypeA)
+	if got, why := v.validate(context.Background(), "nope.example.", dns.TypeA, resp); got != secSecure {
+		t.Fatalf("second validation: %s (%s)", got, why)
+	}
+	if extra := tree.queries.Load() - before - 1; extra != 0 {
+		t.Errorf("validated keys and DS should be cached, saw %d chain queries", extra)
+	}
+}
+
+func TestStripDNSSEC(t *testing.T) {
+	tree := newSignedTree(t)
+	resp, _ := tree.query(context.Background(), "nope.example.", dns.TypeA)
+	stripDNSSEC(resp, dns.TypeA)
+	for _, rr := range resp.Ns {
+		if t2 := rr.Header().Rrtype; t2 != dns.TypeSOA {
+			t.Errorf("unexpected %s left in authority section", dns.TypeToString[t2])
+		}
+	}
+
+	resp, _ = tree.query(context.Background(), "example.", dns.TypeDNSKEY)
+	stripDNSSEC(resp, dns.TypeRRSIG)
+	if len(resp.Answer) != 2 {
+		t.Errorf("records of the queried type must stay, got %v", resp.Answer)
+	}
+}
+
+// startSignedServer serves a validating docker-dns in front of tree.
+func startSignedServer(t *testing.T, tree *signedTree) (string, *Server) {
+	t.Helper()
+	cfg := defaultTestConfig()
+	cfg.Resolvers = []string{startUpstream(t, tree)}
+	cfg.DNSSECValidate = true
+	srv := newTestServer(t, noopDocker(), cfg)
+	srv.dnssec.anchors = tree.anchors()
+	return serveTestDNS(t, srv), srv
+}
+
+func TestHandleForward_DNSSEC(t *testing.T) {
+	tree := newSignedTree(t)
+	addr, srv := startSignedServer(t, tree)
+	c := &dns.Client{Timeout: 3 * time.Second}
+
+	hasSig := func(m *dns.Msg) bool {
+		for _, rr := range m.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("secure answer with DO", func(t *testing.T) {
+		resp, _, err := c.Exchange(ednsQuery("www.example."), addr)
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || !resp.AuthenticatedData || !hasSig(resp) {
+			t.Errorf("want NOERROR, AD and RRSIGs; got %s AD=%v answer=%v", dns.RcodeToString[resp.Rcode], resp.AuthenticatedData, resp.Answer)
+		}
+	})
+
+	t.Run("secure answer without DO", func(t *testing.T) {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.", dns.TypeA)
+		req.AuthenticatedData = true
+		resp, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if !resp.AuthenticatedData || hasSig(resp) || len(resp.Answer) != 1 {
+			t.Errorf("want AD and no RRSIGs; got AD=%v answer=%v", resp.AuthenticatedData, resp.Answer)
+		}
+	})
+
+	t.Run("insecure answer", func(t *testing.T) {
+		resp, _, err := c.Exchange(ednsQuery("host.insecure.example."), addr)
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData || len(resp.Answer) != 1 {
+			t.Errorf("want NOERROR without AD; got %s AD=%v", dns.RcodeToString[resp.Rcode], resp.AuthenticatedData)
+		}
+	})
+
+	t.Run("bogus answer", func(t *testing.T) {
+		resp, _, err := c.Exchange(ednsQuery("bogus.example."), addr)
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if resp.Rcode != dns.RcodeServerFailure || len(resp.Answer) != 0 {
+			t.Fatalf("want SERVFAIL without data; got %s %v", dns.RcodeToString[resp.Rcode], resp.Answer)
+		}
+		var ede *dns.EDNS0_EDE
+		for _, o := range resp.IsEdns0().Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+		if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeDNSBogus {
+			t.Errorf("want EDE DNSSEC Bogus, got %v", ede)
+		}
+	})
+
+	t.Run("checking disabled passes bogus data through", func(t *testing.T) {
+		req := ednsQuery("bogus.example.")
+		req.CheckingDisabled = true
+		resp, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if resp.Rcode != dns.RcodeSuccess || !resp.CheckingDisabled || len(resp.Answer) == 0 {
+			t.Errorf("want raw NOERROR answer with CD; got %s CD=%v", dns.RcodeToString[resp.Rcode], resp.CheckingDisabled)
+		}
+	})
+
+	for result, want := range map[string]uint64{"secure": 2, "insecure": 1, "bogus": 1} {
+		if got := srv.metrics.DNSSECResults.Get(result); got != want {
+			t.Errorf("dnssec %s results = %d, want %d", result, got, want)
+		}
+	}
+}
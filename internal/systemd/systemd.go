@@ -0,0 +1,110 @@
+// Package systemd implements the parts of the systemd service protocol that
+// docker-dns uses, without linking libsystemd: socket activation
+// (sd_listen_fds) and service notifications (sd_notify).
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed by systemd socket activation, split
+// into datagram (UDP) and stream (TCP) sockets. It returns nothing when the
+// process was not socket-activated. The LISTEN_* variables are removed from
+// the environment so child processes do not inherit them.
+func Listeners() ([]net.PacketConn, []net.Listener, error) {
+	n := listenCount(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	files := make([]*os.File, 0, n)
+	for i := range n {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return sockets(files)
+}
+
+// listenCount returns the number of passed sockets, or 0 when they were
+// meant for another process.
+func listenCount(pid, fds string, self int) int {
+	if p, err := strconv.Atoi(pid); err != nil || p != self {
+		return 0
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// sockets turns socket files into connections and closes the files; the
+// connections hold duplicates of the descriptors.
+func sockets(files []*os.File) ([]net.PacketConn, []net.Listener, error) {
+	var (
+		packets []net.PacketConn
+		streams []net.Listener
+	)
+	for _, f := range files {
+		if ln, err := net.FileListener(f); err == nil {
+			streams = append(streams, ln)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			packets = append(packets, pc)
+		} else {
+			_ = f.Close()
+			return nil, nil, fmt.Errorf("socket %s is neither a stream nor a datagram socket: %w", f.Name(), err)
+		}
+		_ = f.Close()
+	}
+	return packets, streams, nil
+}
+
+// Notify sends a state string such as "READY=1" to the service manager. It
+// reports false without error when the process is not run by systemd with
+// NotifyAccess, i.e. NOTIFY_SOCKET is unset.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("connecting to the notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("notifying systemd: %w", err)
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval (WatchdogSec=) within which systemd
+// expects "WATCHDOG=1", or 0 when the watchdog is disabled for this process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,111 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestListenCount(t *testing.T) {
+	tests := []struct {
+		pid, fds string
+		want     int
+	}{
+		{"42", "2", 2},
+		{"43", "2", 0}, // meant for another process
+		{"", "2", 0},
+		{"42", "", 0},
+		{"42", "-1", 0},
+	}
+	for _, tt := range tests {
+		if got := listenCount(tt.pid, tt.fds, 42); got != tt.want {
+			t.Errorf("listenCount(%q, %q) = %d, want %d", tt.pid, tt.fds, got, tt.want)
+		}
+	}
+}
+
+func TestListeners_NotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	packets, streams, err := Listeners()
+	if err != nil || len(packets) != 0 || len(streams) != 0 {
+		t.Errorf("Listeners() = %v, %v, %v; want nothing", packets, streams, err)
+	}
+}
+
+func TestSockets(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pf, _ := pc.(*net.UDPConn).File()
+	lf, _ := ln.(*net.TCPListener).File()
+
+	packets, streams, err := sockets([]*os.File{pf, lf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || packets[0].LocalAddr().String() != pc.LocalAddr().String() {
+		t.Errorf("packets = %v, want the UDP socket", packets)
+	}
+	if len(streams) != 1 || streams[0].Addr().String() != ln.Addr().String() {
+		t.Errorf("streams = %v, want the TCP socket", streams)
+	}
+	for _, c := range packets {
+		_ = c.Close()
+	}
+	for _, l := range streams {
+		_ = l.Close()
+	}
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify("READY=1"); ok || err != nil {
+		t.Errorf("Notify without NOTIFY_SOCKET = %v, %v", ok, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if ok, err := Notify("READY=1\nSTATUS=serving"); !ok || err != nil {
+		t.Fatalf("Notify = %v, %v", ok, err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1\nSTATUS=serving" {
+		t.Errorf("received %q, %v", buf[:n], err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 30*time.Second {
+		t.Errorf("WatchdogInterval() = %v, want 30s", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("watchdog meant for another process: got %v", got)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("disabled watchdog: got %v", got)
+	}
+}
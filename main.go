@@ -14,6 +14,12 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+
 	cfg, err := config.Load()
 	if err != nil {
 		// Use plain log here because slog isn't configured yet.
@@ -22,10 +28,9 @@ func main() {
 	}
 
 	// Structured JSON logger for production; swap to NewTextHandler for dev.
-	var logLevel slog.Level
-	if err := logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
-		logLevel = slog.LevelInfo
-	}
+	// The level is a LevelVar so that a reload can change it.
+	logLevel := new(slog.LevelVar)
+	setLogLevel(logLevel, cfg.LogLevel)
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
 	slog.SetDefault(logger)
 
@@ -46,12 +51,30 @@ func main() {
 	}()
 
 	// Assemble the DNS server.
-	srv := server.New(cfg, dnsCache, dockerClient, logger)
+	srv, err := server.New(cfg, dnsCache, dockerClient, logger)
+	if err != nil {
+		slog.Error("failed to initialise server", "error", err)
+		os.Exit(1)
+	}
 
 	// Capture SIGINT / SIGTERM for graceful shutdown.
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// SIGHUP reloads the configuration and the certificates of the TLS
+	// listeners, keeping the listeners and the cache.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if next, err := srv.Reload(config.Load); err == nil {
+				setLogLevel(logLevel, next.LogLevel)
+			}
+			_ = srv.ReloadCertificates()
+		}
+	}()
+
 	if err := srv.Run(ctx); err != nil {
 		slog.Error("server exited with error", "error", err)
 		os.Exit(1)
@@ -59,3 +82,12 @@ func main() {
 
 	slog.Info("shutdown complete")
 }
+
+// setLogLevel applies a validated --log-level value.
+func setLogLevel(v *slog.LevelVar, level string) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		l = slog.LevelInfo
+	}
+	v.Set(l)
+}
@@ -240,6 +240,18 @@ else
     fail "docker-dns service is NOT enabled"
 fi
 
+if docker exec "$CONTAINER_NAME" systemctl is-active --quiet docker-dns.socket; then
+    pass "docker-dns socket is active"
+else
+    fail "docker-dns socket is NOT active"
+fi
+
+if docker exec "$CONTAINER_NAME" docker-dns check-config /etc/docker-dns/docker-dns.yaml >/dev/null; then
+    pass "installed configuration passes check-config"
+else
+    fail "installed configuration fails check-config"
+fi
+
 # Config assertion: detect which of the three postinst branches was taken.
 # Mirrors postinst's logic: resolved first, then NetworkManager, then plain resolv.conf.
 MODE=resolvconf
@@ -365,6 +377,12 @@ else
     fail "docker-dns service is still active after uninstall"
 fi
 
+if ! docker exec "$CONTAINER_NAME" systemctl is-active --quiet docker-dns.socket 2>/dev/null; then
+    pass "docker-dns socket is not active"
+else
+    fail "docker-dns socket is still active after uninstall"
+fi
+
 # DNS config cleaned: branch on the same MODE detected pre-install.
 case "$MODE" in
     resolved)